@@ -0,0 +1,228 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"trafRep/internal/stream"
+	msgtypes "trafRep/internal/stream/message_types"
+)
+
+type ExportFormat int
+
+const (
+	ExportPgbenchWeighted ExportFormat = iota
+	ExportSQL
+	ExportPgbench
+)
+
+var exportFormatNames = map[ExportFormat]string{
+	ExportPgbenchWeighted: "pgbench-weighted",
+	ExportSQL:             "sql",
+	ExportPgbench:         "pgbench",
+}
+
+var exportFormatValues = map[string]ExportFormat{
+	"pgbench-weighted": ExportPgbenchWeighted,
+	"sql":              ExportSQL,
+	"pgbench":          ExportPgbench,
+}
+
+func (ef ExportFormat) String() string {
+	if s, ok := exportFormatNames[ef]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// Set парсит строковое значение флага --format команды export.
+func (ef *ExportFormat) Set(s string) error {
+	if v, ok := exportFormatValues[strings.ToLower(s)]; ok {
+		*ef = v
+		return nil
+	}
+
+	keys := make([]string, 0, len(exportFormatValues))
+	for k := range exportFormatValues {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return fmt.Errorf("invalid format value: %q (allowed: %s)", s, strings.Join(keys, "|"))
+}
+
+func (ef ExportFormat) Type() string {
+	return "exportFormat"
+}
+
+var (
+	exportFormat = ExportPgbenchWeighted
+	exportOut    string
+)
+
+// ExportCmd извлекает простые запросы из pcap и сохраняет их в виде, пригодном для внешних
+// инструментов нагрузки.
+var ExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Экспорт запросов из pcap файла для внешних инструментов",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		packets, err := StreamAllPackets()
+		if err != nil {
+			return err
+		}
+
+		opts, err := extractOptions(stream.DirectionBoth)
+		if err != nil {
+			return err
+		}
+		messages, manager := stream.ExtractMessages(packets, opts)
+		if PcapVerifyRoundtrip {
+			Logger.Info("round-trip verification", "mismatched", manager.RoundtripMismatches())
+		}
+		if len(messages) == 0 {
+			Logger.Warn("no messages extracted, nothing to export")
+			return nil
+		}
+
+		switch exportFormat {
+		case ExportPgbenchWeighted:
+			return exportPgbenchWeighted(messages, exportOut)
+		case ExportSQL, ExportPgbench:
+			return exportScript(messages, exportOut, exportFormat)
+		}
+		return nil
+	},
+}
+
+// exportPgbenchWeighted пишет в каталог dir по скрипту pgbench на каждую форму запроса
+// (stream.Fingerprint) и файл run.sh с вызовом pgbench, где вес каждого скрипта равен
+// частоте формы в захвате. Литералы заменяются переменными pgbench со случайными значениями.
+//
+// Ограничения: исходные интервалы между запросами не воспроизводятся, реальные значения
+// литералов теряются, а строковые литералы получают числовые значения.
+func exportPgbenchWeighted(messages []stream.PostgreSQLMessage, dir string) error {
+	if dir == "" {
+		return fmt.Errorf("--out directory is required for pgbench-weighted format")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create output dir: %w", err)
+	}
+
+	stats := stream.AggregateFingerprints(messages, 1)
+	args := []string{"pgbench", "-n"}
+	for i, st := range stats {
+		name := fmt.Sprintf("q%03d.sql", i+1)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(pgbenchScript(st)), 0o644); err != nil {
+			return fmt.Errorf("write %s: %w", name, err)
+		}
+		args = append(args, fmt.Sprintf("-f %s@%d", name, st.Count))
+	}
+
+	run := "#!/bin/sh\n# weights reflect query frequency in the capture\ncd \"$(dirname \"$0\")\"\n" +
+		strings.Join(args, " ") + " \"$@\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "run.sh"), []byte(run), 0o755); err != nil {
+		return fmt.Errorf("write run.sh: %w", err)
+	}
+	Logger.Info("exported query shapes", "count", len(stats), "dir", dir)
+	return nil
+}
+
+// exportScript пишет простые запросы в порядке захвата в файл path (stdout, если path пуст),
+// по одному оператору, завершённому точкой с запятой: для ExportSQL — скрипт для psql -f
+// с комментарием о времени и клиенте перед каждым запросом, для ExportPgbench — скрипт
+// для pgbench -n -f. Сообщения расширенного протокола не переносятся: значения параметров
+// Bind в скрипт не подставляются, поэтому вместо Parse пишется комментарий с текстом оператора.
+// COPY FROM STDIN также комментируется — данные CopyData в скрипт не попадают.
+func exportScript(messages []stream.PostgreSQLMessage, path string, format ExportFormat) error {
+	var sb strings.Builder
+	if format == ExportPgbench {
+		sb.WriteString("-- pgbench script exported from capture; run with: pgbench -n -f <file>\n")
+	}
+	written, skipped := 0, 0
+	for _, m := range messages {
+		switch {
+		case m.Type.IsSimpleQuery():
+			query := strings.TrimSuffix(m.PrettyQuery(), ";")
+			if query == "" {
+				continue
+			}
+			if copyFromStdin(query) {
+				fmt.Fprintf(&sb, "-- skipped COPY FROM STDIN: %s\n", oneLine(query))
+				skipped++
+				continue
+			}
+			if format == ExportSQL {
+				fmt.Fprintf(&sb, "-- %s %s\n", m.FirstTCPPacketTimestamp.Format(time.RFC3339Nano), m.ClientAddr())
+			}
+			sb.WriteString(query + ";\n")
+			written++
+		case m.Type.AwaitsSync() || m.Type == msgtypes.MessageTypeSync:
+			skipped++
+			if p, ok := m.Parse(); ok {
+				fmt.Fprintf(&sb, "-- skipped Parse (extended protocol): %s\n", oneLine(p.Query))
+			}
+		}
+	}
+
+	if path == "" {
+		if _, err := os.Stdout.WriteString(sb.String()); err != nil {
+			return fmt.Errorf("write script: %w", err)
+		}
+	} else if err := os.WriteFile(path, []byte(sb.String()), 0o644); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	Logger.Info("exported queries", "count", written, "skipped", skipped)
+	return nil
+}
+
+// copyFromStdin сообщает, что запрос — COPY ... FROM STDIN: psql читал бы данные для него
+// из самого скрипта.
+func copyFromStdin(query string) bool {
+	fields := strings.Fields(strings.ToUpper(query))
+	if len(fields) == 0 || fields[0] != "COPY" {
+		return false
+	}
+	for i := 1; i < len(fields); i++ {
+		if fields[i-1] == "FROM" && strings.TrimSuffix(fields[i], ";") == "STDIN" {
+			return true
+		}
+	}
+	return false
+}
+
+// oneLine сворачивает пробельные символы запроса в одиночные пробелы, чтобы он поместился
+// в однострочный комментарий.
+func oneLine(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// pgbenchScript строит скрипт pgbench для одной формы запроса: по переменной \set на литерал.
+func pgbenchScript(st stream.FingerprintStat) string {
+	var sets []string
+	query := stream.NormalizeLiterals(st.Example, func(kind stream.LiteralKind) string {
+		name := fmt.Sprintf("p%d", len(sets)+1)
+		sets = append(sets, fmt.Sprintf("\\set %s random(1, 100000)", name))
+		if kind == stream.LiteralString {
+			return "':" + name + "'"
+		}
+		return ":" + name
+	})
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "-- %d occurrences: %s\n", st.Count, st.Fingerprint)
+	for _, s := range sets {
+		sb.WriteString(s + "\n")
+	}
+	sb.WriteString(strings.TrimSuffix(query, ";") + ";\n")
+	return sb.String()
+}
+
+func init() {
+	ExportCmd.Flags().Var(&exportFormat, "format", "Формат экспорта: pgbench-weighted, sql, pgbench")
+	ExportCmd.Flags().StringVar(&exportOut, "out", "", "Каталог для pgbench-weighted или файл для sql и pgbench (по умолчанию stdout)")
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/spf13/cobra"
+
+	"trafRep/internal/stream"
+)
+
+var (
+	queryRegex      string
+	includeNonQuery bool
+)
+
+// addQueryFilterFlags регистрирует на c флаги отбора сообщений по тексту запроса.
+func addQueryFilterFlags(c *cobra.Command) {
+	c.Flags().StringVar(&queryRegex, "query-regex", "", "Оставить только простые запросы, текст которых совпадает с регулярным выражением")
+	c.Flags().BoolVar(&includeNonQuery, "include-non-query", false, "С --query-regex сохранять сообщения других типов (startup, расширенный протокол и т.д.)")
+}
+
+// filterByQuery оставляет простые запросы, чей PrettyQuery совпадает с --query-regex.
+// Остальные сообщения сохраняются только с --include-non-query. Без --query-regex
+// messages возвращаются без изменений.
+func filterByQuery(messages []stream.PostgreSQLMessage) ([]stream.PostgreSQLMessage, error) {
+	if queryRegex == "" {
+		return messages, nil
+	}
+	re, err := regexp.Compile(queryRegex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --query-regex: %w", err)
+	}
+	out := messages[:0]
+	for _, m := range messages {
+		if m.Type.IsSimpleQuery() {
+			if re.MatchString(m.PrettyQuery()) {
+				out = append(out, m)
+			}
+			continue
+		}
+		if includeNonQuery {
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
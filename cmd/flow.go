@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	pcappkg "trafRep/internal/pcap"
+)
+
+var PcapFlow string
+
+// flowEndpoint — одна сторона потока из --flow.
+type flowEndpoint struct {
+	ip   string
+	port uint16
+}
+
+// parseFlowEndpoint разбирает "ip:port"; IPv6-адрес пишется как в ключе потока
+// ("::1:54321") или в квадратных скобках ("[::1]:54321").
+func parseFlowEndpoint(s string) (flowEndpoint, error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return flowEndpoint{}, fmt.Errorf("%q is not ip:port", s)
+	}
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s[:i], "["), "]"))
+	if ip == nil {
+		return flowEndpoint{}, fmt.Errorf("invalid ip in %q", s)
+	}
+	port, err := strconv.ParseUint(s[i+1:], 10, 16)
+	if err != nil || port == 0 {
+		return flowEndpoint{}, fmt.Errorf("invalid port in %q", s)
+	}
+	return flowEndpoint{ip: ip.String(), port: uint16(port)}, nil
+}
+
+// flowFilter — разобранный --flow. server нулевой, если задана только сторона клиента.
+type flowFilter struct {
+	client flowEndpoint
+	server flowEndpoint
+}
+
+// parseFlow разбирает --flow: ключ потока "client_ip:port->server_ip:port" в формате
+// TCPStreamManager.AddPacket или только сторона клиента "ip:port". Для пустой строки
+// возвращается nil.
+func parseFlow(s string) (*flowFilter, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	clientPart, serverPart, full := strings.Cut(s, "->")
+	var f flowFilter
+	var err error
+	if f.client, err = parseFlowEndpoint(strings.TrimSpace(clientPart)); err != nil {
+		return nil, fmt.Errorf("invalid --flow: %w", err)
+	}
+	if full {
+		if f.server, err = parseFlowEndpoint(strings.TrimSpace(serverPart)); err != nil {
+			return nil, fmt.Errorf("invalid --flow: %w", err)
+		}
+	}
+	return &f, nil
+}
+
+// matches сообщает, что пакет принадлежит потоку в любом направлении: с заданным ключом —
+// идёт между client и server, с одной стороной клиента — она источник или получатель.
+func (f *flowFilter) matches(pkt pcappkg.TCPPacket) bool {
+	src := flowEndpoint{pkt.IPSource, pkt.PortSource}
+	dst := flowEndpoint{pkt.IPDest, pkt.PortDest}
+	if f.server == (flowEndpoint{}) {
+		return src == f.client || dst == f.client
+	}
+	return (src == f.client && dst == f.server) || (src == f.server && dst == f.client)
+}
+
+// filterByFlow пропускает пакеты потока f; nil ничего не отбрасывает.
+func filterByFlow(in <-chan pcappkg.TCPPacket, f *flowFilter) <-chan pcappkg.TCPPacket {
+	if f == nil {
+		return in
+	}
+	out := make(chan pcappkg.TCPPacket, 1024)
+	go func() {
+		defer close(out)
+		total, kept := 0, 0
+		for pkt := range in {
+			total++
+			if !f.matches(pkt) {
+				continue
+			}
+			out <- pkt
+			kept++
+		}
+		Logger.Info("kept tcp packets of the --flow", "flow", PcapFlow, "kept", kept, "total", total)
+	}()
+	return out
+}
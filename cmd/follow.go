@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	pcappkg "trafRep/internal/pcap"
+	"trafRep/internal/stream"
+)
+
+// checkFollowFlags проверяет, что с --follow не заданы флаги, которым нужен весь захват
+// целиком: сводки, постраничный вывод и серверные сообщения.
+func checkFollowFlags() error {
+	switch {
+	case PcapInterface != "":
+		return fmt.Errorf("--follow reads --pcap; use --interface alone for live capture")
+	case printFingerprints:
+		return fmt.Errorf("--follow cannot be combined with --fingerprints")
+	case printLimit > 0 || printOffset > 0:
+		return fmt.Errorf("--follow cannot be combined with --limit or --offset")
+	case printServerMessages || printFilterSide == FilterServer:
+		return fmt.Errorf("--follow prints client messages only, drop --server-messages and --filter server")
+	case printNotifications || printNotices:
+		return fmt.Errorf("--follow cannot be combined with --notifications or --notices")
+	}
+	// ошибку в --query-regex лучше показать сразу, а не после первого соединения
+	_, err := filterByQuery(nil)
+	return err
+}
+
+// followPrint собирает сообщения из packets и печатает в w сообщения каждого соединения,
+// как только клиент его завершил (Terminate) и получил ответы, — сессия за сессией, с
+// заголовком при --group-by-session. Соединения, не завершённые к концу packets
+// (Ctrl+C), печатаются последними. Номера сообщений сквозные.
+func followPrint(w io.Writer, packets <-chan pcappkg.TCPPacket, opts stream.ExtractOptions) error {
+	enc := json.NewEncoder(w)
+	if printJSONPretty {
+		enc.SetIndent("", "  ")
+	}
+	var csvw *csv.Writer
+	if printFormat == FormatCSV {
+		csvw = csv.NewWriter(w)
+		if err := csvw.Write(csvHeader); err != nil {
+			return fmt.Errorf("write csv header: %w", err)
+		}
+	}
+	flusher, _ := w.(interface{ Flush() error })
+
+	index := 0
+	printBatch := func(messages []stream.PostgreSQLMessage) error {
+		messages, err := filterByQuery(messages)
+		if err != nil {
+			return err
+		}
+		for i, m := range messages {
+			if printGroupBySession && printFormat != FormatJSON && printFormat != FormatCSV && (i == 0 || messages[i-1].StreamID != m.StreamID) {
+				fmt.Fprintf(w, "=== session %s ===\n", m.StreamID)
+			}
+			index++
+			if err := printClientMessage(w, index, m, enc, csvw); err != nil {
+				return err
+			}
+		}
+		if csvw != nil {
+			csvw.Flush()
+			if err := csvw.Error(); err != nil {
+				return fmt.Errorf("write csv: %w", err)
+			}
+		}
+		if flusher != nil {
+			if err := flusher.Flush(); err != nil {
+				return fmt.Errorf("write output file: %w", err)
+			}
+		}
+		return nil
+	}
+
+	var printErr error
+	opts.OnStreamClosed = func(_ string, messages []stream.PostgreSQLMessage) {
+		if printErr == nil {
+			printErr = printBatch(messages)
+		}
+	}
+	// остаток возвращается отсортированным по времени, сообщения завершённого потока — в его порядке
+	rest, _ := stream.ExtractMessages(packets, opts)
+	if printErr != nil {
+		return printErr
+	}
+	if printGroupBySession {
+		entries := make([]printEntry, len(rest))
+		for i := range rest {
+			entries[i] = printEntry{client: &rest[i]}
+		}
+		grouped := make([]stream.PostgreSQLMessage, 0, len(rest))
+		for _, e := range groupBySession(entries) {
+			grouped = append(grouped, *e.client)
+		}
+		rest = grouped
+	}
+	return printBatch(rest)
+}
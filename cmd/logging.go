@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+var LogLevel string
+
+// Logger — журнал диагностических сообщений команд и внутренних пакетов. Пишет в stderr,
+// чтобы не смешиваться с результатами в stdout; уровень задаётся --log-level.
+var Logger = slog.Default()
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// setupLogger создаёт Logger с уровнем --log-level и делает его журналом по умолчанию,
+// так что уровень соблюдают и сообщения стандартного пакета log.
+func setupLogger() error {
+	level, ok := logLevels[strings.ToLower(LogLevel)]
+	if !ok {
+		return fmt.Errorf("invalid --log-level value: %q (allowed: debug|info|warn|error)", LogLevel)
+	}
+	Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(Logger)
+	return nil
+}
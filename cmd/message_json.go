@@ -0,0 +1,228 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"trafRep/internal/stream"
+	msgtypes "trafRep/internal/stream/message_types"
+)
+
+// jsonMessage — представление PostgreSQLMessage (и ServerMessage, уведомлений NOTIFY и
+// NoticeResponse, см. newJSONServerMessage, newJSONNotification и newJSONNotice) для вывода
+// print --format json и csv.
+// Используется структура, а не map, чтобы порядок полей был стабильным и вывод
+// можно было сравнивать diff'ом.
+type jsonMessage struct {
+	Index             int        `json:"index"`
+	FirstTs           time.Time  `json:"first_ts"`
+	LastTs            time.Time  `json:"last_ts"`
+	Type              string     `json:"type"`
+	CommandCompleteTs *time.Time `json:"command_complete_ts,omitempty"`
+	ReadyForQueryTs   *time.Time `json:"ready_for_query_ts,omitempty"`
+	LatencyMicros     *int64     `json:"latency_us,omitempty"`
+	Query             string     `json:"query,omitempty"`
+	PayloadLen        int        `json:"payload_len"`
+	Client            string     `json:"client"`
+	Stream            string     `json:"stream"`
+	Direction         string     `json:"direction"`
+	CommandTag        string     `json:"command_tag,omitempty"`
+	Rows              *int64     `json:"rows,omitempty"`
+	// Channel и PID — канал и процесс-отправитель уведомления NOTIFY
+	Channel string  `json:"channel,omitempty"`
+	PID     *uint32 `json:"pid,omitempty"`
+}
+
+func newJSONMessage(index int, m stream.PostgreSQLMessage) jsonMessage {
+	jm := jsonMessage{
+		Index:      index,
+		FirstTs:    m.FirstTCPPacketTimestamp,
+		LastTs:     m.LastTCPPacketTimestamp,
+		Type:       m.Type.String(),
+		Query:      messageSummary(m),
+		PayloadLen: len(m.Payload),
+		Client:     m.ClientAddr(),
+		Stream:     m.StreamID,
+		Direction:  "client",
+		CommandTag: m.CommandTag,
+	}
+	if rows, ok := m.RowsAffected(); ok {
+		jm.Rows = &rows
+	}
+	if !m.CommandCompleteTimestamp.IsZero() {
+		ts := m.CommandCompleteTimestamp
+		jm.CommandCompleteTs = &ts
+	}
+	if !m.ReadyForQueryTimestamp.IsZero() {
+		ts := m.ReadyForQueryTimestamp
+		jm.ReadyForQueryTs = &ts
+	}
+	if d, ok := messageLatency(m); ok {
+		us := d.Microseconds()
+		jm.LatencyMicros = &us
+	}
+	return jm
+}
+
+// newJSONServerMessage представляет серверное сообщение: обе метки времени равны времени
+// прихода, в query — тег, текст ошибки или столбцы (см. ServerMessage.Summary).
+func newJSONServerMessage(index int, m stream.ServerMessage) jsonMessage {
+	return jsonMessage{
+		Index:      index,
+		FirstTs:    m.Timestamp,
+		LastTs:     m.Timestamp,
+		Type:       m.Type.String(),
+		Query:      m.Summary(),
+		PayloadLen: int(m.Len) - 4,
+		Client:     net.JoinHostPort(m.ClientIP, strconv.Itoa(int(m.ClientPort))),
+		Stream:     m.StreamID,
+		Direction:  "server",
+	}
+}
+
+// newJSONNotification представляет уведомление LISTEN/NOTIFY: в query — полезная нагрузка,
+// канал и PID отправителя — в отдельных полях.
+func newJSONNotification(index int, n stream.Notification) jsonMessage {
+	pid := n.PID
+	return jsonMessage{
+		Index:      index,
+		FirstTs:    n.Timestamp,
+		LastTs:     n.Timestamp,
+		Type:       msgtypes.MessageTypeNotificationResponse.String(),
+		Query:      n.Payload,
+		PayloadLen: len(n.Payload),
+		Direction:  "server",
+		Channel:    n.Channel,
+		PID:        &pid,
+	}
+}
+
+// newJSONNotice представляет NoticeResponse: в query — уровень, код и текст, как у ошибок
+// серверных сообщений.
+func newJSONNotice(index int, n stream.Notice) jsonMessage {
+	return jsonMessage{
+		Index:     index,
+		FirstTs:   n.Timestamp,
+		LastTs:    n.Timestamp,
+		Type:      msgtypes.MessageTypeNoticeResponse.String(),
+		Query:     n.Response.Error(),
+		Direction: "server",
+	}
+}
+
+// csvHeader — столбцы print --format csv, в порядке csvRecord.
+var csvHeader = []string{
+	"index", "first_ts", "last_ts", "command_complete_ts", "ready_for_query_ts", "type", "payload_len", "query", "direction",
+	"command_tag", "rows", "channel", "pid",
+}
+
+// csvRecord возвращает строку CSV с теми же значениями, что и JSON; отсутствующие
+// метки времени — пустые ячейки.
+func (jm jsonMessage) csvRecord() []string {
+	ts := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339Nano)
+	}
+	rows := ""
+	if jm.Rows != nil {
+		rows = strconv.FormatInt(*jm.Rows, 10)
+	}
+	pid := ""
+	if jm.PID != nil {
+		pid = strconv.FormatUint(uint64(*jm.PID), 10)
+	}
+	return []string{
+		strconv.Itoa(jm.Index),
+		jm.FirstTs.Format(time.RFC3339Nano),
+		jm.LastTs.Format(time.RFC3339Nano),
+		ts(jm.CommandCompleteTs),
+		ts(jm.ReadyForQueryTs),
+		jm.Type,
+		strconv.Itoa(jm.PayloadLen),
+		jm.Query,
+		jm.Direction,
+		jm.CommandTag,
+		rows,
+		jm.Channel,
+		pid,
+	}
+}
+
+// jsonFingerprint — строка сводки print --fingerprints для --format json и csv.
+type jsonFingerprint struct {
+	Index            int    `json:"index"`
+	Count            int    `json:"count"`
+	Fingerprint      string `json:"fingerprint"`
+	Example          string `json:"example"`
+	AvgLatencyMicros *int64 `json:"avg_latency_us,omitempty"`
+}
+
+func newJSONFingerprint(index int, st stream.FingerprintStat) jsonFingerprint {
+	jf := jsonFingerprint{
+		Index:       index,
+		Count:       st.Count,
+		Fingerprint: st.Fingerprint,
+		Example:     st.Example,
+	}
+	if st.LatencySamples > 0 {
+		us := st.AvgLatency().Microseconds()
+		jf.AvgLatencyMicros = &us
+	}
+	return jf
+}
+
+// fingerprintCSVHeader — столбцы print --fingerprints --format csv, в порядке csvRecord.
+var fingerprintCSVHeader = []string{"index", "count", "fingerprint", "example", "avg_latency_us"}
+
+// csvRecord возвращает строку CSV с теми же значениями, что и JSON; без замеров задержки
+// ячейка пуста.
+func (jf jsonFingerprint) csvRecord() []string {
+	latency := ""
+	if jf.AvgLatencyMicros != nil {
+		latency = strconv.FormatInt(*jf.AvgLatencyMicros, 10)
+	}
+	return []string{strconv.Itoa(jf.Index), strconv.Itoa(jf.Count), jf.Fingerprint, jf.Example, latency}
+}
+
+// messageLatency возвращает время от первого пакета сообщения до CommandComplete.
+// ok == false, если CommandComplete не попал в захват.
+func messageLatency(m stream.PostgreSQLMessage) (d time.Duration, ok bool) {
+	if m.CommandCompleteTimestamp.IsZero() {
+		return 0, false
+	}
+	return m.CommandCompleteTimestamp.Sub(m.FirstTCPPacketTimestamp), true
+}
+
+// formatLatency округляет задержку для таблицы: до 0.1ms от миллисекунды, иначе до микросекунды.
+func formatLatency(d time.Duration) string {
+	if d >= time.Millisecond {
+		return d.Round(100 * time.Microsecond).String()
+	}
+	return d.Round(time.Microsecond).String()
+}
+
+// messageSummary возвращает текст для колонки запроса: SQL простого запроса или Parse,
+// user/db для StartupMessage, пометку о сжатом потоке. Для остальных сообщений — "".
+func messageSummary(m stream.PostgreSQLMessage) string {
+	switch {
+	case m.Compression != "" && m.Type.HaveTypeByte():
+		return fmt.Sprintf("<compressed stream: %s>", m.Compression)
+	case m.Type.IsSimpleQuery():
+		return m.PrettyQuery()
+	case !m.Type.HaveTypeByte():
+		if sm, ok := m.StartupMessage(); ok {
+			user, _ := sm.Get("user")
+			db, _ := sm.Get("database")
+			return fmt.Sprintf("user=%s db=%s", user, db)
+		}
+	case m.Type == msgtypes.MessageTypeParse:
+		if p, ok := m.Parse(); ok {
+			return p.Query
+		}
+	}
+	return ""
+}
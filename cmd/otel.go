@@ -0,0 +1,13 @@
+//go:build otel
+
+package cmd
+
+import (
+	"trafRep/internal/otel"
+	"trafRep/internal/replay"
+)
+
+// newTracer создаёт экспортёр OpenTelemetry для --otel-endpoint.
+func newTracer(endpoint string) (replay.Tracer, error) {
+	return otel.NewTracer(endpoint)
+}
@@ -0,0 +1,15 @@
+//go:build !otel
+
+package cmd
+
+import (
+	"fmt"
+
+	"trafRep/internal/replay"
+)
+
+// newTracer в сборке без тега otel всегда возвращает ошибку: поддержка OpenTelemetry
+// включается сборкой с `go build -tags otel`.
+func newTracer(endpoint string) (replay.Tracer, error) {
+	return nil, fmt.Errorf("--otel-endpoint %q: binary built without otel support (rebuild with -tags otel)", endpoint)
+}
@@ -1,15 +1,18 @@
 package cmd
 
 import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
-	"log"
-	"net"
+	"io"
+	"os"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
-	pcappkg "trafRep/internal/pcap"
 	"trafRep/internal/stream"
 )
 
@@ -65,73 +68,449 @@ func (fs FilterSide) Type() string {
 	return "filterSide"
 }
 
+// direction возвращает направление потока, которое собирается при данном --filter.
+func (fs FilterSide) direction() stream.Direction {
+	switch fs {
+	case FilterClients:
+		return stream.DirectionClient
+	case FilterServer:
+		return stream.DirectionServer
+	}
+	return stream.DirectionBoth
+}
+
+type PrintFormat int
+
+const (
+	FormatTable PrintFormat = iota
+	FormatWireshark
+	FormatJSON
+	FormatCSV
+)
+
+var printFormatNames = map[PrintFormat]string{
+	FormatTable:     "table",
+	FormatWireshark: "wireshark",
+	FormatJSON:      "json",
+	FormatCSV:       "csv",
+}
+
+var printFormatValues = map[string]PrintFormat{
+	"table":     FormatTable,
+	"wireshark": FormatWireshark,
+	"json":      FormatJSON,
+	"csv":       FormatCSV,
+}
+
+func (pf PrintFormat) String() string {
+	if s, ok := printFormatNames[pf]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// Set парсит строковое значение флага --format (--output). Пустое значение означает table.
+func (pf *PrintFormat) Set(s string) error {
+	if s == "" {
+		*pf = FormatTable
+		return nil
+	}
+	if v, ok := printFormatValues[strings.ToLower(s)]; ok {
+		*pf = v
+		return nil
+	}
+
+	keys := make([]string, 0, len(printFormatValues))
+	for k := range printFormatValues {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return fmt.Errorf("invalid format value: %q (allowed: %s)", s, strings.Join(keys, "|"))
+}
+
+func (pf PrintFormat) Type() string {
+	return "printFormat"
+}
+
 var printFilterSide = FilterBoth
+var printFormat = FormatTable
+var printJSONPretty bool
+var printNotifications bool
+var printNotices bool
+var printFingerprints bool
+var printMinOccurrences int
+var printLimit int
+var printOffset int
+var printGroupBySession bool
+var printServerMessages bool
+var printOut string
 
-// PrintCmd читает pcap, собирает клиентские PostgreSQL‑сообщения (с учётом флага --filter)
-// и печатает их в stdout. Команда использует GetPcapHandle и пакет internal/pcap для извлечения пакетов.
+// PrintCmd читает pcap, собирает клиентские (с --server-messages и серверные) PostgreSQL‑сообщения (с учётом флага --filter)
+// и печатает их в stdout или в файл --out. Команда использует GetPcapHandle и пакет internal/pcap для извлечения пакетов.
 var PrintCmd = &cobra.Command{
 	Use:   "print",
 	Short: "Печать информации из pcap файла",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		handle, err := GetPcapHandle()
+		if PcapFollow {
+			if err := checkFollowFlags(); err != nil {
+				return err
+			}
+		}
+		if printFingerprints && printFormat == FormatWireshark {
+			return fmt.Errorf("--fingerprints does not support --format wireshark (allowed: table|json|csv)")
+		}
+		packets, err := StreamAllPackets()
 		if err != nil {
-			return fmt.Errorf("GetPcapHandle error: %w", err)
+			return err
 		}
-		defer handle.Close()
 
-		filterIP := net.ParseIP(PcapPostgresHost)
-		packets := pcappkg.ExtractPackets(handle, filterIP, PcapPostgresPort)
-		log.Printf("Extracted %d tcp packets", len(packets))
+		opts, err := extractOptions(printFilterSide.direction())
+		if err != nil {
+			return err
+		}
+		if PcapFollow {
+			return withPrintOutput(func(w io.Writer) error {
+				return followPrint(w, packets, opts)
+			})
+		}
+		// без клиентского направления печатать, кроме серверных сообщений, нечего
+		opts.ServerMessages = printServerMessages || printFilterSide == FilterServer
+		messages, manager := stream.ExtractMessages(packets, opts)
+		if PcapVerifyRoundtrip {
+			Logger.Info("round-trip verification", "mismatched", manager.RoundtripMismatches())
+		}
+		messages, err = filterByQuery(messages)
+		if err != nil {
+			return err
+		}
 
-		sort.Slice(packets, func(i, j int) bool {
-			return packets[i].Timestamp.Before(packets[j].Timestamp)
+		return withPrintOutput(func(w io.Writer) error {
+			return writePrint(w, messages, manager)
 		})
+	},
+}
+
+// withPrintOutput вызывает write с stdout или, при --out, с буферизованным файлом.
+func withPrintOutput(write func(w io.Writer) error) error {
+	if printOut == "" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(printOut)
+	if err != nil {
+		return fmt.Errorf("create output file: %w", err)
+	}
+	// ошибки записи в файл проявляются при Flush
+	bw := bufio.NewWriter(f)
+	if err := write(bw); err != nil {
+		f.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("write output file: %w", err)
+	}
+	return f.Close()
+}
+
+// writePrint печатает в w сообщения messages (и серверные сообщения, уведомления и notice
+// из manager) в формате printFormat с учётом флагов постраничного вывода и группировки.
+func writePrint(w io.Writer, messages []stream.PostgreSQLMessage, manager *stream.TCPStreamManager) error {
+	if printFingerprints {
+		return writeFingerprints(w, stream.AggregateFingerprints(messages, printMinOccurrences))
+	}
+
+	entries := timeline(messages, manager.ServerMessages())
+	if printGroupBySession {
+		entries = groupBySession(entries)
+	}
+
+	// постраничный вывод: номера сообщений остаются сквозными, уведомления и notice
+	// нумеруются после всех сообщений
+	total := len(entries)
+	offset := min(max(printOffset, 0), len(entries))
+	entries = entries[offset:]
+	if printLimit > 0 && printLimit < len(entries) {
+		entries = entries[:printLimit]
+	}
+
+	enc := json.NewEncoder(w)
+	if printJSONPretty {
+		enc.SetIndent("", "  ")
+	}
+	var csvw *csv.Writer
+	if printFormat == FormatCSV {
+		csvw = csv.NewWriter(w)
+		if err := csvw.Write(csvHeader); err != nil {
+			return fmt.Errorf("write csv header: %w", err)
+		}
+	}
+	for i, e := range entries {
+		index := offset + i + 1
+		if printGroupBySession && printFormat != FormatJSON && printFormat != FormatCSV && (i == 0 || entries[i-1].streamID() != e.streamID()) {
+			fmt.Fprintf(w, "=== session %s ===\n", e.streamID())
+		}
+		if e.server != nil {
+			if err := printServerMessage(w, index, *e.server, enc, csvw); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := printClientMessage(w, index, *e.client, enc, csvw); err != nil {
+			return err
+		}
+	}
 
-		manager := stream.NewTCPStreamManager()
-
-		for _, pkt := range packets {
-			switch printFilterSide {
-			case FilterBoth:
-			case FilterClients:
-				if pkt.PortDest != PcapPostgresPort {
-					continue
-				}
-			case FilterServer:
-				if pkt.PortSource != PcapPostgresPort {
-					continue
-				}
+	index := total
+	if printNotifications {
+		for _, n := range manager.Notifications() {
+			index++
+			if err := printNotification(w, index, n, enc, csvw); err != nil {
+				return err
 			}
+		}
+	}
 
-			if err := manager.AddPacket(
-				pkt.Data, pkt.Timestamp, pkt.IPSource, pkt.IPDest, pkt.PortSource, pkt.PortDest, PcapPostgresHost, PcapPostgresPort,
-			); err != nil {
-				log.Printf("AddPacket error: %v", err)
+	if printNotices {
+		for _, n := range manager.Notices() {
+			index++
+			if err := printNotice(w, index, n, enc, csvw); err != nil {
+				return err
 			}
 		}
+	}
 
-		messages := manager.CollectMessages()
+	if csvw != nil {
+		csvw.Flush()
+		if err := csvw.Error(); err != nil {
+			return fmt.Errorf("write csv: %w", err)
+		}
+	}
+	return nil
+}
 
-		sort.Slice(messages, func(i, j int) bool {
-			return messages[i].FirstTCPPacketTimestamp.Before(messages[j].FirstTCPPacketTimestamp)
-		})
+// writeFingerprints печатает в w сводку по формам запросов в формате printFormat с учётом
+// --limit и --offset; номера форм сквозные.
+func writeFingerprints(w io.Writer, stats []stream.FingerprintStat) error {
+	offset := min(max(printOffset, 0), len(stats))
+	stats = stats[offset:]
+	if printLimit > 0 && printLimit < len(stats) {
+		stats = stats[:printLimit]
+	}
 
-		for i, m := range messages {
-			typ := m.Type.String()
-			query := "-"
-			if m.Type.IsSimpleQuery() {
-				query = m.PrettyQuery()
+	switch printFormat {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		if printJSONPretty {
+			enc.SetIndent("", "  ")
+		}
+		for i, st := range stats {
+			if err := enc.Encode(newJSONFingerprint(offset+i+1, st)); err != nil {
+				return fmt.Errorf("encode fingerprint %d: %w", offset+i+1, err)
 			}
-			fmt.Printf("%3d | %s | %s | %s\n",
-				i+1,
-				m.FirstTCPPacketTimestamp.Format("2006-01-02 15:04:05.000000"),
-				typ,
-				query,
-			)
 		}
-		return nil
-	},
+	case FormatCSV:
+		csvw := csv.NewWriter(w)
+		if err := csvw.Write(fingerprintCSVHeader); err != nil {
+			return fmt.Errorf("write csv header: %w", err)
+		}
+		for i, st := range stats {
+			if err := csvw.Write(newJSONFingerprint(offset+i+1, st).csvRecord()); err != nil {
+				return fmt.Errorf("write fingerprint %d: %w", offset+i+1, err)
+			}
+		}
+		csvw.Flush()
+		if err := csvw.Error(); err != nil {
+			return fmt.Errorf("write csv: %w", err)
+		}
+	default:
+		for _, st := range stats {
+			fmt.Fprintf(w, "%6d | %s\n", st.Count, st.Fingerprint)
+		}
+	}
+	return nil
+}
+
+// printEntry — строка вывода print: клиентское сообщение или (с --server-messages) серверное.
+// Задано ровно одно из полей.
+type printEntry struct {
+	client *stream.PostgreSQLMessage
+	server *stream.ServerMessage
+}
+
+func (e printEntry) timestamp() time.Time {
+	if e.server != nil {
+		return e.server.Timestamp
+	}
+	return e.client.FirstTCPPacketTimestamp
+}
+
+func (e printEntry) streamID() string {
+	if e.server != nil {
+		return e.server.StreamID
+	}
+	return e.client.StreamID
+}
+
+// timeline сливает отсортированные по времени клиентские и серверные сообщения в одну
+// последовательность; при равных метках клиентское сообщение идёт первым.
+func timeline(messages []stream.PostgreSQLMessage, server []stream.ServerMessage) []printEntry {
+	entries := make([]printEntry, 0, len(messages)+len(server))
+	i, j := 0, 0
+	for i < len(messages) || j < len(server) {
+		if j == len(server) || (i < len(messages) && !server[j].Timestamp.Before(messages[i].FirstTCPPacketTimestamp)) {
+			entries = append(entries, printEntry{client: &messages[i]})
+			i++
+			continue
+		}
+		entries = append(entries, printEntry{server: &server[j]})
+		j++
+	}
+	return entries
+}
+
+// printClientMessage печатает клиентское сообщение в w в формате printFormat; enc и csvw —
+// кодировщики JSON и CSV основного цикла.
+func printClientMessage(w io.Writer, index int, m stream.PostgreSQLMessage, enc *json.Encoder, csvw *csv.Writer) error {
+	switch printFormat {
+	case FormatWireshark:
+		writeWireshark(w, index, m)
+	case FormatJSON:
+		if err := enc.Encode(newJSONMessage(index, m)); err != nil {
+			return fmt.Errorf("encode message %d: %w", index, err)
+		}
+	case FormatCSV:
+		if err := csvw.Write(newJSONMessage(index, m).csvRecord()); err != nil {
+			return fmt.Errorf("write message %d: %w", index, err)
+		}
+	default:
+		query := messageSummary(m)
+		if query == "" {
+			query = "-"
+		}
+		latency := "-"
+		if d, ok := messageLatency(m); ok {
+			latency = formatLatency(d)
+		}
+		tag := m.CommandTag
+		if tag == "" {
+			tag = "-"
+		}
+		fmt.Fprintf(w, "%3d | %s | %s | %s | %s | %s\n",
+			index,
+			m.FirstTCPPacketTimestamp.Format("2006-01-02 15:04:05.000000"),
+			m.Type.String(),
+			latency,
+			tag,
+			query,
+		)
+	}
+	return nil
+}
+
+// printServerMessage печатает серверное сообщение в w в формате printFormat; enc и csvw —
+// кодировщики JSON и CSV основного цикла.
+func printServerMessage(w io.Writer, index int, m stream.ServerMessage, enc *json.Encoder, csvw *csv.Writer) error {
+	switch printFormat {
+	case FormatWireshark:
+		writeWiresharkServer(w, index, m)
+	case FormatJSON:
+		if err := enc.Encode(newJSONServerMessage(index, m)); err != nil {
+			return fmt.Errorf("encode message %d: %w", index, err)
+		}
+	case FormatCSV:
+		if err := csvw.Write(newJSONServerMessage(index, m).csvRecord()); err != nil {
+			return fmt.Errorf("write message %d: %w", index, err)
+		}
+	default:
+		summary := m.Summary()
+		if summary == "" {
+			summary = "-"
+		}
+		fmt.Fprintf(w, "%3d | %s | <- %s | - | - | %s\n",
+			index,
+			m.Timestamp.Format("2006-01-02 15:04:05.000000"),
+			m.Type,
+			summary,
+		)
+	}
+	return nil
+}
+
+// printNotification печатает уведомление LISTEN/NOTIFY в w в формате printFormat: в json
+// и csv — записью того же вида, что и сообщения (см. newJSONNotification).
+func printNotification(w io.Writer, index int, n stream.Notification, enc *json.Encoder, csvw *csv.Writer) error {
+	switch printFormat {
+	case FormatJSON:
+		if err := enc.Encode(newJSONNotification(index, n)); err != nil {
+			return fmt.Errorf("encode notification %d: %w", index, err)
+		}
+	case FormatCSV:
+		if err := csvw.Write(newJSONNotification(index, n).csvRecord()); err != nil {
+			return fmt.Errorf("write notification %d: %w", index, err)
+		}
+	default:
+		fmt.Fprintf(w, "NOTIFY | %s | pid=%d | %s | %s\n",
+			n.Timestamp.Format("2006-01-02 15:04:05.000000"),
+			n.PID,
+			n.Channel,
+			n.Payload,
+		)
+	}
+	return nil
+}
+
+// printNotice печатает NoticeResponse в w в формате printFormat: в json и csv — записью
+// того же вида, что и сообщения (см. newJSONNotice).
+func printNotice(w io.Writer, index int, n stream.Notice, enc *json.Encoder, csvw *csv.Writer) error {
+	switch printFormat {
+	case FormatJSON:
+		if err := enc.Encode(newJSONNotice(index, n)); err != nil {
+			return fmt.Errorf("encode notice %d: %w", index, err)
+		}
+	case FormatCSV:
+		if err := csvw.Write(newJSONNotice(index, n).csvRecord()); err != nil {
+			return fmt.Errorf("write notice %d: %w", index, err)
+		}
+	default:
+		fmt.Fprintf(w, "NOTICE | %s | %s | %s | %s\n",
+			n.Timestamp.Format("2006-01-02 15:04:05.000000"),
+			n.Response.Severity,
+			n.Response.Code,
+			n.Response.Message,
+		)
+	}
+	return nil
+}
+
+// groupBySession переставляет отсортированные по времени entries так, что сообщения одного
+// TCP-потока идут подряд. Потоки упорядочены по первому сообщению, внутри потока порядок сохраняется.
+func groupBySession(entries []printEntry) []printEntry {
+	order := make(map[string]int)
+	for _, e := range entries {
+		if _, ok := order[e.streamID()]; !ok {
+			order[e.streamID()] = len(order)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return order[entries[i].streamID()] < order[entries[j].streamID()]
+	})
+	return entries
 }
 
 func init() {
 	PrintCmd.Flags().Var(&printFilterSide, "filter", "Фильтр вывода: clients | server | both")
+	PrintCmd.Flags().Var(&printFormat, "format", "Формат вывода: table | wireshark | json | csv")
+	PrintCmd.Flags().Var(&printFormat, "output", "Синоним --format")
+	addQueryFilterFlags(PrintCmd)
+	PrintCmd.Flags().BoolVar(&printJSONPretty, "json-pretty", false, "Печатать JSON с отступами (для --format json)")
+	PrintCmd.Flags().BoolVar(&printFingerprints, "fingerprints", false, "Печатать сводку по формам запросов (отпечаткам), отсортированную по частоте")
+	PrintCmd.Flags().IntVar(&printMinOccurrences, "min-occurrences", 1, "Скрывать в сводке --fingerprints формы, встретившиеся реже N раз")
+	PrintCmd.Flags().IntVar(&printLimit, "limit", 0, "Печатать не больше N сообщений или форм с --fingerprints (0 = все)")
+	PrintCmd.Flags().IntVar(&printOffset, "offset", 0, "Пропустить первые M сообщений или форм с --fingerprints")
+	PrintCmd.Flags().BoolVar(&printGroupBySession, "group-by-session", false, "Выводить сообщения каждого соединения подряд, под заголовком с ключом потока")
+	PrintCmd.Flags().BoolVar(&printServerMessages, "server-messages", false, "Печатать и серверные сообщения (теги CommandComplete, ошибки, столбцы RowDescription) вперемешку с клиентскими; с --filter server включено всегда")
+	PrintCmd.Flags().BoolVar(&printNotifications, "notifications", false, "Печатать уведомления LISTEN/NOTIFY (NotificationResponse) от сервера")
+	PrintCmd.Flags().StringVar(&printOut, "out", "", "Записывать результат в файл вместо stdout (логи остаются в stderr)")
+	PrintCmd.Flags().BoolVar(&PcapFollow, "follow", false, "Читать --pcap по мере записи другим процессом и печатать сообщения каждого соединения по его завершении, до Ctrl+C")
+	PrintCmd.Flags().BoolVar(&printNotices, "notices", false, "Печатать сообщения NoticeResponse от сервера (RAISE NOTICE, WARNING)")
 }
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	pcappkg "trafRep/internal/pcap"
+)
+
+// spinnerInterval — период обновления строки прогресса извлечения.
+const spinnerInterval = 100 * time.Millisecond
+
+var spinnerFrames = []rune(`|/-\`)
+
+// progressEnabled сообщает, что задан --progress и stdout и stderr — терминалы: при выводе
+// в файл или конвейер строки с возвратом каретки только засоряют его.
+func progressEnabled() bool {
+	return PcapProgress && isTerminal(os.Stdout) && isTerminal(os.Stderr)
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// spinPackets пересылает пакеты из in и, пока они идут, обновляет в stderr строку со
+// счётчиком прочитанных пакетов: общее их число до конца чтения неизвестно. По закрытии in
+// строка стирается.
+func spinPackets(in <-chan pcappkg.TCPPacket) <-chan pcappkg.TCPPacket {
+	out := make(chan pcappkg.TCPPacket, 1024)
+	go func() {
+		defer close(out)
+		ticker := time.NewTicker(spinnerInterval)
+		defer ticker.Stop()
+		count, frame := 0, 0
+		for {
+			select {
+			case pkt, ok := <-in:
+				if !ok {
+					fmt.Fprint(os.Stderr, "\r\033[K")
+					return
+				}
+				out <- pkt
+				count++
+			case <-ticker.C:
+				fmt.Fprintf(os.Stderr, "\r%c %d tcp packets read\033[K", spinnerFrames[frame], count)
+				frame = (frame + 1) % len(spinnerFrames)
+			}
+		}
+	}()
+	return out
+}
@@ -1,15 +1,22 @@
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
-	"log"
 	"net"
-	"sort"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
 
 	_ "github.com/google/gopacket/pcap"
 	"github.com/spf13/cobra"
 
-	pcappkg "trafRep/internal/pcap"
 	"trafRep/internal/replay"
 	"trafRep/internal/stream"
 )
@@ -18,8 +25,42 @@ var (
 	replayTargetHost string
 	replayTargetPort int
 	replayRate       float64
+	replayRateMode   string
+	replayQPS        float64
 	replayPrintQuery bool // новый флаг: печатать запросы при успешной отправке
 	replayMaxRetries int  // new flag: max retries for write attempts
+	replayOccurrence int
+
+	replayPreserveStartupParams bool
+	replayStartupParams         map[string]string
+	replayExpectPath            string
+	replayValidate              bool
+	replayRewriteStatements     bool
+	replayOtelEndpoint          string
+	replayProductionPattern     string
+	replayConfirmProduction     bool
+	replayLatencyHistogram      bool
+	replayBackoffBase           time.Duration
+	replayBackoffMax            time.Duration
+	replayPoolSize              int
+	replayFinalizeTransactions  string
+	replayMaxDuration           time.Duration
+	replayMaxMessages           int
+	replayReadyTimeout          time.Duration
+	replayStatsInterval         time.Duration
+	replayRedirectWrites        string
+	replayPerStream             bool
+	replayLoops                 int
+	replayDryRun                bool
+	replayOutput                = FormatTable
+	replayUser                  string
+	replayDatabase              string
+	replayPassword              string
+	replayTLS                   bool
+	replayTLSSkipVerify         bool
+	replayTLSCA                 string
+	replayTLSCert               string
+	replayTLSKey                string
 )
 
 // ReplayCmd собирает PostgreSQL‑сообщения из pcap и воспроизводит их на target-host:target-port.
@@ -27,51 +68,184 @@ var ReplayCmd = &cobra.Command{
 	Use:   "replay",
 	Short: "Воспроизведение трафика из pcap файла",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		handle, err := GetPcapHandle()
+		packets, err := StreamAllPackets()
 		if err != nil {
-			return fmt.Errorf("GetPcapHandle error: %w", err)
+			return err
 		}
-		defer handle.Close()
 
-		filterIP := net.ParseIP(PcapPostgresHost)
-		packets := pcappkg.ExtractPackets(handle, filterIP, PcapPostgresPort)
-		log.Printf("Extracted %d tcp packets", len(packets))
+		opts, err := extractOptions(stream.DirectionBoth)
+		if err != nil {
+			return err
+		}
+		messages, manager := stream.ExtractMessages(packets, opts)
+		if n := manager.RoundtripMismatches(); n > 0 {
+			return fmt.Errorf("%d messages failed round-trip verification, refusing to replay", n)
+		}
+		messages, err = filterByQuery(messages)
+		if err != nil {
+			return err
+		}
 
-		sort.Slice(packets, func(i, j int) bool {
-			return packets[i].Timestamp.Before(packets[j].Timestamp)
-		})
+		if len(messages) == 0 {
+			Logger.Warn("no messages extracted, nothing to replay")
+			return nil
+		}
 
-		manager := stream.NewTCPStreamManager()
+		var expectations []replay.Expectation
+		if replayExpectPath != "" {
+			expectations, err = replay.LoadExpectations(replayExpectPath)
+			if err != nil {
+				return err
+			}
+		}
 
-		for _, pkt := range packets {
+		if replayRate <= 0 {
+			return fmt.Errorf("invalid --rate %v: must be positive", replayRate)
+		}
+		var qps float64
+		switch replayRateMode {
+		case "scale":
+			if cmd.Flags().Changed("qps") {
+				return fmt.Errorf("--qps requires --rate-mode qps")
+			}
+		case "qps":
+			if replayQPS <= 0 {
+				return fmt.Errorf("invalid --qps %v: must be positive", replayQPS)
+			}
+			if cmd.Flags().Changed("rate") {
+				return fmt.Errorf("--rate is not used with --rate-mode qps")
+			}
+			qps = replayQPS
+		default:
+			return fmt.Errorf("invalid --rate-mode value: %q (allowed: scale|qps)", replayRateMode)
+		}
+		if replayReadyTimeout <= 0 {
+			return fmt.Errorf("invalid --ready-timeout %v: must be positive", replayReadyTimeout)
+		}
+
+		switch replayFinalizeTransactions {
+		case "", "commit", "rollback":
+		default:
+			return fmt.Errorf("invalid --finalize-transactions value: %q (allowed: commit|rollback)", replayFinalizeTransactions)
+		}
+
+		if replayPerStream && replayPoolSize > 0 {
+			return fmt.Errorf("--per-stream and --pool-size are mutually exclusive")
+		}
+		if replayOutput != FormatTable && replayOutput != FormatJSON {
+			return fmt.Errorf("format %s is not supported by replay (allowed: table|json)", replayOutput)
+		}
+		if replayOutput == FormatJSON && replayDryRun {
+			return fmt.Errorf("--dry-run does not support --output json")
+		}
+		if replayLoops < 0 {
+			return fmt.Errorf("--loop must be >= 0")
+		}
+		if replayLoops != 1 && replayPoolSize > 0 {
+			return fmt.Errorf("--loop is not supported with --pool-size")
+		}
+		// --loop 0 — повторять бесконечно
+		loops := replayLoops
+		if loops == 0 {
+			loops = -1
+		}
 
-			if err := manager.AddPacket(
-				pkt.Data, pkt.Timestamp, pkt.IPSource, pkt.IPDest, pkt.PortSource, pkt.PortDest, PcapPostgresHost, PcapPostgresPort,
-			); err != nil {
-				log.Printf("AddPacket error: %v", err)
+		var writeHost string
+		var writePort int
+		if replayRedirectWrites != "" {
+			if replayPoolSize <= 0 {
+				return fmt.Errorf("--redirect-writes requires --pool-size")
+			}
+			host, port, err := net.SplitHostPort(replayRedirectWrites)
+			if err != nil {
+				return fmt.Errorf("invalid --redirect-writes: %w", err)
 			}
+			writePort, err = strconv.Atoi(port)
+			if err != nil {
+				return fmt.Errorf("invalid --redirect-writes port %q: %w", port, err)
+			}
+			writeHost = host
 		}
 
-		messages := manager.CollectMessages()
+		tlsConfig, err := replayTLSConfig()
+		if err != nil {
+			return err
+		}
 
-		sort.Slice(messages, func(i, j int) bool {
-			return messages[i].FirstTCPPacketTimestamp.Before(messages[j].FirstTCPPacketTimestamp)
-		})
+		password := replayPassword
+		if password == "" {
+			password = os.Getenv("PGPASSWORD")
+		}
 
-		if len(messages) == 0 {
-			log.Printf("no messages extracted, nothing to replay")
-			return nil
+		var productionPattern *regexp.Regexp
+		if replayProductionPattern != "" {
+			productionPattern, err = regexp.Compile(replayProductionPattern)
+			if err != nil {
+				return fmt.Errorf("invalid --production-pattern: %w", err)
+			}
+		}
+
+		var tracer replay.Tracer
+		if replayOtelEndpoint != "" {
+			tracer, err = newTracer(replayOtelEndpoint)
+			if err != nil {
+				return err
+			}
 		}
 
 		cfg := replay.Config{
 			TargetHost: replayTargetHost,
 			TargetPort: replayTargetPort,
 			Rate:       replayRate,
+			QPS:        qps,
 			PrintQuery: replayPrintQuery,
 			MaxRetries: replayMaxRetries,
+			Occurrence: replayOccurrence,
+
+			PreserveStartupParams: replayPreserveStartupParams,
+			StartupParams:         replayStartupParams,
+			Expectations:          expectations,
+			Validate:              replayValidate,
+			Logger:                Logger,
+			RewriteStatementNames: replayRewriteStatements,
+			Tracer:                tracer,
+			ProductionPattern:     productionPattern,
+			ConfirmProduction:     replayConfirmProduction,
+			LatencyHistogram:      replayLatencyHistogram,
+			ReconnectBackoffBase:  replayBackoffBase,
+			ReconnectBackoffMax:   replayBackoffMax,
+			PoolSize:              replayPoolSize,
+			PerStream:             replayPerStream,
+			Loops:                 loops,
+			DryRun:                replayDryRun,
+			User:                  replayUser,
+			Database:              replayDatabase,
+			Password:              password,
+			TLS:                   tlsConfig,
+			WriteTargetHost:       writeHost,
+			WriteTargetPort:       writePort,
+			FinalizeTransactions:  replayFinalizeTransactions,
+			MaxDuration:           replayMaxDuration,
+			MaxMessages:           replayMaxMessages,
+			ReadTimeout:           replayReadyTimeout,
+			StatsInterval:         replayStatsInterval,
+			Quiet:                 replayOutput == FormatJSON,
+		}
+		if progressEnabled() {
+			cfg.Progress = os.Stderr
 		}
 
-		if err := replay.ReplayMessages(messages, cfg); err != nil {
+		// Ctrl+C останавливает воспроизведение: соединения закрываются и печатается сводка
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		report, err := replay.ReplayMessages(ctx, messages, cfg)
+		// отчёт печатается и при ошибках сообщений: он объясняет, какие именно сообщения не прошли
+		if report != nil && replayOutput == FormatJSON {
+			if encErr := json.NewEncoder(os.Stdout).Encode(report); encErr != nil {
+				return fmt.Errorf("encode report: %w", encErr)
+			}
+		}
+		if err != nil {
 			return fmt.Errorf("replay failed: %w", err)
 		}
 		return nil
@@ -79,9 +253,73 @@ var ReplayCmd = &cobra.Command{
 }
 
 func init() {
+	addQueryFilterFlags(ReplayCmd)
 	ReplayCmd.Flags().StringVar(&replayTargetHost, "target-host", "127.0.0.1", "Target host для воспроизведения")
 	ReplayCmd.Flags().IntVar(&replayTargetPort, "target-port", 5432, "Target port для воспроизведения")
+	ReplayCmd.Flags().StringVar(&replayUser, "target-user", "", "Пользователь для собственной аутентификации на цели вместо захваченного startup")
+	ReplayCmd.Flags().StringVar(&replayDatabase, "target-database", "", "База данных для собственной аутентификации (по умолчанию совпадает с пользователем)")
+	ReplayCmd.Flags().StringVar(&replayPassword, "target-password", "", "Пароль для собственной аутентификации (по умолчанию из PGPASSWORD)")
+	ReplayCmd.Flags().BoolVar(&replayTLS, "tls", false, "Подключаться к цели по TLS (SSLRequest)")
+	ReplayCmd.Flags().BoolVar(&replayTLSSkipVerify, "tls-skip-verify", false, "Не проверять сертификат цели")
+	ReplayCmd.Flags().StringVar(&replayTLSCA, "tls-ca", "", "PEM-файл с CA для проверки сертификата цели")
+	ReplayCmd.Flags().StringVar(&replayTLSCert, "tls-cert", "", "PEM-файл клиентского сертификата")
+	ReplayCmd.Flags().StringVar(&replayTLSKey, "tls-key", "", "PEM-файл ключа клиентского сертификата")
 	ReplayCmd.Flags().Float64Var(&replayRate, "rate", 1.0, "Скорость реплея (1.0 = оригинал)")
-	ReplayCmd.Flags().BoolVar(&replayPrintQuery, "print-query", false, "Печатать текст запроса при успешной отправке (если доступен)")
+	ReplayCmd.Flags().StringVar(&replayRateMode, "rate-mode", "scale", "Режим темпа: scale — исходные интервалы, масштабированные --rate; qps — постоянный темп --qps без учёта исходных интервалов")
+	ReplayCmd.Flags().Float64Var(&replayQPS, "qps", 0, "Запросов в секунду в режиме --rate-mode qps")
+	ReplayCmd.Flags().BoolVar(&replayPrintQuery, "print-query", false, "Печатать текст запроса (если доступен) и задержку до ReadyForQuery для каждого сообщения")
 	ReplayCmd.Flags().IntVar(&replayMaxRetries, "max-retries", 3, "Максимальное число попыток записи при ошибке")
+	ReplayCmd.Flags().DurationVar(&replayBackoffBase, "reconnect-backoff-base", 100*time.Millisecond, "Начальная пауза перед переподключением (удваивается с каждой попыткой)")
+	ReplayCmd.Flags().DurationVar(&replayBackoffMax, "reconnect-backoff-max", 5*time.Second, "Максимальная пауза перед переподключением")
+	ReplayCmd.Flags().IntVar(&replayOccurrence, "occurrence", 0, "Воспроизводить только N-е вхождение каждого уникального запроса (0 = все)")
+	ReplayCmd.Flags().BoolVar(&replayPreserveStartupParams, "preserve-startup-params", true, "Переносить параметры сессии из захваченного StartupMessage (иначе только user и database)")
+	ReplayCmd.Flags().StringToStringVar(&replayStartupParams, "startup-param", nil, "Переопределить параметр StartupMessage, например --startup-param search_path=public")
+	ReplayCmd.Flags().StringVar(&replayExpectPath, "expect", "", "YAML-файл ожиданий (query, tag, rows); replay завершается ошибкой при несовпадении")
+	ReplayCmd.Flags().BoolVar(&replayValidate, "validate", false, "Сравнивать ответы цели с ответами сервера из захвата (ошибка или успех, тег CommandComplete, число строк) и сообщать о расхождениях")
+	ReplayCmd.Flags().BoolVar(&replayRewriteStatements, "rewrite-statement-names", false, "Делать имена подготовленных операторов и порталов уникальными для каждой исходной сессии")
+	ReplayCmd.Flags().StringVar(&replayOtelEndpoint, "otel-endpoint", "", "OTLP/HTTP endpoint (host:port) для экспорта spans; требует сборки с -tags otel")
+	ReplayCmd.Flags().StringVar(&replayProductionPattern, "production-pattern", "", "Регулярное выражение для адреса цели или имени базы, считающихся production (пусто = проверка выключена)")
+	ReplayCmd.Flags().BoolVar(&replayConfirmProduction, "confirm-production", false, "Разрешить воспроизведение на цель, совпавшую с --production-pattern")
+	ReplayCmd.Flags().BoolVar(&replayLatencyHistogram, "latency-histogram", false, "Печатать в сводке ASCII-гистограмму задержек до ReadyForQuery")
+	ReplayCmd.Flags().Var(&replayOutput, "output", "Формат итогов: table | json (отчёт по каждому сообщению в JSON вместо построчного вывода)")
+	ReplayCmd.Flags().BoolVar(&replayDryRun, "dry-run", false, "Не подключаться к цели: напечатать, какие сообщения и когда были бы отправлены")
+	ReplayCmd.Flags().IntVar(&replayLoops, "loop", 1, "Воспроизвести сообщения N раз подряд (0 — бесконечно, до Ctrl+C)")
+	ReplayCmd.Flags().BoolVar(&replayPerStream, "per-stream", false, "Воспроизводить каждую исходную сессию на своём соединении параллельно с остальными")
+	ReplayCmd.Flags().IntVar(&replayPoolSize, "pool-size", 0, "Воспроизводить через пул из N прогретых соединений, выдаваемых на каждый запрос (0 = выключено)")
+	ReplayCmd.Flags().StringVar(&replayRedirectWrites, "redirect-writes", "", "Адрес primary (host:port), на который перенаправляются записи при воспроизведении на реплику; требует --pool-size")
+	ReplayCmd.Flags().DurationVar(&replayMaxDuration, "max-duration", 0, "Остановить воспроизведение по истечении времени, например 10m (0 = без ограничения)")
+	ReplayCmd.Flags().DurationVar(&replayReadyTimeout, "ready-timeout", 40*time.Second, "Сколько ждать ReadyForQuery от цели на каждое сообщение (и ответов при подключении)")
+	ReplayCmd.Flags().IntVar(&replayMaxMessages, "max-messages", 0, "Воспроизвести только первые N сообщений по времени (0 = все)")
+	ReplayCmd.Flags().DurationVar(&replayStatsInterval, "stats-interval", 0, "Печатать снимок прогресса (отправлено, QPS, p50/p99, ошибки) с заданным интервалом, например 30s")
+	ReplayCmd.Flags().StringVar(&replayFinalizeTransactions, "finalize-transactions", "", "Завершать транзакцию, оставшуюся открытой в конце сессии: commit | rollback")
+}
+
+// replayTLSConfig собирает tls.Config из флагов --tls*. Без --tls возвращает nil.
+func replayTLSConfig() (*tls.Config, error) {
+	if !replayTLS {
+		if replayTLSSkipVerify || replayTLSCA != "" || replayTLSCert != "" || replayTLSKey != "" {
+			return nil, fmt.Errorf("--tls-* options require --tls")
+		}
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: replayTLSSkipVerify}
+	if replayTLSCA != "" {
+		pem, err := os.ReadFile(replayTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("read --tls-ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("--tls-ca %s: no certificates found", replayTLSCA)
+		}
+		cfg.RootCAs = pool
+	}
+	if replayTLSCert != "" || replayTLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(replayTLSCert, replayTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
 }
@@ -1,40 +1,415 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/google/gopacket/pcap"
 	"github.com/spf13/cobra"
+
+	pcappkg "trafRep/internal/pcap"
+	"trafRep/internal/stream"
 )
 
 var PcapPath string
 var PcapPostgresHost string
-var PcapPostgresPort uint16
+var PcapPostgresPorts []uint
+var PcapInterface string
+var PcapBPF string
+var PcapDedup bool
+var PcapVerifyRoundtrip bool
+var PcapAutoDetect bool
+var PcapFrom string
+var PcapTo string
+var PcapReorderWindow int
+var PcapProgress bool
+var PcapMaxMessageSize uint32
+var PcapSampleRate float64
+
+// PcapFollow — читать файлы --pcap по мере записи до SIGINT/SIGTERM (флаг --follow команды print).
+var PcapFollow bool
 
 var RootCmd = &cobra.Command{
 	Use:   "app",
 	Short: "Трафик репортер",
 	Long:  "Приложение для анализа и воспроизведения pcap файлов.",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return setupLogger()
+	},
 }
 
 func init() {
-	RootCmd.PersistentFlags().StringVar(&PcapPath, "pcap", "", "Путь к pcap файлу")
-	err := RootCmd.MarkPersistentFlagRequired("pcap")
+	RootCmd.PersistentFlags().StringVar(&PcapPath, "pcap", "", "Путь к pcap файлу, glob-шаблон или список через запятую (например, 'capture.0.pcap,capture.1.pcap' или 'shard-*.pcap')")
+	RootCmd.PersistentFlags().StringVar(&PcapInterface, "interface", "", "Захватывать трафик с сетевого интерфейса (например, eth0) до Ctrl+C вместо чтения --pcap")
+
+	RootCmd.PersistentFlags().StringVarP(&PcapPostgresHost, "host", "H", "::1", "PostgreSQL хост в pcap файле: IP-адрес, подсеть CIDR (например, 10.0.0.0/24 для нескольких реплик) или имя (учитываются все его адреса)")
+	RootCmd.PersistentFlags().UintSliceVarP(&PcapPostgresPorts, "port", "P", []uint{5432}, "PostgreSQL порты в pcap файле через запятую (например, 5432,6432)")
+	RootCmd.PersistentFlags().StringVar(&PcapBPF, "bpf", "", "BPF-фильтр, применяемый libpcap при чтении (например, 'tcp port 5432 and host 10.0.0.5'); фильтр --host/--port действует поверх него")
+	RootCmd.PersistentFlags().BoolVar(&PcapDedup, "dedup", false, "Отбрасывать дубликаты пакетов при слиянии захватов с нескольких отводов")
+	RootCmd.PersistentFlags().StringVar(&PcapFrom, "from", "", "Обрабатывать только пакеты не раньше этого времени (RFC3339, например 2024-05-01T12:00:00Z)")
+	RootCmd.PersistentFlags().StringVar(&PcapTo, "to", "", "Обрабатывать только пакеты не позже этого времени (RFC3339)")
+	RootCmd.PersistentFlags().StringVar(&PcapFlow, "flow", "", "Обрабатывать только один поток: ключ 'client_ip:port->server_ip:port' (как в выводе print) или сторона клиента 'ip:port'")
+	RootCmd.PersistentFlags().IntVar(&PcapReorderWindow, "reorder-window", 0, "Восстанавливать порядок пакетов по времени в окне из N пакетов (0 — порядок записи в файле)")
+	RootCmd.PersistentFlags().BoolVar(&PcapAutoDetect, "auto-detect", false, "Определять сервер каждого потока по содержимому (Authentication, ReadyForQuery, startup); явно заданные --host/--port имеют приоритет")
+	RootCmd.PersistentFlags().Uint32Var(&PcapMaxMessageSize, "max-message-size", stream.DefaultMaxMessageSize, "Максимальная длина сообщения PostgreSQL в байтах; кадр длиннее считается повреждённым, и разбор ищет следующую границу сообщения")
+	RootCmd.PersistentFlags().Float64Var(&PcapSampleRate, "sample-rate", 1, "Доля потоков (0..1], сообщения которых обрабатываются, например 0.1; выборка по соединениям целиком, а не по пакетам, и одинакова при повторных запусках")
+	RootCmd.PersistentFlags().BoolVar(&PcapVerifyRoundtrip, "verify-roundtrip", false, "Проверять, что каждое собранное сообщение побайтно совпадает с байтами из захвата")
+	RootCmd.PersistentFlags().BoolVar(&PcapProgress, "progress", false, "Показывать в stderr строку прогресса чтения пакетов и воспроизведения (только в терминале)")
+	RootCmd.PersistentFlags().StringVar(&LogLevel, "log-level", "info", "Уровень журнала в stderr: debug | info | warn | error")
+}
+
+// GetPcapHandle открывает файл захвата path (pcap или pcapng) с применённым фильтром --bpf.
+func GetPcapHandle(path string) (pcappkg.Source, error) {
+	handle, err := pcappkg.OpenFile(path, PcapBPF)
 	if err != nil {
-		log.Fatal(err)
-		return
+		return nil, fmt.Errorf("open pcap %s: %w", path, err)
 	}
+	return handle, nil
+}
 
-	RootCmd.PersistentFlags().StringVarP(&PcapPostgresHost, "host", "H", "::1", "PostgreSQL хост в pcap файле")
-	RootCmd.PersistentFlags().Uint16VarP(&PcapPostgresPort, "port", "P", 5432, "PostgreSQL port в pcap файле")
+// applyBPF устанавливает на handle фильтр --bpf, если он задан. При ошибке handle закрывается.
+func applyBPF(handle *pcap.Handle) error {
+	if PcapBPF == "" {
+		return nil
+	}
+	if err := handle.SetBPFFilter(PcapBPF); err != nil {
+		handle.Close()
+		return fmt.Errorf("invalid --bpf %q: %w", PcapBPF, err)
+	}
+	return nil
 }
 
-// GetPcapHandle открывает pcap файл по пути из флагов и возвращает *pcap.Handle.
-func GetPcapHandle() (*pcap.Handle, error) {
-	handle, err := pcap.OpenOffline(PcapPath)
+// Параметры живого захвата: snaplen как у tcpdump по умолчанию, таймаут чтения
+// ограничивает, как долго handle.Close() ждёт блокированного чтения.
+const (
+	liveSnaplen     int32 = 262144
+	liveReadTimeout       = 500 * time.Millisecond
+)
+
+// GetLivePcapHandle открывает живой захват с интерфейса iface и возвращает *pcap.Handle.
+func GetLivePcapHandle(iface string, snaplen int32, promisc bool) (*pcap.Handle, error) {
+	handle, err := pcap.OpenLive(iface, snaplen, promisc, liveReadTimeout)
 	if err != nil {
-		return nil, fmt.Errorf("open pcap: %w", err)
+		return nil, fmt.Errorf("open interface %s: %w", iface, err)
+	}
+	if err := applyBPF(handle); err != nil {
+		return nil, err
 	}
 	return handle, nil
 }
+
+// PcapPaths раскрывает значение --pcap: список через запятую, каждый элемент которого —
+// путь или glob-шаблон (например, 'shard-*.pcap'). Совпадения шаблона сортируются,
+// повторы убираются. Путь без совпадений возвращается как есть, чтобы ошибка открытия
+// назвала его.
+func PcapPaths() ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, pattern := range strings.Split(PcapPath, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --pcap pattern %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			matches = []string{pattern}
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				paths = append(paths, m)
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("--pcap is empty")
+	}
+	return paths, nil
+}
+
+// StreamAllPackets отдаёт TCP-пакеты PostgreSQL из всех файлов --pcap (или, с --interface,
+// захваченные с интерфейса до SIGINT/SIGTERM) в канал по мере чтения, не накапливая их
+// в памяти. Пакеты вне окна --from/--to и чужих потоков при --flow отбрасываются.
+// Файлы --pcap читаются одновременно и сливаются по времени (см. pcappkg.MergePackets);
+// внутри файла пакеты идут в порядке записи, который почти совпадает с порядком по времени.
+// Точнее порядок восстанавливает --reorder-window.
+func StreamAllPackets() (<-chan pcappkg.TCPPacket, error) {
+	from, to, err := timeWindow()
+	if err != nil {
+		return nil, err
+	}
+	if PcapReorderWindow < 0 {
+		return nil, fmt.Errorf("--reorder-window must be >= 0")
+	}
+	flow, err := parseFlow(PcapFlow)
+	if err != nil {
+		return nil, err
+	}
+
+	var packets <-chan pcappkg.TCPPacket
+	switch {
+	case PcapPath != "" && PcapInterface != "":
+		return nil, fmt.Errorf("--pcap and --interface are mutually exclusive")
+	case PcapPath == "" && PcapInterface == "":
+		return nil, fmt.Errorf("one of --pcap or --interface is required")
+	case PcapInterface != "":
+		packets, err = StreamLivePackets(PcapInterface)
+	default:
+		packets, err = streamFilePackets()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if progressEnabled() {
+		packets = spinPackets(packets)
+	}
+	packets = pcappkg.ReorderPackets(packets, PcapReorderWindow)
+	return filterByFlow(filterByTime(packets, from, to), flow), nil
+}
+
+// streamFilePackets открывает все файлы --pcap и сливает их пакеты в один канал.
+// Каждый файл закрывается, когда прочитан до конца. С PcapFollow конец файла не завершает
+// чтение: файлы читаются по мере записи до SIGINT/SIGTERM.
+func streamFilePackets() (<-chan pcappkg.TCPPacket, error) {
+	paths, err := PcapPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	filterNets, err := serverNets()
+	if err != nil {
+		return nil, err
+	}
+	ports, err := serverPorts()
+	if err != nil {
+		return nil, err
+	}
+	open := GetPcapHandle
+	if PcapFollow {
+		// слияние по времени ждало бы пакета от каждого файла, а дописывается обычно один
+		if len(paths) > 1 {
+			return nil, fmt.Errorf("--follow supports a single --pcap file")
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		// после первого сигнала повторный снова завершает процесс сразу
+		context.AfterFunc(ctx, stop)
+		open = func(path string) (pcappkg.Source, error) {
+			src, err := pcappkg.OpenFollow(ctx, path, PcapBPF)
+			if err != nil {
+				return nil, fmt.Errorf("open pcap %s: %w", path, err)
+			}
+			return src, nil
+		}
+		Logger.Info("following capture file, press Ctrl+C to stop", "path", paths[0])
+	}
+	var handles []pcappkg.Source
+	inputs := make([]<-chan pcappkg.TCPPacket, 0, len(paths))
+	for _, path := range paths {
+		handle, err := open(path)
+		if err != nil {
+			for _, h := range handles {
+				h.Close()
+			}
+			return nil, fmt.Errorf("GetPcapHandle error: %w", err)
+		}
+		handles = append(handles, handle)
+		inputs = append(inputs, fileChan(handle, path, filterNets, ports))
+	}
+	return pcappkg.MergePackets(inputs...), nil
+}
+
+// fileChan пересылает пакеты файла path, а по его окончании закрывает handle
+// и пишет в лог число извлечённых пакетов.
+func fileChan(handle pcappkg.Source, path string, filterNets []*net.IPNet, ports []uint16) <-chan pcappkg.TCPPacket {
+	out := make(chan pcappkg.TCPPacket, 1024)
+	go func() {
+		defer close(out)
+		n := 0
+		for pkt := range pcappkg.ExtractPacketsChan(handle, filterNets, ports, Logger) {
+			out <- pkt
+			n++
+		}
+		handle.Close()
+		Logger.Info("extracted tcp packets", "count", n, "path", path)
+	}()
+	return out
+}
+
+// timeWindow разбирает --from и --to. Незаданная граница возвращается нулевым временем
+// и не ограничивает окно.
+func timeWindow() (from, to time.Time, err error) {
+	if PcapFrom != "" {
+		if from, err = time.Parse(time.RFC3339, PcapFrom); err != nil {
+			return from, to, fmt.Errorf("invalid --from %q: %w", PcapFrom, err)
+		}
+	}
+	if PcapTo != "" {
+		if to, err = time.Parse(time.RFC3339, PcapTo); err != nil {
+			return from, to, fmt.Errorf("invalid --to %q: %w", PcapTo, err)
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		return from, to, fmt.Errorf("--from %s is after --to %s", PcapFrom, PcapTo)
+	}
+	return from, to, nil
+}
+
+// filterByTime пропускает пакеты с Timestamp в окне [from, to]; нулевая граница не ограничивает.
+func filterByTime(in <-chan pcappkg.TCPPacket, from, to time.Time) <-chan pcappkg.TCPPacket {
+	if from.IsZero() && to.IsZero() {
+		return in
+	}
+	out := make(chan pcappkg.TCPPacket, 1024)
+	go func() {
+		defer close(out)
+		total, kept := 0, 0
+		for pkt := range in {
+			total++
+			if (!from.IsZero() && pkt.Timestamp.Before(from)) || (!to.IsZero() && pkt.Timestamp.After(to)) {
+				continue
+			}
+			out <- pkt
+			kept++
+		}
+		Logger.Info("kept tcp packets in the --from/--to window", "kept", kept, "total", total)
+	}()
+	return out
+}
+
+// autoDetect сообщает, что сервер определяется по содержимому потоков: задан --auto-detect,
+// а --host и --port оставлены по умолчанию.
+func autoDetect() bool {
+	flags := RootCmd.PersistentFlags()
+	return PcapAutoDetect && !flags.Changed("host") && !flags.Changed("port")
+}
+
+// resolvedServerNets — адреса --host, разрешённые при первом вызове serverNets.
+var resolvedServerNets []*net.IPNet
+
+// serverNets возвращает адреса --host (IP, подсеть CIDR или имя, см. pcappkg.ResolveHost).
+// Имя разрешается один раз, чтобы отбор пакетов и определение направления видели одни и те
+// же адреса. С автоопределением сервера адреса не ограничиваются и возвращается nil.
+func serverNets() ([]*net.IPNet, error) {
+	if autoDetect() {
+		return nil, nil
+	}
+	if resolvedServerNets != nil {
+		return resolvedServerNets, nil
+	}
+	nets, err := pcappkg.ResolveHost(PcapPostgresHost)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --host: %w", err)
+	}
+	if len(nets) > 1 {
+		Logger.Info("--host resolved to several addresses", "host", PcapPostgresHost, "addresses", nets)
+	}
+	resolvedServerNets = nets
+	return nets, nil
+}
+
+// serverPorts возвращает порты --port, проверяя, что каждый помещается в uint16.
+// С автоопределением сервера порты не ограничиваются и возвращается nil.
+func serverPorts() ([]uint16, error) {
+	if autoDetect() {
+		return nil, nil
+	}
+	if len(PcapPostgresPorts) == 0 {
+		return nil, fmt.Errorf("--port is empty")
+	}
+	ports := make([]uint16, 0, len(PcapPostgresPorts))
+	for _, p := range PcapPostgresPorts {
+		if p == 0 || p > math.MaxUint16 {
+			return nil, fmt.Errorf("invalid --port %d", p)
+		}
+		ports = append(ports, uint16(p))
+	}
+	return ports, nil
+}
+
+// extractOptions возвращает параметры сборки сообщений из общих флагов.
+func extractOptions(dir stream.Direction) (stream.ExtractOptions, error) {
+	nets, err := serverNets()
+	if err != nil {
+		return stream.ExtractOptions{}, err
+	}
+	ports, err := serverPorts()
+	if err != nil {
+		return stream.ExtractOptions{}, err
+	}
+	if !(PcapSampleRate > 0 && PcapSampleRate <= 1) {
+		return stream.ExtractOptions{}, fmt.Errorf("invalid --sample-rate %v: must be in (0, 1]", PcapSampleRate)
+	}
+	return stream.ExtractOptions{
+		ServerNets:      nets,
+		Ports:           ports,
+		Direction:       dir,
+		AutoDetect:      autoDetect(),
+		Dedup:           PcapDedup,
+		VerifyRoundtrip: PcapVerifyRoundtrip,
+		MaxMessageSize:  PcapMaxMessageSize,
+		SampleRate:      PcapSampleRate,
+		Logger:          Logger,
+	}, nil
+}
+
+// StreamLivePackets отдаёт в канал TCP-пакеты PostgreSQL, захваченные с интерфейса iface,
+// в порядке прихода. Канал закрывается после SIGINT или SIGTERM, когда дочитаны пакеты, захваченные до закрытия handle.
+func StreamLivePackets(iface string) (<-chan pcappkg.TCPPacket, error) {
+	filterNets, err := serverNets()
+	if err != nil {
+		return nil, err
+	}
+	ports, err := serverPorts()
+	if err != nil {
+		return nil, err
+	}
+	handle, err := GetLivePcapHandle(iface, liveSnaplen, false)
+	if err != nil {
+		return nil, fmt.Errorf("GetLivePcapHandle error: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	Logger.Info("capturing, press Ctrl+C to stop", "interface", iface)
+	packetsCh := pcappkg.ExtractPacketsChan(handle, filterNets, ports, Logger)
+	out := make(chan pcappkg.TCPPacket, 1024)
+	go func() {
+		defer close(out)
+		defer stop()
+		n := 0
+		for {
+			select {
+			case pkt, ok := <-packetsCh:
+				if !ok {
+					Logger.Info("captured tcp packets", "count", n, "interface", iface)
+					return
+				}
+				out <- pkt
+				n++
+			case <-ctx.Done():
+				stop()
+				handle.Close()
+				// дочитываем пакеты, уже отправленные в канал до закрытия handle
+				for pkt := range packetsCh {
+					out <- pkt
+					n++
+				}
+				Logger.Info("captured tcp packets", "count", n, "interface", iface)
+				return
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,237 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"trafRep/internal/stats"
+	"trafRep/internal/stream"
+)
+
+var (
+	statsFormat     = FormatTable
+	statsJSONPretty bool
+	statsBucket     time.Duration
+	statsTop        int
+)
+
+// typeCount — число сообщений одного типа.
+type typeCount struct {
+	Type  string `json:"type"`
+	Count int    `json:"count"`
+}
+
+// commandCount — число ответов CommandComplete с одной командой тега (SELECT, INSERT, ...)
+// и сумма строк из их тегов.
+type commandCount struct {
+	Command string `json:"command"`
+	Count   int    `json:"count"`
+	Rows    int64  `json:"rows"`
+}
+
+// queryShape — одна форма простого запроса (отпечаток) с числом вхождений и задержками,
+// как строка pg_stat_statements.
+type queryShape struct {
+	Fingerprint    string        `json:"fingerprint"`
+	Count          int           `json:"count"`
+	LatencySamples int           `json:"latency_samples"`
+	LatencyTotal   time.Duration `json:"latency_total_ns"`
+	LatencyAvg     time.Duration `json:"latency_avg_ns"`
+}
+
+// statsSummary — сводка по собранным клиентским сообщениям. Задержки считаются от первого
+// пакета сообщения до CommandComplete только для сообщений, ответ на которые попал в захват.
+type statsSummary struct {
+	Messages       int            `json:"messages"`
+	Streams        int            `json:"streams"`
+	Bytes          int            `json:"bytes"`
+	ByType         []typeCount    `json:"by_type"`
+	ByCommand      []commandCount `json:"by_command"`
+	LatencySamples int            `json:"latency_samples"`
+	LatencyMin     time.Duration  `json:"latency_min_ns"`
+	LatencyMax     time.Duration  `json:"latency_max_ns"`
+	LatencyAvg     time.Duration  `json:"latency_avg_ns"`
+	// Arrivals — число запросов (Query и Execute) по интервалам --bucket.
+	Arrivals []stats.Bucket `json:"arrivals,omitempty"`
+	// TopQueries — --top самых частых форм простых запросов.
+	TopQueries []queryShape `json:"top_queries,omitempty"`
+}
+
+// StatsCmd печатает агрегированную статистику по сообщениям из pcap: количество по типам и командам,
+// число потоков, объём, задержки до CommandComplete и самые частые формы запросов, а с --bucket —
+// гистограмму прихода запросов.
+var StatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Сводная статистика по сообщениям из pcap файла",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if statsFormat == FormatWireshark || statsFormat == FormatCSV {
+			return fmt.Errorf("format %s is not supported by stats (allowed: table|json)", statsFormat)
+		}
+
+		packets, err := StreamAllPackets()
+		if err != nil {
+			return err
+		}
+
+		opts, err := extractOptions(stream.DirectionBoth)
+		if err != nil {
+			return err
+		}
+		messages, _ := stream.ExtractMessages(packets, opts)
+		if statsTop < 0 {
+			return fmt.Errorf("--top must be >= 0")
+		}
+		summary := summarize(messages)
+		summary.TopQueries = topQueries(messages, statsTop)
+		if statsBucket != 0 {
+			queries := make([]stream.PostgreSQLMessage, 0, len(messages))
+			for _, m := range messages {
+				if m.Type.NeedCommandCompleteAnswer() {
+					queries = append(queries, m)
+				}
+			}
+			if summary.Arrivals, err = stats.ArrivalHistogram(queries, statsBucket); err != nil {
+				return fmt.Errorf("invalid --bucket: %w", err)
+			}
+		}
+		if statsFormat == FormatJSON {
+			enc := json.NewEncoder(os.Stdout)
+			if statsJSONPretty {
+				enc.SetIndent("", "  ")
+			}
+			return enc.Encode(summary)
+		}
+		writeStatsTable(os.Stdout, summary)
+		return nil
+	},
+}
+
+func summarize(messages []stream.PostgreSQLMessage) statsSummary {
+	var s statsSummary
+	streams := make(map[string]bool)
+	types := make(map[string]int)
+	commands := make(map[string]*commandCount)
+	var latencyTotal time.Duration
+	for _, m := range messages {
+		s.Messages++
+		s.Bytes += len(m.Row())
+		streams[m.StreamID] = true
+		types[m.Type.String()]++
+		for _, tag := range strings.Split(m.CommandTag, "; ") {
+			fields := strings.Fields(tag)
+			if len(fields) == 0 {
+				continue
+			}
+			c, ok := commands[fields[0]]
+			if !ok {
+				c = &commandCount{Command: fields[0]}
+				commands[fields[0]] = c
+			}
+			c.Count++
+			if rows, ok := stream.CommandTagRows(tag); ok {
+				c.Rows += rows
+			}
+		}
+
+		d, ok := messageLatency(m)
+		if !ok {
+			continue
+		}
+		if s.LatencySamples == 0 || d < s.LatencyMin {
+			s.LatencyMin = d
+		}
+		s.LatencyMax = max(s.LatencyMax, d)
+		latencyTotal += d
+		s.LatencySamples++
+	}
+	s.Streams = len(streams)
+	if s.LatencySamples > 0 {
+		s.LatencyAvg = latencyTotal / time.Duration(s.LatencySamples)
+	}
+
+	for t, c := range types {
+		s.ByType = append(s.ByType, typeCount{Type: t, Count: c})
+	}
+	sort.Slice(s.ByType, func(i, j int) bool {
+		if s.ByType[i].Count != s.ByType[j].Count {
+			return s.ByType[i].Count > s.ByType[j].Count
+		}
+		return s.ByType[i].Type < s.ByType[j].Type
+	})
+	for _, c := range commands {
+		s.ByCommand = append(s.ByCommand, *c)
+	}
+	sort.Slice(s.ByCommand, func(i, j int) bool {
+		if s.ByCommand[i].Count != s.ByCommand[j].Count {
+			return s.ByCommand[i].Count > s.ByCommand[j].Count
+		}
+		return s.ByCommand[i].Command < s.ByCommand[j].Command
+	})
+	return s
+}
+
+// topQueries возвращает n самых частых форм простых запросов (n == 0 — ни одной).
+func topQueries(messages []stream.PostgreSQLMessage, n int) []queryShape {
+	fps := stream.AggregateFingerprints(messages, 1)
+	out := make([]queryShape, 0, min(n, len(fps)))
+	for _, st := range fps[:min(n, len(fps))] {
+		out = append(out, queryShape{
+			Fingerprint:    st.Fingerprint,
+			Count:          st.Count,
+			LatencySamples: st.LatencySamples,
+			LatencyTotal:   st.Latency,
+			LatencyAvg:     st.AvgLatency(),
+		})
+	}
+	return out
+}
+
+func writeStatsTable(w io.Writer, s statsSummary) {
+	fmt.Fprintf(w, "Messages: %d\n", s.Messages)
+	fmt.Fprintf(w, "Streams:  %d\n", s.Streams)
+	fmt.Fprintf(w, "Bytes:    %d\n", s.Bytes)
+	fmt.Fprintln(w, "By type:")
+	for _, tc := range s.ByType {
+		fmt.Fprintf(w, "  %-24s %d\n", tc.Type, tc.Count)
+	}
+	if len(s.ByCommand) > 0 {
+		fmt.Fprintln(w, "By command (CommandComplete tags):")
+		for _, c := range s.ByCommand {
+			fmt.Fprintf(w, "  %-24s %d, rows %d\n", c.Command, c.Count, c.Rows)
+		}
+	}
+	if s.LatencySamples == 0 {
+		fmt.Fprintln(w, "Latency:  no CommandComplete in capture")
+	} else {
+		fmt.Fprintf(w, "Latency (%d samples): min %s, avg %s, max %s\n",
+			s.LatencySamples, formatLatency(s.LatencyMin), formatLatency(s.LatencyAvg), formatLatency(s.LatencyMax))
+	}
+	if len(s.TopQueries) > 0 {
+		fmt.Fprintln(w, "Top queries (count | total latency | avg latency | fingerprint):")
+		for _, q := range s.TopQueries {
+			total, avg := "-", "-"
+			if q.LatencySamples > 0 {
+				total, avg = formatLatency(q.LatencyTotal), formatLatency(q.LatencyAvg)
+			}
+			fmt.Fprintf(w, "  %6d | %10s | %10s | %s\n", q.Count, total, avg, q.Fingerprint)
+		}
+	}
+	if statsBucket != 0 {
+		fmt.Fprintf(w, "Queries per %v:\n", statsBucket)
+		stats.WriteHistogram(w, s.Arrivals)
+	}
+}
+
+func init() {
+	StatsCmd.Flags().Var(&statsFormat, "output", "Формат вывода: table | json")
+	StatsCmd.Flags().DurationVar(&statsBucket, "bucket", 0, "Печатать гистограмму прихода запросов (Query, Execute) с интервалом этой ширины, например 1s (0 — не печатать)")
+	StatsCmd.Flags().IntVar(&statsTop, "top", 10, "Показать N самых частых форм простых запросов (литералы заменены на ?) с суммарной и средней задержкой; 0 — не показывать")
+	StatsCmd.Flags().BoolVar(&statsJSONPretty, "json-pretty", false, "Печатать JSON с отступами (для --output json)")
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"trafRep/internal/stream"
+	msgtypes "trafRep/internal/stream/message_types"
+)
+
+// wiresharkTypeNames повторяет подписи типов сообщений из диссектора PostgreSQL в Wireshark.
+var wiresharkTypeNames = map[msgtypes.ClientMessageType]string{
+	msgtypes.MessageTypeQuery:                "Simple query",
+	msgtypes.MessageTypeParse:                "Parse",
+	msgtypes.MessageTypeBind:                 "Bind",
+	msgtypes.MessageTypeExecute:              "Execute",
+	msgtypes.MessageTypeSync:                 "Sync",
+	msgtypes.MessageTypeTerminate:            "Termination",
+	msgtypes.MessageTypeCopyData:             "Copy data",
+	msgtypes.MessageTypeCopyFail:             "Copy fail",
+	msgtypes.MessageTypeCopyDone:             "Copy completion",
+	msgtypes.MessageTypeDescribe:             "Describe",
+	msgtypes.MessageTypeFlush:                "Flush",
+	msgtypes.MessageTypeFunctionCall:         "Function call",
+	msgtypes.MessageTypeFunctionCallResponse: "Function call response",
+	msgtypes.MessageTypePasswordMessage:      "Password message",
+	msgtypes.MessageTypeClose:                "Close",
+	msgtypes.ClientMessageTypeOnlyLength:     "Startup message",
+}
+
+// writeWireshark печатает сообщение в виде, похожем на дерево диссектора PostgreSQL в Wireshark:
+// заголовок кадра, тип, длина и декодированные поля, известные трафрепу.
+func writeWireshark(w io.Writer, index int, m stream.PostgreSQLMessage) {
+	fmt.Fprintf(w, "Message %d: %s\n", index, m.FirstTCPPacketTimestamp.Format("2006-01-02 15:04:05.000000"))
+	fmt.Fprintln(w, "PostgreSQL")
+
+	name, ok := wiresharkTypeNames[m.Type]
+	if !ok {
+		name = fmt.Sprintf("Unknown (%q)", byte(m.Type))
+	}
+	fmt.Fprintf(w, "    Type: %s\n", name)
+	fmt.Fprintf(w, "    Length: %d\n", m.Len)
+
+	switch {
+	case m.Compression != "" && m.Type.HaveTypeByte():
+		fmt.Fprintf(w, "    Compression: %s\n", m.Compression)
+		writeWiresharkData(w, m.Payload)
+	case m.Type.IsSimpleQuery():
+		fmt.Fprintf(w, "    Query: %s\n", m.PrettyQuery())
+	case !m.Type.HaveTypeByte():
+		sm, ok := m.StartupMessage()
+		if !ok {
+			writeWiresharkData(w, m.Payload)
+			break
+		}
+		fmt.Fprintf(w, "    Protocol major version: %d\n", sm.ProtocolVersion>>16)
+		fmt.Fprintf(w, "    Protocol minor version: %d\n", sm.ProtocolVersion&0xffff)
+		for _, p := range sm.Parameters {
+			fmt.Fprintf(w, "    Parameter name: %s\n", p.Name)
+			fmt.Fprintf(w, "    Parameter value: %s\n", p.Value)
+		}
+	case m.Type == msgtypes.MessageTypeClose:
+		c, ok := m.Close()
+		if !ok {
+			writeWiresharkData(w, m.Payload)
+			break
+		}
+		if c.Kind == 'S' {
+			fmt.Fprintf(w, "    Statement: %s\n", c.Name)
+		} else {
+			fmt.Fprintf(w, "    Portal: %s\n", c.Name)
+		}
+	case m.Type == msgtypes.MessageTypeParse:
+		p, err := stream.DecodeParse(m.Payload)
+		if err != nil {
+			writeWiresharkData(w, m.Payload)
+			break
+		}
+		fmt.Fprintf(w, "    Statement: %s\n", p.Name)
+		fmt.Fprintf(w, "    Query: %s\n", p.Query)
+		fmt.Fprintf(w, "    Parameters: %d\n", len(p.ParamTypes))
+		for _, oid := range p.ParamTypes {
+			fmt.Fprintf(w, "        Type OID: %d\n", oid)
+		}
+	case m.Type == msgtypes.MessageTypeBind:
+		b, err := stream.DecodeBind(m.Payload)
+		if err != nil {
+			writeWiresharkData(w, m.Payload)
+			break
+		}
+		fmt.Fprintf(w, "    Portal: %s\n", b.Portal)
+		fmt.Fprintf(w, "    Statement: %s\n", b.Statement)
+		fmt.Fprintf(w, "    Parameter values: %d\n", len(b.Params))
+		for _, v := range b.Params {
+			if v == nil {
+				fmt.Fprintln(w, "        Column length: -1")
+				continue
+			}
+			fmt.Fprintf(w, "        Column length: %d\n", len(v))
+			fmt.Fprintf(w, "        Data: %s\n", hex.EncodeToString(v))
+		}
+	case m.Type == msgtypes.MessageTypePasswordMessage:
+		fmt.Fprintln(w, "    Password: <hidden>")
+	default:
+		writeWiresharkData(w, m.Payload)
+	}
+	fmt.Fprintln(w)
+}
+
+func writeWiresharkData(w io.Writer, payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "    Data: %s\n", hex.EncodeToString(payload))
+}
+
+// writeWiresharkServer печатает серверное сообщение в том же виде, что writeWireshark:
+// тип, длину и разобранные тег CommandComplete, поля ошибки или столбцы RowDescription.
+func writeWiresharkServer(w io.Writer, index int, m stream.ServerMessage) {
+	fmt.Fprintf(w, "Message %d: %s\n", index, m.Timestamp.Format("2006-01-02 15:04:05.000000"))
+	fmt.Fprintln(w, "PostgreSQL")
+	fmt.Fprintf(w, "    Type: %s\n", m.Type)
+	fmt.Fprintf(w, "    Length: %d\n", m.Len)
+	switch {
+	case m.CommandTag != "":
+		fmt.Fprintf(w, "    Tag: %s\n", m.CommandTag)
+	case m.Error != nil:
+		fmt.Fprintf(w, "    Severity: %s\n", m.Error.Severity)
+		fmt.Fprintf(w, "    Code: %s\n", m.Error.Code)
+		fmt.Fprintf(w, "    Message: %s\n", m.Error.Message)
+		if m.Error.Detail != "" {
+			fmt.Fprintf(w, "    Detail: %s\n", m.Error.Detail)
+		}
+		if m.Error.Hint != "" {
+			fmt.Fprintf(w, "    Hint: %s\n", m.Error.Hint)
+		}
+	case m.RowDescription != nil:
+		fmt.Fprintf(w, "    Field count: %d\n", len(m.RowDescription.Fields))
+		for _, f := range m.RowDescription.Fields {
+			fmt.Fprintf(w, "        Column name: %s\n", f.Name)
+			fmt.Fprintf(w, "            Table OID: %d\n", f.TableOID)
+			fmt.Fprintf(w, "            Column index: %d\n", f.ColumnAttr)
+			fmt.Fprintf(w, "            Type OID: %d\n", f.TypeOID)
+			fmt.Fprintf(w, "            Column length: %d\n", f.TypeSize)
+			fmt.Fprintf(w, "            Type modifier: %d\n", f.TypeModifier)
+			fmt.Fprintf(w, "            Format: %d\n", f.Format)
+		}
+	}
+	fmt.Fprintln(w)
+}
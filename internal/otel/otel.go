@@ -0,0 +1,130 @@
+//go:build otel
+
+// Package otel экспортирует события воспроизведения как OpenTelemetry spans по OTLP/HTTP.
+// Пакет собирается только с тегом otel, чтобы основной бинарник не тянул зависимости OTel.
+package otel
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"trafRep/internal/replay"
+	"trafRep/internal/stream"
+)
+
+// Tracer реализует replay.Tracer: корневой span "replay", вложенные spans
+// на каждое целевое соединение и spans на каждое воспроизведённое сообщение.
+type Tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+
+	rootCtx context.Context
+	root    trace.Span
+
+	// open — трассы соединений, ещё не завершённые End; Close завершает их
+	mu   sync.Mutex
+	open map[*connection]struct{}
+}
+
+// connection реализует replay.ConnectionTrace: span одного соединения с целью.
+type connection struct {
+	t    *Tracer
+	ctx  context.Context
+	span trace.Span
+}
+
+// NewTracer создаёт экспортёр OTLP/HTTP для endpoint (host:port) и открывает корневой span.
+func NewTracer(endpoint string) (*Tracer, error) {
+	ctx := context.Background()
+	exp, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpoint(endpoint),
+		otlptracehttp.WithInsecure(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create otlp exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("trafrep"))),
+	)
+	t := &Tracer{
+		provider: provider,
+		tracer:   provider.Tracer("trafRep/replay"),
+		open:     make(map[*connection]struct{}),
+	}
+	t.rootCtx, t.root = t.tracer.Start(ctx, "replay")
+	return t, nil
+}
+
+// StartConnection открывает span соединения с target, вложенный в корневой span.
+func (t *Tracer) StartConnection(target string) replay.ConnectionTrace {
+	c := &connection{t: t}
+	c.ctx, c.span = t.tracer.Start(t.rootCtx, "connection",
+		trace.WithAttributes(attribute.String("net.peer.name", target)),
+	)
+	t.mu.Lock()
+	t.open[c] = struct{}{}
+	t.mu.Unlock()
+	return c
+}
+
+// Message записывает span сообщения m, вложенный в span соединения: от start до
+// start+latency, с ошибкой err, если она не nil.
+func (c *connection) Message(m stream.PostgreSQLMessage, bytes int, start time.Time, latency time.Duration, err error) {
+	attrs := []attribute.KeyValue{
+		attribute.String("pg.message.type", m.Type.String()),
+		attribute.Int("pg.message.bytes", bytes),
+		attribute.Int64("pg.latency_us", latency.Microseconds()),
+	}
+	if m.Type.IsSimpleQuery() {
+		attrs = append(attrs, attribute.String("db.query.fingerprint", stream.Fingerprint(m.PrettyQuery())))
+	}
+
+	_, span := c.t.tracer.Start(c.ctx, "message "+m.Type.String(),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(attrs...),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(start.Add(latency)))
+}
+
+// End завершает span соединения. Повторный вызов ничего не делает.
+func (c *connection) End() {
+	c.t.mu.Lock()
+	_, open := c.t.open[c]
+	delete(c.t.open, c)
+	c.t.mu.Unlock()
+	if open {
+		c.span.End()
+	}
+}
+
+// Close завершает незакрытые spans соединений и корневой span и сбрасывает накопленные
+// spans экспортёру (не дольше 10 секунд).
+func (t *Tracer) Close() error {
+	t.mu.Lock()
+	open := t.open
+	t.open = make(map[*connection]struct{})
+	t.mu.Unlock()
+	for c := range open {
+		c.span.End()
+	}
+	t.root.End()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return t.provider.Shutdown(ctx)
+}
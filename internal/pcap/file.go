@@ -0,0 +1,169 @@
+package pcap
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Source — источник пакетов для ExtractPackets: *pcap.Handle (classic pcap, живой захват)
+// или файл, читаемый через pcapgo (pcapng, сжатый gzip).
+type Source interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+	Close()
+}
+
+// Сигнатуры начала файла: classic pcap с микро- и наносекундными метками (в обоих
+// порядках байтов), Section Header Block pcapng и заголовок gzip.
+const (
+	magicPcapMicro        = 0xa1b2c3d4
+	magicPcapMicroSwapped = 0xd4c3b2a1
+	magicPcapNano         = 0xa1b23c4d
+	magicPcapNanoSwapped  = 0x4d3cb2a1
+	magicPcapNG           = 0x0a0d0d0a
+
+	gzipID1 = 0x1f
+	gzipID2 = 0x8b
+)
+
+// OpenFile открывает файл захвата path, определяя формат по сигнатуре: classic pcap
+// читается через libpcap, pcapng — через pcapgo.NgReader. Файл, сжатый gzip (.pcap.gz,
+// .pcapng.gz), распаковывается на лету и читается через pcapgo без временного файла.
+// Если bpf не пуст, пакеты фильтруются выражением BPF. Для файла другого формата
+// возвращается ошибка.
+func OpenFile(path, bpf string) (Source, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	head, err := br.Peek(4)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("read %s header: %w", path, err)
+	}
+
+	if head[0] == gzipID1 && head[1] == gzipID2 {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("open gzip %s: %w", path, err)
+		}
+		src, err := openReader(bufio.NewReader(zr), path, bpf, multiCloser{zr, f})
+		if err != nil {
+			_ = zr.Close()
+			_ = f.Close()
+			return nil, err
+		}
+		return src, nil
+	}
+
+	switch binary.BigEndian.Uint32(head) {
+	case magicPcapMicro, magicPcapMicroSwapped, magicPcapNano, magicPcapNanoSwapped:
+		_ = f.Close()
+		handle, err := pcap.OpenOffline(path)
+		if err != nil {
+			return nil, err
+		}
+		if bpf != "" {
+			if err := handle.SetBPFFilter(bpf); err != nil {
+				handle.Close()
+				return nil, fmt.Errorf("invalid bpf %q: %w", bpf, err)
+			}
+		}
+		return handle, nil
+	}
+	src, err := openReader(br, path, bpf, f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return src, nil
+}
+
+// packetReader — общее у pcapgo.Reader и pcapgo.NgReader.
+type packetReader interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// openReader читает захват из r средствами pcapgo (pcap или pcapng по сигнатуре).
+// closer закрывается в Source.Close; при ошибке закрывать его должна вызывающая сторона.
+func openReader(r *bufio.Reader, path, bpf string, closer io.Closer) (Source, error) {
+	head, err := r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("read %s header: %w", path, err)
+	}
+
+	var reader packetReader
+	switch binary.BigEndian.Uint32(head) {
+	case magicPcapMicro, magicPcapMicroSwapped, magicPcapNano, magicPcapNanoSwapped:
+		reader, err = pcapgo.NewReader(r)
+	case magicPcapNG:
+		reader, err = pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+	default:
+		return nil, fmt.Errorf("%s is neither pcap nor pcapng (magic %x)", path, head)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	src := &readerSource{packetReader: reader, closer: closer}
+	if bpf != "" {
+		// BPF компилируется под тип канала, а усечённый тип SLL2 libpcap не поймёт
+		if reader.LinkType() == LinkTypeLinuxSLL2 {
+			return nil, fmt.Errorf("--bpf is not supported for Linux SLL2 capture %s read without libpcap", path)
+		}
+		src.bpf, err = pcap.NewBPF(reader.LinkType(), readerSnaplen, bpf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bpf %q: %w", bpf, err)
+		}
+	}
+	return src, nil
+}
+
+// readerSnaplen — длина захвата, для которой компилируется BPF-фильтр readerSource.
+const readerSnaplen = 262144
+
+// readerSource читает захват через pcapgo и, если задан bpf, пропускает только
+// подходящие пакеты.
+type readerSource struct {
+	packetReader
+	closer io.Closer
+	bpf    *pcap.BPF
+}
+
+func (s *readerSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := s.packetReader.ReadPacketData()
+		if err != nil || s.bpf == nil || s.bpf.Matches(ci, data) {
+			return data, ci, err
+		}
+	}
+}
+
+func (s *readerSource) Close() {
+	_ = s.closer.Close()
+}
+
+// multiCloser закрывает все элементы по порядку.
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var first error
+	for _, c := range m {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
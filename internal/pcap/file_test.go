@@ -0,0 +1,115 @@
+package pcap
+
+import (
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Захваты в testdata содержат одно и то же соединение: запрос клиента 10.0.0.1:40000
+// к 10.0.0.2:5432, ответ сервера, пустой ACK клиента и HTTP-запрос к 10.0.0.3:80.
+// Пакеты идут с интервалом в миллисекунду начиная с fixtureStart.
+var fixtureStart = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// fixturePackets — пакеты захватов testdata, которые проходят фильтр 10.0.0.2:5432.
+var fixturePackets = []TCPPacket{
+	{
+		Timestamp:  fixtureStart,
+		Data:       []byte("Q\x00\x00\x00\x0dselect 1\x00"),
+		IPSource:   "10.0.0.1",
+		IPDest:     "10.0.0.2",
+		PortSource: 40000,
+		PortDest:   5432,
+		Seq:        1000,
+		Ack:        5000,
+	},
+	{
+		Timestamp:  fixtureStart.Add(time.Millisecond),
+		Data:       []byte("C\x00\x00\x00\x0dSELECT 1\x00Z\x00\x00\x00\x05I"),
+		IPSource:   "10.0.0.2",
+		IPDest:     "10.0.0.1",
+		PortSource: 5432,
+		PortDest:   40000,
+		Seq:        5000,
+		Ack:        1014,
+	},
+}
+
+func quietLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// extractFile открывает захват path через OpenFile и возвращает его пакеты, проходящие
+// фильтр 10.0.0.2:5432, с метками времени в UTC.
+func extractFile(t *testing.T, path string) []TCPPacket {
+	t.Helper()
+	src, err := OpenFile(path, "")
+	if err != nil {
+		t.Fatalf("OpenFile(%s): %v", path, err)
+	}
+	defer src.Close()
+	nets, err := ResolveHost("10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := ExtractPackets(src, nets, []uint16{5432}, quietLogger())
+	for i := range packets {
+		packets[i].Timestamp = packets[i].Timestamp.UTC()
+	}
+	return packets
+}
+
+// gzipFile сжимает файл path во временный каталог теста и возвращает путь к копии.
+func gzipFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), filepath.Base(path)+".gz")
+	f, err := os.Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(f)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestOpenFileFormatsYieldSamePackets(t *testing.T) {
+	// classic pcap читается через libpcap, pcapng и сжатые файлы — через pcapgo
+	for _, path := range []string{
+		"testdata/postgres.pcap",
+		"testdata/postgres.pcapng",
+		gzipFile(t, "testdata/postgres.pcap"),
+		gzipFile(t, "testdata/postgres.pcapng"),
+	} {
+		if got := extractFile(t, path); !reflect.DeepEqual(got, fixturePackets) {
+			t.Errorf("%s: packets\n%+v\nwant\n%+v", filepath.Base(path), got, fixturePackets)
+		}
+	}
+}
+
+func TestOpenFileRejectsUnknownFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.txt")
+	if err := os.WriteFile(path, []byte("not a capture"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if src, err := OpenFile(path, ""); err == nil {
+		src.Close()
+		t.Error("OpenFile accepted a file that is neither pcap nor pcapng")
+	}
+}
@@ -0,0 +1,62 @@
+package pcap
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// followPollInterval — как часто при --follow проверяется, не дописан ли файл.
+const followPollInterval = 200 * time.Millisecond
+
+// followReader читает файл, который продолжает дописывать другой процесс: на конце файла
+// Read ждёт новых данных, а io.EOF возвращает только после отмены ctx.
+type followReader struct {
+	ctx context.Context
+	f   *os.File
+}
+
+func (r *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.f.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		select {
+		case <-r.ctx.Done():
+			return 0, io.EOF
+		case <-time.After(followPollInterval):
+		}
+	}
+}
+
+// OpenFollow открывает файл захвата path (pcap или pcapng) для чтения по мере записи,
+// как tail -f: пакеты, дописанные после текущего конца файла, тоже читаются. Источник
+// исчерпывается только после отмены ctx; недописанный к этому моменту пакет отбрасывается.
+// Файл читается через pcapgo, так как libpcap останавливается на конце файла; сжатые
+// gzip захваты не поддерживаются.
+func OpenFollow(ctx context.Context, path, bpf string) (Source, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(&followReader{ctx: ctx, f: f})
+	head, err := br.Peek(2)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("read %s header: %w", path, err)
+	}
+	if head[0] == gzipID1 && head[1] == gzipID2 {
+		_ = f.Close()
+		return nil, fmt.Errorf("%s is gzip-compressed and cannot be followed", path)
+	}
+	src, err := openReader(br, path, bpf, f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return src, nil
+}
@@ -0,0 +1,79 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Поддерживаемые типы канального уровня захвата:
+//   - Ethernet (в том числе с метками VLAN/QinQ и MPLS);
+//   - Linux cooked capture SLL и SLL2 (tcpdump -i any; SLL2 — по умолчанию с libpcap 1.10);
+//   - Raw IP, IPv4, IPv6 (захват с туннельных интерфейсов);
+//   - Null и Loop (loopback BSD и macOS).
+//
+// Для остальных типов ExtractPacketsChan предупреждает в логе: gopacket может их разобрать,
+// но извлечение на них не проверялось.
+const (
+	// LinkTypeLinuxSLL2 — DLT_LINUX_SLL2 (276), которого нет в gopacket. layers.LinkType —
+	// uint8, и gopacket (libpcap и pcapgo) отдаёт этот тип усечённым до младшего байта;
+	// значение 20 другим типом не занято.
+	LinkTypeLinuxSLL2 layers.LinkType = 276 & 0xff
+
+	// linuxSLL2HeaderLen — длина заголовка SLL2: тип протокола, резерв, индекс интерфейса,
+	// тип ARPHRD, тип пакета, длина адреса и 8 байт адреса.
+	linuxSLL2HeaderLen = 20
+)
+
+var supportedLinkTypes = map[layers.LinkType]bool{
+	layers.LinkTypeEthernet: true,
+	layers.LinkTypeLinuxSLL: true,
+	LinkTypeLinuxSLL2:       true,
+	layers.LinkTypeRaw:      true,
+	layers.LinkTypeIPv4:     true,
+	layers.LinkTypeIPv6:     true,
+	layers.LinkTypeNull:     true,
+	layers.LinkTypeLoop:     true,
+}
+
+// LayerTypeLinuxSLL2 — тип слоя заголовка SLL2 (номера до 2000 зарезервированы gopacket).
+var LayerTypeLinuxSLL2 = gopacket.RegisterLayerType(2276, gopacket.LayerTypeMetadata{
+	Name:    "LinuxSLL2",
+	Decoder: gopacket.DecodeFunc(decodeLinuxSLL2),
+})
+
+func init() {
+	layers.LinkTypeMetadata[LinkTypeLinuxSLL2] = layers.EnumMetadata{DecodeWith: LayerTypeLinuxSLL2, Name: "Linux SLL2"}
+	layers.LinkTypeMetadata[layers.LinkTypeIPv4] = layers.EnumMetadata{DecodeWith: layers.LayerTypeIPv4, Name: "IPv4"}
+	layers.LinkTypeMetadata[layers.LinkTypeIPv6] = layers.EnumMetadata{DecodeWith: layers.LayerTypeIPv6, Name: "IPv6"}
+}
+
+// LinuxSLL2 — заголовок Linux cooked capture v2. Полезная нагрузка разбирается по
+// EthernetType, как у Ethernet.
+type LinuxSLL2 struct {
+	layers.BaseLayer
+	EthernetType   layers.EthernetType
+	InterfaceIndex uint32
+	PacketType     uint8
+	Addr           []byte
+}
+
+func (s *LinuxSLL2) LayerType() gopacket.LayerType { return LayerTypeLinuxSLL2 }
+
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	if len(data) < linuxSLL2HeaderLen {
+		p.SetTruncated()
+		return fmt.Errorf("linux SLL2 header too short: %d bytes", len(data))
+	}
+	s := &LinuxSLL2{
+		EthernetType:   layers.EthernetType(binary.BigEndian.Uint16(data[0:2])),
+		InterfaceIndex: binary.BigEndian.Uint32(data[4:8]),
+		PacketType:     data[10],
+	}
+	s.Addr = data[12 : 12+min(int(data[11]), 8)]
+	s.BaseLayer = layers.BaseLayer{Contents: data[:linuxSLL2HeaderLen], Payload: data[linuxSLL2HeaderLen:]}
+	p.AddLayer(s)
+	return p.NextDecoder(s.EthernetType)
+}
@@ -0,0 +1,70 @@
+package pcap
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestOpenFileLinuxCookedCapture(t *testing.T) {
+	// sll2.* записаны с DLT_LINUX_SLL2 (276): libpcap и pcapgo отдают его усечённым
+	// до LinkTypeLinuxSLL2
+	tests := []struct {
+		path     string
+		linkType layers.LinkType
+	}{
+		{"testdata/sll.pcap", layers.LinkTypeLinuxSLL},
+		{"testdata/sll2.pcap", LinkTypeLinuxSLL2},
+		{"testdata/sll2.pcapng", LinkTypeLinuxSLL2},
+	}
+	for _, tt := range tests {
+		t.Run(filepath.Base(tt.path), func(t *testing.T) {
+			src, err := OpenFile(tt.path, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			linkType := src.LinkType()
+			src.Close()
+			if linkType != tt.linkType {
+				t.Errorf("link type %v, want %v", linkType, tt.linkType)
+			}
+			if got := extractFile(t, tt.path); !reflect.DeepEqual(got, fixturePackets) {
+				t.Errorf("packets\n%+v\nwant\n%+v", got, fixturePackets)
+			}
+		})
+	}
+}
+
+func TestDecodeLinuxSLL2(t *testing.T) {
+	header := []byte{
+		0x08, 0x00, // EtherType IPv4
+		0, 0, // резерв
+		0, 0, 0, 2, // индекс интерфейса
+		0, 1, // ARPHRD_ETHER
+		4,                      // PACKET_OUTGOING
+		6,                      // длина адреса
+		2, 0, 0, 0, 0, 1, 0, 0, // адрес
+	}
+	frame := append(header, serialize(t, "x")...)
+
+	packet := gopacket.NewPacket(frame, LinkTypeLinuxSLL2, gopacket.Default)
+	sll, ok := packet.Layer(LayerTypeLinuxSLL2).(*LinuxSLL2)
+	if !ok {
+		t.Fatalf("no SLL2 layer: %v", packet.ErrorLayer())
+	}
+	if sll.EthernetType != layers.EthernetTypeIPv4 || sll.InterfaceIndex != 2 || sll.PacketType != 4 ||
+		!reflect.DeepEqual(sll.Addr, []byte{2, 0, 0, 0, 0, 1}) {
+		t.Errorf("SLL2 header %+v", sll)
+	}
+	if packet.TransportLayer() == nil {
+		t.Errorf("payload not decoded down to TCP: %v", packet.ErrorLayer())
+	}
+
+	short := gopacket.NewPacket(header[:linuxSLL2HeaderLen-1], LinkTypeLinuxSLL2, gopacket.Default)
+	if short.ErrorLayer() == nil || !short.Metadata().Truncated {
+		t.Error("short SLL2 header decoded without error")
+	}
+}
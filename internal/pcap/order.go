@@ -0,0 +1,91 @@
+package pcap
+
+import "container/heap"
+
+// MergePackets сливает каналы, каждый из которых упорядочен по времени, в один
+// упорядоченный канал. При равном Timestamp первым идёт пакет из канала с меньшим
+// индексом, как при стабильной сортировке объединённого списка.
+func MergePackets(inputs ...<-chan TCPPacket) <-chan TCPPacket {
+	if len(inputs) == 1 {
+		return inputs[0]
+	}
+	out := make(chan TCPPacket, 1024)
+	go func() {
+		defer close(out)
+		heads := make([]TCPPacket, len(inputs))
+		open := make([]bool, len(inputs))
+		for i, in := range inputs {
+			heads[i], open[i] = <-in
+		}
+		for {
+			next := -1
+			for i := range inputs {
+				if open[i] && (next < 0 || heads[i].Timestamp.Before(heads[next].Timestamp)) {
+					next = i
+				}
+			}
+			if next < 0 {
+				return
+			}
+			out <- heads[next]
+			heads[next], open[next] = <-inputs[next]
+		}
+	}()
+	return out
+}
+
+// ReorderPackets восстанавливает порядок по Timestamp в пределах окна из window пакетов:
+// пакет отправляется дальше, только когда в буфере накопилось больше window пакетов
+// и он среди них самый ранний. Пакет, опоздавший больше чем на window позиций,
+// остаётся не на своём месте. При window <= 0 канал возвращается как есть.
+func ReorderPackets(in <-chan TCPPacket, window int) <-chan TCPPacket {
+	if window <= 0 {
+		return in
+	}
+	out := make(chan TCPPacket, 1024)
+	go func() {
+		defer close(out)
+		var buf packetHeap
+		var arrival uint64
+		for pkt := range in {
+			heap.Push(&buf, orderedPacket{TCPPacket: pkt, arrival: arrival})
+			arrival++
+			if buf.Len() > window {
+				out <- heap.Pop(&buf).(orderedPacket).TCPPacket
+			}
+		}
+		for buf.Len() > 0 {
+			out <- heap.Pop(&buf).(orderedPacket).TCPPacket
+		}
+	}()
+	return out
+}
+
+// orderedPacket — пакет в буфере ReorderPackets; arrival сохраняет исходный порядок
+// пакетов с одинаковым Timestamp.
+type orderedPacket struct {
+	TCPPacket
+	arrival uint64
+}
+
+type packetHeap []orderedPacket
+
+func (h packetHeap) Len() int { return len(h) }
+
+func (h packetHeap) Less(i, j int) bool {
+	if !h[i].Timestamp.Equal(h[j].Timestamp) {
+		return h[i].Timestamp.Before(h[j].Timestamp)
+	}
+	return h[i].arrival < h[j].arrival
+}
+
+func (h packetHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *packetHeap) Push(x any) { *h = append(*h, x.(orderedPacket)) }
+
+func (h *packetHeap) Pop() any {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return p
+}
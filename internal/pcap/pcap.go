@@ -1,17 +1,20 @@
 package pcap
 
 import (
+	"fmt"
+	"log/slog"
 	"net"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
 // TCPPacket представляет сетевой TCP-пакет, извлечённый из pcap.
 // Поля содержат метаданные пакета: время прихода, полезную нагрузку,
-// IP-адреса источника и назначения и соответствующие порты.
+// IP-адреса источника и назначения, соответствующие порты и номера SEQ/ACK.
 type TCPPacket struct {
 	Timestamp  time.Time
 	Data       []byte
@@ -19,42 +22,158 @@ type TCPPacket struct {
 	IPDest     string
 	PortSource uint16
 	PortDest   uint16
+	Seq        uint32
+	Ack        uint32
 }
 
-// ExtractPackets читает пакеты из handle и возвращает TCPPacket,
-// соответствующие заданному filterIP и filterPort.
-// Функция возвращает только те пакеты,
-// у которых src или dst совпадает с filterIP и соответствующий порт равен filterPort.
-func ExtractPackets(handle *pcap.Handle, filterIP net.IP, filterPort uint16) []TCPPacket {
-	if filterIP == nil {
-		return nil
+// legacyVLANTypes — TPID внешней метки QinQ, которыми до стандартизации 802.1ad (0x88a8)
+// пользовались коммутаторы разных производителей. gopacket их не знает и останавливает
+// разбор пакета на Ethernet, поэтому захват со SPAN-порта с такими метками давал бы ноль пакетов.
+var legacyVLANTypes = []layers.EthernetType{0x9100, 0x9200, 0x9300}
+
+func init() {
+	// метки 802.1Q (0x8100) и 802.1ad (0x88a8) в любом количестве, а также MPLS
+	// gopacket разбирает сам; устаревшие TPID разбираются тем же декодером Dot1Q
+	for _, t := range legacyVLANTypes {
+		layers.EthernetTypeMetadata[t] = layers.EthernetTypeMetadata[layers.EthernetTypeDot1Q]
 	}
+}
 
+// ExtractPackets читает пакеты из handle и возвращает TCPPacket,
+// соответствующие заданным filterNets и filterPorts.
+// Функция возвращает только те пакеты,
+// у которых src или dst входит в одну из filterNets и соответствующий порт входит в filterPorts.
+// Пустой filterNets или filterPorts не ограничивает адрес или порт: при обоих пустых
+// возвращаются все TCP-пакеты с данными.
+// Все пакеты держатся в памяти; для больших захватов используйте ExtractPacketsChan.
+func ExtractPackets(handle Source, filterNets []*net.IPNet, filterPorts []uint16, logger *slog.Logger) []TCPPacket {
 	var packets []TCPPacket
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	for pkt := range ExtractPacketsChan(handle, filterNets, filterPorts, logger) {
+		packets = append(packets, pkt)
+	}
+	return packets
+}
 
-	for packet := range packetSource.Packets() {
-		tcp, ok := packet.TransportLayer().(*layers.TCP)
-		if !ok || tcp == nil || len(tcp.Payload) == 0 {
-			continue
+// ExtractPacketsChan читает пакеты из handle в отдельной горутине и отправляет в канал те,
+// что проходят фильтр ExtractPackets, по мере декодирования. Канал закрывается, когда
+// источник исчерпан: для файла — по достижении конца, для живого захвата — после handle.Close().
+// Пакеты идут в порядке записи в захват, то есть почти по времени; при необходимости
+// порядок восстанавливает ReorderPackets. Предупреждения пишутся в logger (nil — slog.Default()).
+func ExtractPacketsChan(handle Source, filterNets []*net.IPNet, filterPorts []uint16, logger *slog.Logger) <-chan TCPPacket {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	out := make(chan TCPPacket, 1024)
+	go func() {
+		defer close(out)
+		if !supportedLinkTypes[handle.LinkType()] {
+			logger.Warn("link type is not supported, packets may fail to decode",
+				"link_type", handle.LinkType().String(), "code", int(handle.LinkType()))
+		}
+		packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+		undecoded := 0
+		var firstErr error
+		for packet := range packetSource.Packets() {
+			if pkt, ok := tcpPacket(packet, filterNets, filterPorts); ok {
+				out <- pkt
+				continue
+			}
+			// пакет, разбор которого оборвался до транспортного уровня (неизвестная
+			// инкапсуляция), иначе пропал бы незаметно
+			if errLayer := packet.ErrorLayer(); errLayer != nil && packet.TransportLayer() == nil {
+				if undecoded == 0 {
+					firstErr = errLayer.Error()
+				}
+				undecoded++
+			}
 		}
+		if undecoded > 0 {
+			logger.Warn("skipped packets that could not be decoded down to TCP", "count", undecoded, "first_err", firstErr)
+		}
+	}()
+	return out
+}
 
-		ipSrc, ipDst := getIPs(packet.NetworkLayer())
-		if !((uint16(tcp.SrcPort) == filterPort && ipSrc.Equal(filterIP)) ||
-			(uint16(tcp.DstPort) == filterPort && ipDst.Equal(filterIP))) {
-			continue
+// tcpPacket преобразует packet в TCPPacket, если это TCP-пакет с данными,
+// адресованный на один из filterPorts адреса из filterNets или отправленный с него.
+func tcpPacket(packet gopacket.Packet, filterNets []*net.IPNet, filterPorts []uint16) (TCPPacket, bool) {
+	tcp, ok := packet.TransportLayer().(*layers.TCP)
+	if !ok || tcp == nil || len(tcp.Payload) == 0 {
+		return TCPPacket{}, false
+	}
+
+	ipSrc, ipDst := getIPs(packet.NetworkLayer())
+	matches := func(ip net.IP, port uint16) bool {
+		return (len(filterPorts) == 0 || slices.Contains(filterPorts, port)) &&
+			(len(filterNets) == 0 || ContainsIP(filterNets, ip))
+	}
+	if !matches(ipSrc, uint16(tcp.SrcPort)) && !matches(ipDst, uint16(tcp.DstPort)) {
+		return TCPPacket{}, false
+	}
+
+	return TCPPacket{
+		Timestamp:  packet.Metadata().Timestamp,
+		Data:       tcp.Payload,
+		IPSource:   ipSrc.String(),
+		IPDest:     ipDst.String(),
+		PortSource: uint16(tcp.SrcPort),
+		PortDest:   uint16(tcp.DstPort),
+		Seq:        tcp.Seq,
+		Ack:        tcp.Ack,
+	}, true
+}
+
+// ResolveHost возвращает сети адресов host: подсеть в нотации CIDR (10.0.0.0/24) —
+// как есть, IP-адрес — сетью из одного адреса, имя разрешается через DNS (все найденные
+// адреса). IPv4-mapped IPv6 адреса (::ffff:a.b.c.d) приводятся к IPv4, так что их
+// строковая форма совпадает с адресами из IPv4-пакетов.
+func ResolveHost(host string) ([]*net.IPNet, error) {
+	if strings.Contains(host, "/") {
+		_, ipNet, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, fmt.Errorf("parse subnet %q: %w", host, err)
 		}
+		return []*net.IPNet{ipNet}, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []*net.IPNet{hostNet(ip)}, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve host %q: %w", host, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("resolve host %q: no addresses", host)
+	}
+	nets := make([]*net.IPNet, len(ips))
+	for i, ip := range ips {
+		nets[i] = hostNet(ip)
+	}
+	return nets, nil
+}
+
+// hostNet возвращает сеть из одного адреса ip.
+func hostNet(ip net.IP) *net.IPNet {
+	ip = normalizeIP(ip)
+	bits := len(ip) * 8
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
 
-		packets = append(packets, TCPPacket{
-			Timestamp:  packet.Metadata().Timestamp,
-			Data:       tcp.Payload,
-			IPSource:   ipSrc.String(),
-			IPDest:     ipDst.String(),
-			PortSource: uint16(tcp.SrcPort),
-			PortDest:   uint16(tcp.DstPort),
-		})
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
 	}
-	return packets
+	return ip
+}
+
+// ContainsIP сообщает, что ip входит в одну из nets.
+func ContainsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 // getIPs извлекает IP-адреса источника и назначения из переданного networkLayer.
@@ -0,0 +1,148 @@
+package pcap
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// memSource — Source из кадров в памяти с типом канала linkType.
+type memSource struct {
+	linkType layers.LinkType
+	frames   [][]byte
+}
+
+func (s *memSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(s.frames) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data := s.frames[0]
+	s.frames = s.frames[1:]
+	return data, gopacket.CaptureInfo{Timestamp: fixtureStart, CaptureLength: len(data), Length: len(data)}, nil
+}
+
+func (s *memSource) LinkType() layers.LinkType { return s.linkType }
+
+func (s *memSource) Close() {}
+
+// serialize собирает кадр из слоёв ls, дописывая к ним IPv4 и TCP с payload от
+// 10.0.0.1:40000 к 10.0.0.2:5432.
+func serialize(t *testing.T, payload string, ls ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(10, 0, 0, 2),
+	}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 5432, Seq: 1000, ACK: true, PSH: true}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	ls = append(ls, ip, tcp, gopacket.Payload(payload))
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// ethernet возвращает заголовок Ethernet с типом следующего слоя typ.
+func ethernet(typ layers.EthernetType) *layers.Ethernet {
+	return &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+		EthernetType: typ,
+	}
+}
+
+func TestExtractPacketsVLAN(t *testing.T) {
+	const query = "Q\x00\x00\x00\x0dselect 1\x00"
+	// qinq — внешняя метка с TPID tpid и внутренняя 802.1Q, иначе одна метка tpid
+	tests := []struct {
+		name string
+		tpid layers.EthernetType
+		qinq bool
+	}{
+		{"802.1Q", layers.EthernetTypeDot1Q, false},
+		{"802.1ad QinQ", layers.EthernetTypeQinQ, true},
+	}
+	for _, tpid := range legacyVLANTypes {
+		tests = append(tests, struct {
+			name string
+			tpid layers.EthernetType
+			qinq bool
+		}{fmt.Sprintf("%#04x QinQ", uint16(tpid)), tpid, true})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls := []gopacket.SerializableLayer{ethernet(tt.tpid)}
+			if tt.qinq {
+				ls = append(ls, &layers.Dot1Q{VLANIdentifier: 10, Type: layers.EthernetTypeDot1Q})
+			}
+			ls = append(ls, &layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv4})
+			src := &memSource{linkType: layers.LinkTypeEthernet, frames: [][]byte{serialize(t, query, ls...)}}
+			packets := ExtractPackets(src, nil, []uint16{5432}, quietLogger())
+			if len(packets) != 1 {
+				t.Fatalf("got %d packets, want 1", len(packets))
+			}
+			p := packets[0]
+			if string(p.Data) != query || p.IPSource != "10.0.0.1" || p.IPDest != "10.0.0.2" || p.PortDest != 5432 {
+				t.Errorf("packet %+v, want the query from 10.0.0.1 to 10.0.0.2:5432", p)
+			}
+		})
+	}
+}
+
+func TestResolveHostContainsIP(t *testing.T) {
+	tests := []struct {
+		host string
+		ip   string
+		want bool
+	}{
+		{"10.0.0.0/24", "10.0.0.7", true},
+		{"10.0.0.0/24", "10.0.1.7", false},
+		{"10.0.0.0/24", "::ffff:10.0.0.7", true},
+		{"10.0.0.2", "10.0.0.2", true},
+		{"10.0.0.2", "10.0.0.3", false},
+		{"10.0.0.2", "::ffff:10.0.0.2", true},
+		{"::ffff:10.0.0.2", "10.0.0.2", true},
+		{"::ffff:10.0.0.2", "10.0.0.3", false},
+		{"2001:db8::1", "2001:db8::1", true},
+		{"2001:db8::/32", "2001:db8:1::5", true},
+		{"2001:db8::/32", "10.0.0.2", false},
+	}
+	for _, tt := range tests {
+		nets, err := ResolveHost(tt.host)
+		if err != nil {
+			t.Errorf("ResolveHost(%q): %v", tt.host, err)
+			continue
+		}
+		if got := ContainsIP(nets, net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("ContainsIP(ResolveHost(%q), %s) = %v, want %v", tt.host, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestResolveHostMappedAddressIsIPv4(t *testing.T) {
+	// строковая форма адреса должна совпадать с адресами из IPv4-пакетов
+	nets, err := ResolveHost("::ffff:10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 1 || nets[0].String() != "10.0.0.2/32" {
+		t.Errorf("ResolveHost(::ffff:10.0.0.2) = %v, want [10.0.0.2/32]", nets)
+	}
+}
+
+func TestResolveHostInvalidSubnet(t *testing.T) {
+	if _, err := ResolveHost("10.0.0.0/33"); err == nil {
+		t.Error("ResolveHost accepted an invalid subnet")
+	}
+}
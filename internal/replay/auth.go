@@ -0,0 +1,256 @@
+package replay
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"trafRep/internal/stream"
+)
+
+// Коды запросов аутентификации ('R') сервера.
+const (
+	authOK                = 0
+	authCleartextPassword = 3
+	authMD5Password       = 5
+	authSASL              = 10
+	authSASLContinue      = 11
+	authSASLFinal         = 12
+)
+
+const scramSHA256 = "SCRAM-SHA-256"
+
+// performStartup выполняет на conn собственный startup с учётными данными cfg.User,
+// cfg.Database и cfg.Password (вместо захваченных StartupMessage и PasswordMessage):
+// отправляет StartupMessage, проходит аутентификацию cleartext, MD5 или SCRAM-SHA-256
+// и ждёт ReadyForQuery. Отказ сервера возвращается как *StartupError.
+// С cfg.PreserveStartupParams в StartupMessage переносятся параметры сессии из captured
+// (захваченного StartupMessage, если он есть), кроме user и database; cfg.StartupParams
+// применяются поверх.
+func performStartup(conn net.Conn, cfg Config, captured *stream.StartupMessage, timeout time.Duration) error {
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	defer func() { _ = conn.SetDeadline(time.Time{}) }()
+
+	sm := stream.StartupMessage{ProtocolVersion: stream.ProtocolVersion3}
+	sm.Set("user", cfg.User)
+	if cfg.Database != "" {
+		sm.Set("database", cfg.Database)
+	}
+	if captured != nil && cfg.PreserveStartupParams {
+		for _, p := range captured.Parameters {
+			if p.Name != "user" && p.Name != "database" {
+				sm.Set(p.Name, p.Value)
+			}
+		}
+	}
+	names := make([]string, 0, len(cfg.StartupParams))
+	for name := range cfg.StartupParams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sm.Set(name, cfg.StartupParams[name])
+	}
+	if _, err := conn.Write(sm.Row()); err != nil {
+		return fmt.Errorf("write startup: %w", err)
+	}
+
+	var scram *scramClient
+	for {
+		typ, body, err := readServerMessage(conn)
+		if err != nil {
+			return fmt.Errorf("startup: %w", err)
+		}
+		switch typ {
+		case 'E':
+			return parseErrorResponse(body)
+		case 'Z':
+			return nil
+		case 'R':
+			if len(body) < 4 {
+				return fmt.Errorf("startup: short authentication request")
+			}
+			code := binary.BigEndian.Uint32(body[:4])
+			data := body[4:]
+			switch code {
+			case authOK:
+			case authCleartextPassword:
+				err = writePasswordMessage(conn, []byte(cfg.Password+"\x00"))
+			case authMD5Password:
+				if len(data) < 4 {
+					return fmt.Errorf("startup: short MD5 salt")
+				}
+				err = writePasswordMessage(conn, []byte(md5Password(cfg.User, cfg.Password, data[:4])+"\x00"))
+			case authSASL:
+				if !bytes.Contains(data, []byte(scramSHA256+"\x00")) {
+					return fmt.Errorf("startup: server offers no supported SASL mechanism")
+				}
+				scram, err = newScramClient(cfg.Password)
+				if err != nil {
+					return err
+				}
+				first := scram.clientFirst()
+				payload := append([]byte(scramSHA256+"\x00"), 0, 0, 0, 0)
+				binary.BigEndian.PutUint32(payload[len(payload)-4:], uint32(len(first)))
+				err = writePasswordMessage(conn, append(payload, first...))
+			case authSASLContinue:
+				if scram == nil {
+					return fmt.Errorf("startup: unexpected SASLContinue")
+				}
+				var final []byte
+				final, err = scram.clientFinal(data)
+				if err == nil {
+					err = writePasswordMessage(conn, final)
+				}
+			case authSASLFinal:
+				if scram == nil {
+					return fmt.Errorf("startup: unexpected SASLFinal")
+				}
+				err = scram.verifyServer(data)
+			default:
+				return fmt.Errorf("startup: unsupported authentication method %d", code)
+			}
+			if err != nil {
+				return fmt.Errorf("startup: %w", err)
+			}
+		}
+	}
+}
+
+// readServerMessage читает из conn одно типизированное серверное сообщение целиком.
+func readServerMessage(conn net.Conn) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:5])
+	if size < 4 {
+		return 0, nil, fmt.Errorf("invalid server length %d", size)
+	}
+	body := make([]byte, size-4)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+// writePasswordMessage отправляет PasswordMessage ('p'); тем же типом передаются
+// SASLInitialResponse и SASLResponse.
+func writePasswordMessage(conn net.Conn, payload []byte) error {
+	buf := make([]byte, 5, 5+len(payload))
+	buf[0] = 'p'
+	binary.BigEndian.PutUint32(buf[1:5], uint32(4+len(payload)))
+	_, err := conn.Write(append(buf, payload...))
+	return err
+}
+
+// md5Password возвращает ответ на AuthenticationMD5Password:
+// "md5" + md5(md5(password + user) + salt).
+func md5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// scramClient ведёт клиентскую сторону обмена SCRAM-SHA-256 (RFC 5802, RFC 7677)
+// без channel binding. Имя пользователя в SCRAM PostgreSQL игнорирует и берёт из startup.
+type scramClient struct {
+	password        string
+	nonce           string
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+func newScramClient(password string) (*scramClient, error) {
+	raw := make([]byte, 18)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("scram nonce: %w", err)
+	}
+	nonce := base64.RawStdEncoding.EncodeToString(raw)
+	return &scramClient{password: password, nonce: nonce, clientFirstBare: "n=,r=" + nonce}, nil
+}
+
+func (c *scramClient) clientFirst() []byte {
+	return []byte("n,," + c.clientFirstBare)
+}
+
+// clientFinal строит client-final-message по server-first-message.
+func (c *scramClient) clientFinal(serverFirst []byte) ([]byte, error) {
+	attrs := scramAttributes(string(serverFirst))
+	nonce, salt64, iterStr := attrs["r"], attrs["s"], attrs["i"]
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return nil, errors.New("scram: server nonce does not extend client nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return nil, fmt.Errorf("scram: invalid salt: %w", err)
+	}
+	iterations, err := strconv.Atoi(iterStr)
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("scram: invalid iteration count %q", iterStr)
+	}
+
+	c.saltedPassword, err = pbkdf2.Key(sha256.New, c.password, salt, iterations, sha256.Size)
+	if err != nil {
+		return nil, fmt.Errorf("scram: %w", err)
+	}
+	withoutProof := "c=biws,r=" + nonce
+	c.authMessage = c.clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+
+	clientKey := hmacSHA256(c.saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	signature := hmacSHA256(storedKey[:], c.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verifyServer проверяет подпись сервера из server-final-message.
+func (c *scramClient) verifyServer(serverFinal []byte) error {
+	attrs := scramAttributes(string(serverFinal))
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("scram: server error %s", e)
+	}
+	got, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil {
+		return fmt.Errorf("scram: invalid server signature: %w", err)
+	}
+	serverKey := hmacSHA256(c.saltedPassword, "Server Key")
+	if !hmac.Equal(got, hmacSHA256(serverKey, c.authMessage)) {
+		return errors.New("scram: server signature mismatch")
+	}
+	return nil
+}
+
+func scramAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, part := range strings.Split(msg, ",") {
+		if k, v, ok := strings.Cut(part, "="); ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
@@ -0,0 +1,79 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"trafRep/internal/stream"
+)
+
+// startupParams выполняет performStartup против сервера, который сразу принимает
+// соединение, и возвращает параметры отправленного StartupMessage.
+func startupParams(t *testing.T, cfg Config, captured *stream.StartupMessage) map[string]string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		defer server.Close()
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(server, header); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header)-4)
+		if _, err := io.ReadFull(server, body); err != nil {
+			return
+		}
+		received <- body
+		_, _ = server.Write(append(serverFrame('R', "\x00\x00\x00\x00"), serverFrame('Z', "I")...))
+	}()
+	if err := performStartup(client, cfg, captured, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// тело: версия протокола, затем пары имя\0значение\0 и завершающий \0
+	fields := bytes.Split(bytes.TrimSuffix((<-received)[4:], []byte{0, 0}), []byte{0})
+	params := make(map[string]string)
+	for i := 0; i+1 < len(fields); i += 2 {
+		params[string(fields[i])] = string(fields[i+1])
+	}
+	return params
+}
+
+func TestPerformStartupPreservesCapturedParams(t *testing.T) {
+	captured := &stream.StartupMessage{ProtocolVersion: stream.ProtocolVersion3}
+	captured.Set("user", "app")
+	captured.Set("database", "prod")
+	captured.Set("client_encoding", "UTF8")
+	captured.Set("TimeZone", "Europe/Moscow")
+	captured.Set("application_name", "web")
+
+	cfg := Config{User: "replayer", Database: "shadow", PreserveStartupParams: true,
+		StartupParams: map[string]string{"application_name": "trafrep"}}
+	got := startupParams(t, cfg, captured)
+	want := map[string]string{
+		"user":             "replayer",
+		"database":         "shadow",
+		"client_encoding":  "UTF8",
+		"TimeZone":         "Europe/Moscow",
+		"application_name": "trafrep",
+	}
+	if len(got) != len(want) {
+		t.Errorf("startup params %v, want %v", got, want)
+	}
+	for name, v := range want {
+		if got[name] != v {
+			t.Errorf("startup param %s = %q, want %q", name, got[name], v)
+		}
+	}
+
+	cfg.PreserveStartupParams = false
+	got = startupParams(t, cfg, captured)
+	if _, ok := got["client_encoding"]; ok || got["user"] != "replayer" || got["application_name"] != "trafrep" {
+		t.Errorf("without PreserveStartupParams got %v", got)
+	}
+}
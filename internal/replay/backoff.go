@@ -0,0 +1,32 @@
+package replay
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	defaultReconnectBackoffBase = 100 * time.Millisecond
+	defaultReconnectBackoffMax  = 5 * time.Second
+)
+
+// backoffDelay возвращает паузу перед попыткой переподключения attempt (с нуля):
+// base·2^attempt, но не больше maxDelay, со случайным разбросом в верхней половине
+// интервала, чтобы переподключения не приходили к восстанавливающейся цели синхронно.
+func backoffDelay(attempt int, base, maxDelay time.Duration) time.Duration {
+	if base <= 0 {
+		base = defaultReconnectBackoffBase
+	}
+	if maxDelay <= 0 {
+		maxDelay = defaultReconnectBackoffMax
+	}
+
+	d := base
+	for i := 0; i < attempt && d < maxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, maxDelay)
+
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
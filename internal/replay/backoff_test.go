@@ -0,0 +1,109 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"trafRep/internal/stream"
+	msgtypes "trafRep/internal/stream/message_types"
+)
+
+func TestBackoffDelayGrows(t *testing.T) {
+	base, maxDelay := 100*time.Millisecond, time.Second
+	for attempt, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		for range 100 {
+			d := backoffDelay(attempt, base, maxDelay)
+			if d < want/2 || d > want {
+				t.Fatalf("attempt %d: delay %v outside [%v, %v]", attempt, d, want/2, want)
+			}
+		}
+	}
+}
+
+func TestBackoffDelayDefaults(t *testing.T) {
+	if d := backoffDelay(0, 0, 0); d < defaultReconnectBackoffBase/2 || d > defaultReconnectBackoffBase {
+		t.Errorf("default first delay %v", d)
+	}
+	if d := backoffDelay(30, 0, 0); d < defaultReconnectBackoffMax/2 || d > defaultReconnectBackoffMax {
+		t.Errorf("default capped delay %v", d)
+	}
+}
+
+// flakyConns выдаёт соединения, запись в которые завершается ошибкой, пока не исчерпан
+// запас failures, и запоминает время каждой попытки записи.
+type flakyConns struct {
+	mu       sync.Mutex
+	failures int
+	writes   []time.Time
+}
+
+func (f *flakyConns) dial(string, int, Config, *stream.StartupMessage) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() { _, _ = io.Copy(io.Discard, server) }()
+	return &flakyConn{Conn: client, owner: f}, nil
+}
+
+type flakyConn struct {
+	net.Conn
+	owner *flakyConns
+}
+
+func (c *flakyConn) Write(b []byte) (int, error) {
+	f := c.owner
+	f.mu.Lock()
+	f.writes = append(f.writes, time.Now())
+	fail := f.failures > 0
+	if fail {
+		f.failures--
+	}
+	f.mu.Unlock()
+	if fail {
+		return 0, errors.New("connection reset by peer")
+	}
+	return c.Conn.Write(b)
+}
+
+func TestReplayRetriesWithGrowingBackoff(t *testing.T) {
+	const base = 20 * time.Millisecond
+	conns := &flakyConns{failures: 3}
+	config := Config{
+		Rate:                 1,
+		MaxRetries:           4,
+		ReconnectBackoffBase: base,
+		ReconnectBackoffMax:  time.Second,
+		Quiet:                true,
+		Logger:               quietLogger(),
+	}
+	totals := &replayTotals{}
+	r := &sessionReplayer{
+		ctx:         context.Background(),
+		config:      config,
+		totals:      totals,
+		firstTime:   testStart,
+		replayStart: time.Now(),
+		dial:        conns.dial,
+	}
+	messages := []stream.PostgreSQLMessage{clientMessage(msgtypes.MessageTypeQuery, "select 1\x00", "a", testStart)}
+	if err := r.run(messages); err != nil {
+		t.Fatal(err)
+	}
+	if totals.success != 1 || totals.errors != 0 {
+		t.Fatalf("success %d, errors %d; want the message delivered on the last attempt", totals.success, totals.errors)
+	}
+	if len(conns.writes) != 4 {
+		t.Fatalf("%d write attempts, want 4", len(conns.writes))
+	}
+	// пауза перед попыткой i не меньше нижней границы разброса base·2^i/2
+	for i := 1; i < len(conns.writes); i++ {
+		gap := conns.writes[i].Sub(conns.writes[i-1])
+		if lower := (base << (i - 1)) / 2; gap < lower {
+			t.Errorf("pause before attempt %d is %v, want at least %v", i+1, gap, lower)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package replay
+
+import "trafRep/internal/stream"
+
+// contiguousCopyBlocks переставляет сообщения так, чтобы CopyData/CopyDone/CopyFail каждой
+// операции COPY шли сразу за её запросом. На общем соединении сообщения других сессий,
+// попавшие по времени внутрь COPY, сервер принял бы за часть потока данных.
+// Поток COPY, чей запрос отсутствует в messages, остаётся на месте.
+func contiguousCopyBlocks(messages []stream.PostgreSQLMessage) []stream.PostgreSQLMessage {
+	type copyKey struct {
+		stream string
+		group  int
+	}
+	starts := make(map[copyKey]bool)
+	for _, m := range messages {
+		if m.CopyGroup != 0 && !m.Type.IsCopyStream() {
+			starts[copyKey{m.StreamID, m.CopyGroup}] = true
+		}
+	}
+	if len(starts) == 0 {
+		return messages
+	}
+
+	blocks := make(map[copyKey][]stream.PostgreSQLMessage)
+	for _, m := range messages {
+		k := copyKey{m.StreamID, m.CopyGroup}
+		if m.Type.IsCopyStream() && starts[k] {
+			blocks[k] = append(blocks[k], m)
+		}
+	}
+
+	out := make([]stream.PostgreSQLMessage, 0, len(messages))
+	for _, m := range messages {
+		k := copyKey{m.StreamID, m.CopyGroup}
+		if m.Type.IsCopyStream() && starts[k] {
+			continue
+		}
+		out = append(out, m)
+		if m.CopyGroup != 0 {
+			out = append(out, blocks[k]...)
+		}
+	}
+	return out
+}
@@ -0,0 +1,131 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"trafRep/internal/stream"
+)
+
+// Expectation задаёт ожидаемый ответ цели на запросы одной формы.
+// Query может быть как исходным текстом запроса, так и готовым отпечатком:
+// при загрузке он нормализуется через stream.Fingerprint.
+// Пустой Tag, nil Rows и пустой Columns означают «не проверять». Columns — ожидаемые имена
+// столбцов результата (из RowDescription) по порядку.
+type Expectation struct {
+	Query   string   `yaml:"query"`
+	Tag     string   `yaml:"tag,omitempty"`
+	Rows    *int64   `yaml:"rows,omitempty"`
+	Columns []string `yaml:"columns,omitempty"`
+}
+
+// ExpectationResult — итог проверки одного ожидания по всем совпавшим сообщениям.
+type ExpectationResult struct {
+	Expectation Expectation
+	Checked     int
+	Failed      int
+	LastFailure string
+}
+
+// Passed сообщает, что ожидание было проверено хотя бы раз и ни разу не нарушено.
+func (r ExpectationResult) Passed() bool {
+	return r.Checked > 0 && r.Failed == 0
+}
+
+// LoadExpectations читает YAML-файл со списком ожиданий.
+func LoadExpectations(path string) ([]Expectation, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read expectations: %w", err)
+	}
+	var exps []Expectation
+	if err := yaml.Unmarshal(data, &exps); err != nil {
+		return nil, fmt.Errorf("parse expectations %s: %w", path, err)
+	}
+	for i := range exps {
+		if strings.TrimSpace(exps[i].Query) == "" {
+			return nil, fmt.Errorf("expectation %d: empty query", i+1)
+		}
+		exps[i].Query = stream.Fingerprint(exps[i].Query)
+	}
+	return exps, nil
+}
+
+// expectationChecker сопоставляет ответы цели с ожиданиями по отпечатку запроса.
+type expectationChecker struct {
+	results []ExpectationResult
+	index   map[string]int
+}
+
+func newExpectationChecker(exps []Expectation) *expectationChecker {
+	c := &expectationChecker{
+		results: make([]ExpectationResult, len(exps)),
+		index:   make(map[string]int, len(exps)),
+	}
+	for i, e := range exps {
+		c.results[i].Expectation = e
+		c.index[e.Query] = i
+	}
+	return c
+}
+
+// check проверяет ответ resp на простой запрос m, если для его отпечатка задано ожидание.
+func (c *expectationChecker) check(m stream.PostgreSQLMessage, resp serverResponse) {
+	if !m.Type.IsSimpleQuery() {
+		return
+	}
+	i, ok := c.index[stream.Fingerprint(m.PrettyQuery())]
+	if !ok {
+		return
+	}
+	r := &c.results[i]
+	r.Checked++
+
+	tag := resp.LastCommandTag()
+	var failure string
+	switch {
+	case len(resp.Errors) > 0:
+		failure = "error: " + resp.Errors[0].Error()
+	case r.Expectation.Tag != "" && tag != r.Expectation.Tag:
+		failure = fmt.Sprintf("tag %q, expected %q", tag, r.Expectation.Tag)
+	case len(r.Expectation.Columns) > 0 && !slices.Equal(resp.Columns, r.Expectation.Columns):
+		failure = fmt.Sprintf("columns [%s], expected [%s]",
+			strings.Join(resp.Columns, ", "), strings.Join(r.Expectation.Columns, ", "))
+	case r.Expectation.Rows != nil:
+		rows, ok := stream.CommandTagRows(tag)
+		if !ok || rows != *r.Expectation.Rows {
+			failure = fmt.Sprintf("rows in tag %q, expected %d", tag, *r.Expectation.Rows)
+		}
+	}
+	if failure != "" {
+		r.Failed++
+		r.LastFailure = failure
+	}
+}
+
+// report печатает итог по каждому ожиданию и возвращает число непрошедших.
+func (c *expectationChecker) report(w io.Writer) int {
+	failed := 0
+	for _, r := range c.results {
+		status := "PASS"
+		detail := fmt.Sprintf("%d checked", r.Checked)
+		switch {
+		case r.Checked == 0:
+			status = "FAIL"
+			detail = "no matching queries replayed"
+		case r.Failed > 0:
+			status = "FAIL"
+			detail = fmt.Sprintf("%d/%d failed, last: %s", r.Failed, r.Checked, r.LastFailure)
+		}
+		if !r.Passed() {
+			failed++
+		}
+		fmt.Fprintf(w, "EXPECT %s | %s | %s\n", status, r.Expectation.Query, detail)
+	}
+	return failed
+}
@@ -0,0 +1,38 @@
+package replay
+
+import (
+	"fmt"
+
+	"trafRep/internal/stream"
+)
+
+// checkProduction отказывает в воспроизведении, если цель похожа на production:
+// адрес цели (или цели записи) или имя базы из захваченного StartupMessage совпадает с config.ProductionPattern.
+// Проверка отключена, если шаблон не задан или выставлен config.ConfirmProduction.
+func checkProduction(messages []stream.PostgreSQLMessage, config Config) error {
+	if config.ProductionPattern == nil || config.ConfirmProduction {
+		return nil
+	}
+
+	for _, host := range []string{config.TargetHost, config.WriteTargetHost} {
+		if host != "" && config.ProductionPattern.MatchString(host) {
+			return fmt.Errorf("target host %q matches production pattern %q; pass --confirm-production to replay anyway",
+				host, config.ProductionPattern)
+		}
+	}
+	if config.Database != "" && config.ProductionPattern.MatchString(config.Database) {
+		return fmt.Errorf("target database %q matches production pattern %q; pass --confirm-production to replay anyway",
+			config.Database, config.ProductionPattern)
+	}
+	for _, m := range messages {
+		sm, ok := m.StartupMessage()
+		if !ok {
+			continue
+		}
+		if db, ok := sm.Get("database"); ok && config.ProductionPattern.MatchString(db) {
+			return fmt.Errorf("startup database %q matches production pattern %q; pass --confirm-production to replay anyway",
+				db, config.ProductionPattern)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+const histogramBarWidth = 40
+
+// writeLatencySummary печатает min/p50/p95/p99/max задержек до ReadyForQuery.
+func writeLatencySummary(w io.Writer, latencies []time.Duration) {
+	if len(latencies) == 0 {
+		fmt.Fprintln(w, "Latency: no samples")
+		return
+	}
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+	fmt.Fprintf(w, "Latency (%d samples): min %v, p50 %v, p95 %v, p99 %v, max %v\n",
+		len(sorted), sorted[0], percentile(sorted, 0.50), percentile(sorted, 0.95),
+		percentile(sorted, 0.99), sorted[len(sorted)-1])
+}
+
+// writeLatencyHistogram печатает ASCII-гистограмму задержек с экспоненциальными корзинами:
+// первая граница — 100µs, каждая следующая вдвое больше. Длина полосы пропорциональна
+// числу замеров в корзине относительно самой заполненной.
+func writeLatencyHistogram(w io.Writer, latencies []time.Duration) {
+	if len(latencies) == 0 {
+		fmt.Fprintln(w, "Latency histogram: no samples")
+		return
+	}
+
+	var maxLatency time.Duration
+	for _, l := range latencies {
+		maxLatency = max(maxLatency, l)
+	}
+
+	var bounds []time.Duration
+	for b := 100 * time.Microsecond; ; b *= 2 {
+		bounds = append(bounds, b)
+		if b >= maxLatency {
+			break
+		}
+	}
+
+	counts := make([]int, len(bounds))
+	for _, l := range latencies {
+		for i, b := range bounds {
+			if l <= b {
+				counts[i]++
+				break
+			}
+		}
+	}
+
+	peak := 0
+	for _, c := range counts {
+		peak = max(peak, c)
+	}
+
+	fmt.Fprintf(w, "Latency histogram (%d samples):\n", len(latencies))
+	lower := time.Duration(0)
+	for i, b := range bounds {
+		bar := counts[i] * histogramBarWidth / peak
+		if counts[i] > 0 && bar == 0 {
+			bar = 1
+		}
+		fmt.Fprintf(w, "  %10v - %-10v | %-*s %d\n", lower, b, histogramBarWidth, strings.Repeat("█", bar), counts[i])
+		lower = b
+	}
+}
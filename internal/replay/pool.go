@@ -0,0 +1,505 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"trafRep/internal/stream"
+	msgtypes "trafRep/internal/stream/message_types"
+)
+
+// connPool — пул заранее подключённых и аутентифицированных соединений к цели.
+// Пустой слот (nil) означает соединение, которое не удалось восстановить:
+// при выдаче такого слота пул пытается подключиться заново.
+type connPool struct {
+	ctx     context.Context
+	config  Config
+	warmup  [][]byte
+	startup *stream.StartupMessage
+	conns   chan net.Conn
+
+	mu      sync.Mutex
+	waited  time.Duration
+	maxWait time.Duration
+	// traces — трассы открытых соединений пула при заданном config.Tracer
+	traces map[net.Conn]ConnectionTrace
+}
+
+// newConnPool открывает size соединений и прогревает каждое последовательностью warmup
+// (захваченные StartupMessage и PasswordMessage), дожидаясь ReadyForQuery. Если задан
+// config.User, вместо warmup выполняется собственный startup (см. performStartup)
+// с параметрами сессии из startup.
+func newConnPool(ctx context.Context, size int, warmup [][]byte, startup *stream.StartupMessage, config Config) (*connPool, error) {
+	p := &connPool{
+		ctx:     ctx,
+		config:  config,
+		warmup:  warmup,
+		startup: startup,
+		conns:   make(chan net.Conn, size),
+		traces:  make(map[net.Conn]ConnectionTrace),
+	}
+	for i := 0; i < size; i++ {
+		c, err := p.dial()
+		if err != nil {
+			p.close()
+			return nil, fmt.Errorf("warm pool connection %d/%d: %w", i+1, size, err)
+		}
+		p.conns <- c
+	}
+	return p, nil
+}
+
+// dial открывает и прогревает новое соединение пула и начинает его трассу.
+func (p *connPool) dial() (net.Conn, error) {
+	c, err := p.connect()
+	if err == nil && p.config.Tracer != nil {
+		p.mu.Lock()
+		p.traces[c] = p.config.Tracer.StartConnection(c.RemoteAddr().String())
+		p.mu.Unlock()
+	}
+	return c, err
+}
+
+// trace возвращает трассу соединения c пула или nil без config.Tracer.
+func (p *connPool) trace(c net.Conn) ConnectionTrace {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.traces[c]
+}
+
+// closeConn закрывает соединение пула и завершает его трассу.
+func (p *connPool) closeConn(c net.Conn) {
+	p.mu.Lock()
+	trace := p.traces[c]
+	delete(p.traces, c)
+	p.mu.Unlock()
+	_ = closeConn(c, trace)
+}
+
+func (p *connPool) connect() (net.Conn, error) {
+	if p.config.User != "" {
+		return dialTarget(p.config.TargetHost, p.config.TargetPort, p.config, p.startup)
+	}
+	c, err := connectTCP(p.config.TargetHost, p.config.TargetPort, p.config.TLS, p.config.readTimeout())
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range p.warmup {
+		if _, err := c.Write(row); err != nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("write startup: %w", err)
+		}
+		if _, err := waitForReady(p.ctx, c, p.config.readTimeout(), true, p.config.logger()); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// checkout выдаёт соединение из пула, блокируясь, пока свободных нет; отмена ctx прерывает
+// ожидание. Время ожидания учитывается в статистике пула.
+func (p *connPool) checkout(ctx context.Context) (net.Conn, error) {
+	start := time.Now()
+	var c net.Conn
+	select {
+	case c = <-p.conns:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	wait := time.Since(start)
+
+	p.mu.Lock()
+	p.waited += wait
+	p.maxWait = max(p.maxWait, wait)
+	p.mu.Unlock()
+
+	if c != nil {
+		return c, nil
+	}
+	c, err := p.dial()
+	if err != nil {
+		p.conns <- nil
+		return nil, fmt.Errorf("reconnect pool slot: %w", err)
+	}
+	return c, nil
+}
+
+// release возвращает соединение в пул. Сломанное соединение закрывается,
+// а его слот освобождается для повторного подключения.
+func (p *connPool) release(c net.Conn, broken bool) {
+	if broken {
+		p.closeConn(c)
+		p.conns <- nil
+		return
+	}
+	p.conns <- c
+}
+
+func (p *connPool) close() {
+	for {
+		select {
+		case c := <-p.conns:
+			if c != nil {
+				p.closeConn(c)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// poolUnits разбивает сообщения одного потока на единицы выдачи соединения:
+// простой запрос или последовательность сообщений расширенного протокола до Sync включительно.
+// Поток COPY (CopyData..CopyDone) присоединяется к запросу COPY, чтобы идти по тому же соединению.
+// Startup, PasswordMessage и Terminate пропускаются: ими управляет пул.
+func poolUnits(messages []stream.PostgreSQLMessage) [][]stream.PostgreSQLMessage {
+	var units [][]stream.PostgreSQLMessage
+	var cur []stream.PostgreSQLMessage
+	for _, m := range messages {
+		if poolSkipped(m) {
+			continue
+		}
+		if m.Type.IsCopyStream() && len(cur) == 0 && len(units) > 0 {
+			units[len(units)-1] = append(units[len(units)-1], m)
+			continue
+		}
+		cur = append(cur, m)
+		if !m.Type.AwaitsSync() {
+			units = append(units, cur)
+			cur = nil
+		}
+	}
+	if len(cur) > 0 {
+		units = append(units, cur)
+	}
+	return units
+}
+
+// poolSkipped сообщает, что poolUnits не включает m в единицы выдачи.
+func poolSkipped(m stream.PostgreSQLMessage) bool {
+	return !m.Type.HaveTypeByte() || m.Type == msgtypes.MessageTypePasswordMessage || m.Type == msgtypes.MessageTypeTerminate
+}
+
+// unitIsWrite сообщает, что единицу нужно выполнить на цели записи (см. stream.IsWriteQuery):
+// простой запрос классифицируется по тексту, пакет расширенного протокола — по текстам Parse.
+// Пакет без Parse (выполнение ранее подготовленного оператора) считается записью.
+func unitIsWrite(unit []stream.PostgreSQLMessage) bool {
+	classified := false
+	for _, m := range unit {
+		query, ok := "", false
+		if m.Type.IsSimpleQuery() {
+			query, ok = m.PrettyQuery(), true
+		} else if p, isParse := m.Parse(); isParse {
+			query, ok = p.Query, true
+		}
+		if !ok {
+			continue
+		}
+		if stream.IsWriteQuery(query) {
+			return true
+		}
+		classified = true
+	}
+	return !classified
+}
+
+// poolWarmup возвращает захваченную последовательность аутентификации первой сессии:
+// её StartupMessage и следующие за ним PasswordMessage.
+func poolWarmup(messages []stream.PostgreSQLMessage, config Config) [][]byte {
+	var rows [][]byte
+	var session string
+	for _, m := range messages {
+		if _, ok := m.StartupMessage(); ok && session == "" {
+			session = m.StreamID
+			rows = append(rows, config.rowFor(m))
+			continue
+		}
+		if session != "" && m.StreamID == session && m.Type == msgtypes.MessageTypePasswordMessage {
+			rows = append(rows, m.Row())
+		}
+	}
+	return rows
+}
+
+// replayPooled воспроизводит сообщения через пул из config.PoolSize соединений:
+// каждая исходная сессия выполняется в своей горутине и на каждую единицу (запрос или
+// пакет расширенного протокола до Sync) берёт соединение из пула. Пока сервер сообщает
+// об открытой транзакции, соединение остаётся закреплённым за сессией; транзакция,
+// открытая к концу сессии, завершается по FinalizeTransactions (по умолчанию — ROLLBACK).
+// Ожидания (Config.Expectations) проверяются по ответам на единицы; с RewriteStatementNames
+// имена операторов переименовываются до раздачи сессий, так как пул делят все сессии.
+// Config.Tracer получает трассу каждого соединения пула с сообщениями всех единиц,
+// выполненных на нём. Итоги учитываются и печатаются так же, как при воспроизведении
+// на одном соединении (см. replayTotals), MaxDuration прерывает и ожидание соединения.
+func replayPooled(ctx context.Context, messages []stream.PostgreSQLMessage, config Config) (*ReplayReport, error) {
+	logger := config.logger()
+	if config.RewriteStatementNames {
+		rewriter := newStatementRewriter()
+		rewritten := make([]stream.PostgreSQLMessage, len(messages))
+		for i, m := range messages {
+			rewritten[i] = rewriter.rewrite(m)
+		}
+		messages = rewritten
+	}
+	warmup := poolWarmup(messages, config)
+	startup := capturedStartup(messages)
+	pool, err := newConnPool(ctx, config.PoolSize, warmup, startup, config)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.close()
+
+	// при перенаправлении записи второй пул подключается к primary; транзакции целиком
+	// уходят туда же, так как BEGIN классифицируется как запись
+	var writePool *connPool
+	if config.WriteTargetHost != "" {
+		writeConfig := config
+		writeConfig.TargetHost, writeConfig.TargetPort = config.WriteTargetHost, config.WriteTargetPort
+		writePool, err = newConnPool(ctx, config.PoolSize, warmup, startup, writeConfig)
+		if err != nil {
+			return nil, fmt.Errorf("write target: %w", err)
+		}
+		defer writePool.close()
+	}
+
+	sessions := make(map[string][]stream.PostgreSQLMessage)
+	var order []string
+	for _, m := range messages {
+		if _, ok := sessions[m.StreamID]; !ok {
+			order = append(order, m.StreamID)
+		}
+		sessions[m.StreamID] = append(sessions[m.StreamID], m)
+	}
+
+	total := 0
+	for _, m := range messages {
+		if !poolSkipped(m) {
+			total++
+		}
+	}
+	totals := newReplayTotals(config, total)
+	firstTime := messages[0].FirstTCPPacketTimestamp
+	replayStart := time.Now()
+
+	// runCtx отменяется и по истечении MaxDuration: ожидание расписания и свободного
+	// соединения прерываются, а уже отправленные единицы дочитываются по ctx
+	runCtx := ctx
+	if config.MaxDuration > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, config.MaxDuration)
+		defer cancel()
+	}
+	skip := func(rest [][]stream.PostgreSQLMessage) {
+		totals.mu.Lock()
+		for _, unit := range rest {
+			totals.skipped += len(unit)
+		}
+		totals.mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for _, id := range order {
+		units := poolUnits(sessions[id])
+		// indexes — номера (с 1) сообщений единиц внутри исходной сессии, по порядку
+		var indexes []int
+		for i, m := range sessions[id] {
+			if !poolSkipped(m) {
+				indexes = append(indexes, i+1)
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var pinned net.Conn
+			var pinnedPool *connPool
+			next := 0
+			for u, unit := range units {
+				if !sleepCtx(runCtx, time.Until(paceTime(replayStart, firstTime, unit[0], config.Rate))) {
+					skip(units[u:])
+					break
+				}
+				outcomes := make([]MessageOutcome, len(unit))
+				for k, m := range unit {
+					outcomes[k] = MessageOutcome{Index: indexes[next+k], Stream: m.StreamID, Type: m.Type.String(), Bytes: len(config.rowFor(m))}
+				}
+				next += len(unit)
+
+				conn, from := pinned, pinnedPool
+				if conn == nil {
+					from = pool
+					if writePool != nil && unitIsWrite(unit) {
+						from = writePool
+					}
+					c, err := from.checkout(runCtx)
+					if err != nil {
+						if runCtx.Err() != nil {
+							skip(units[u:])
+							break
+						}
+						logger.Error("checkout failed", "client", unit[0].ClientAddr(), "err", err)
+						for _, o := range outcomes {
+							o.Error = err.Error()
+							totals.failedMessage(o)
+						}
+						continue
+					}
+					conn = c
+				}
+
+				sent := time.Now()
+				resp, copied, err := sendUnit(ctx, conn, unit, config)
+				latency := time.Since(sent)
+				trace := from.trace(conn)
+
+				// ErrorResponse цели — ошибка единицы, но не соединения
+				for _, e := range resp.Errors {
+					logger.Warn("target returned error", "client", unit[0].ClientAddr(), "error", e)
+				}
+				if err != nil {
+					logger.Error("message failed", "client", unit[0].ClientAddr(), "err", err)
+					for k, o := range outcomes {
+						o.Error = err.Error()
+						totals.failedMessage(o)
+						if trace != nil {
+							trace.Message(unit[k], o.Bytes, sent, latency, err)
+						}
+					}
+				} else {
+					// как при воспроизведении на одном соединении, ответ цели относится к последнему
+					// отправленному сообщению; поток COPY, который цель не приняла, — ошибка
+					head, _ := splitCopyStream(unit)
+					last := len(head) - 1
+					if copied {
+						last = len(unit) - 1
+					}
+					answered := !unit[last].Type.AwaitsSync()
+					if config.Validate {
+						if mismatch, ok := compareResponse(unit, resp); ok {
+							totals.validated(mismatch)
+							if mismatch != "" {
+								outcomes[last].Mismatch = mismatch
+								logger.Warn("response differs from capture", "client", unit[0].ClientAddr(), "mismatch", mismatch)
+							}
+						}
+					}
+					for k, o := range outcomes {
+						var msgErr error
+						switch {
+						case k < last:
+							totals.completed(o, false, serverResponse{}, 0)
+						case k == last:
+							totals.completed(o, answered, resp, latency)
+							if len(resp.Errors) > 0 {
+								msgErr = resp.Errors[0]
+							}
+						default:
+							msgErr = errors.New("target is not in COPY IN mode")
+							o.Error = msgErr.Error()
+							totals.failedMessage(o)
+						}
+						if trace != nil {
+							trace.Message(unit[k], o.Bytes, sent, latency, msgErr)
+						}
+					}
+					if answered {
+						// простой запрос — первое сообщение единицы, в том числе запрос COPY с его потоком
+						totals.check(unit[0], resp)
+					}
+				}
+
+				if err == nil && (resp.TxStatus == 'T' || resp.TxStatus == 'E') {
+					pinned, pinnedPool = conn, from
+					continue
+				}
+				pinned, pinnedPool = nil, nil
+				from.release(conn, err != nil)
+			}
+			if pinned != nil {
+				// соединение вернётся к другим сессиям: транзакцию, оставленную открытой,
+				// без FinalizeTransactions откатываем, а не отдаём им
+				mode := config.FinalizeTransactions
+				if mode == "" {
+					mode = "rollback"
+				}
+				broken := false
+				if err := finalizeTransaction(pinned, mode, config.readTimeout(), logger); err != nil {
+					logger.Error("finalize open transaction failed", "client", units[len(units)-1][0].ClientAddr(), "err", err)
+					broken = true
+				}
+				pinnedPool.release(pinned, broken)
+			}
+		}()
+	}
+	wg.Wait()
+
+	detail := fmt.Sprintf("pool wait: %v (max %v)", pool.waited, pool.maxWait)
+	if writePool != nil {
+		detail += fmt.Sprintf(", write target %s pool wait: %v (max %v)",
+			net.JoinHostPort(config.WriteTargetHost, strconv.Itoa(config.WriteTargetPort)), writePool.waited, writePool.maxWait)
+	}
+	return totals.finish(ctx, config, len(messages), 1, time.Since(replayStart), detail)
+}
+
+// sendUnit отправляет сообщения единицы подряд и ждёт ReadyForQuery, если последнее
+// сообщение его предполагает. Поток COPY единицы (CopyData..CopyDone) отправляется только
+// после CopyInResponse цели на запрос COPY, а ответ после CopyDone дочитывается до
+// ReadyForQuery: иначе соединение вернулось бы в пул с непрочитанным ответом, и его
+// получила бы следующая единица. Если цель не перешла в режим COPY (запрос завершился
+// ошибкой), поток данных не отправляется; copied сообщает, что поток был отправлен.
+func sendUnit(ctx context.Context, conn net.Conn, unit []stream.PostgreSQLMessage, config Config) (resp serverResponse, copied bool, err error) {
+	head, copyStream := splitCopyStream(unit)
+	if len(head) == 0 {
+		return resp, false, fmt.Errorf("COPY data without COPY query")
+	}
+	for _, m := range head {
+		if _, err := conn.Write(config.rowFor(m)); err != nil {
+			return resp, false, fmt.Errorf("write failed: %w", err)
+		}
+	}
+	if len(copyStream) == 0 && head[len(head)-1].Type.AwaitsSync() {
+		return resp, false, nil
+	}
+	resp, err = waitForReady(ctx, conn, config.readTimeout(), false, config.logger())
+	if err != nil {
+		return resp, false, fmt.Errorf("waiting ReadyForQuery failed: %w", err)
+	}
+	if len(copyStream) == 0 || !resp.CopyIn {
+		return resp, false, nil
+	}
+
+	for _, m := range copyStream {
+		if _, err := conn.Write(config.rowFor(m)); err != nil {
+			return resp, true, fmt.Errorf("write COPY data failed: %w", err)
+		}
+	}
+	if copyStream[len(copyStream)-1].Type == msgtypes.MessageTypeCopyData {
+		// без CopyDone цель останется в режиме COPY, и соединение нельзя вернуть в пул
+		return resp, true, fmt.Errorf("COPY stream has no CopyDone in capture, target left in COPY mode")
+	}
+	done, err := waitForReady(ctx, conn, config.readTimeout(), false, config.logger())
+	resp.CopyIn = false
+	resp.CommandTags = append(resp.CommandTags, done.CommandTags...)
+	resp.Errors = append(resp.Errors, done.Errors...)
+	resp.TxStatus = done.TxStatus
+	if err != nil {
+		return resp, true, fmt.Errorf("waiting ReadyForQuery after COPY failed: %w", err)
+	}
+	return resp, true, nil
+}
+
+// splitCopyStream делит единицу на сообщения до потока COPY и сам поток
+// (CopyData/CopyDone/CopyFail), который poolUnits присоединяет в конец единицы.
+func splitCopyStream(unit []stream.PostgreSQLMessage) (head, copyStream []stream.PostgreSQLMessage) {
+	for i, m := range unit {
+		if m.Type.IsCopyStream() {
+			return unit[:i], unit[i:]
+		}
+	}
+	return unit, nil
+}
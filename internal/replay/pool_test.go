@@ -0,0 +1,238 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"trafRep/internal/stream"
+	msgtypes "trafRep/internal/stream/message_types"
+)
+
+// answerCopy отвечает как answerReady, но запрос COPY переводит в режим COPY IN, а на
+// CopyDone отвечает CommandComplete и ReadyForQuery.
+func answerCopy(typ byte, body []byte) []byte {
+	switch {
+	case typ == 'Q' && strings.HasPrefix(string(body), "copy"):
+		return serverFrame('G', "\x00\x00\x00")
+	case typ == 'd':
+		return nil
+	case typ == 'c':
+		return append(serverFrame('C', "COPY 2\x00"), serverFrame('Z', "I")...)
+	}
+	return answerReady(typ, body)
+}
+
+func TestReplayPooledCopyKeepsConnectionInSync(t *testing.T) {
+	ft := startFakeTarget(t, answerCopy)
+
+	ts := testStart
+	copyQuery := clientMessage(msgtypes.MessageTypeQuery, "copy t from stdin\x00", "a", ts)
+	copyQuery.CommandTag = "COPY 2"
+	copyDone := clientMessage(msgtypes.MessageTypeCopyDone, "", "a", ts)
+	copyDone.ReadyForQueryTimestamp = ts
+	selectQuery := clientMessage(msgtypes.MessageTypeQuery, "select 1\x00", "a", ts.Add(time.Millisecond))
+	selectQuery.CommandTag = "SELECT 1"
+	selectQuery.ReadyForQueryTimestamp = ts.Add(time.Millisecond)
+	messages := []stream.PostgreSQLMessage{
+		copyQuery,
+		clientMessage(msgtypes.MessageTypeCopyData, "1\n", "a", ts),
+		clientMessage(msgtypes.MessageTypeCopyData, "2\n", "a", ts),
+		copyDone,
+		selectQuery,
+	}
+
+	config := ft.config()
+	config.PoolSize = 1
+	config.Validate = true
+	report, err := ReplayMessages(context.Background(), messages, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Successful != len(messages) || report.ValidationMismatches != 0 {
+		t.Errorf("successful %d of %d, mismatches %d", report.Successful, len(messages), report.ValidationMismatches)
+	}
+	if got := ft.receivedTypes(len(messages)); got != "QddcQ" {
+		t.Errorf("target received %s, want QddcQ", got)
+	}
+}
+
+func TestReplayPooledCopyNotStartedSkipsData(t *testing.T) {
+	// цель отвечает на COPY ошибкой: данные не отправляются, соединение остаётся в пуле
+	ft := startFakeTarget(t, func(typ byte, body []byte) []byte {
+		if typ == 'Q' && strings.HasPrefix(string(body), "copy") {
+			return append(serverFrame('E', "SERROR\x00C42P01\x00Mrelation \"t\" does not exist\x00\x00"), serverFrame('Z', "I")...)
+		}
+		return answerReady(typ, body)
+	})
+
+	ts := testStart
+	messages := []stream.PostgreSQLMessage{
+		clientMessage(msgtypes.MessageTypeQuery, "copy t from stdin\x00", "a", ts),
+		clientMessage(msgtypes.MessageTypeCopyData, "1\n", "a", ts),
+		clientMessage(msgtypes.MessageTypeCopyDone, "", "a", ts),
+		clientMessage(msgtypes.MessageTypeQuery, "select 1\x00", "a", ts.Add(time.Millisecond)),
+	}
+	config := ft.config()
+	config.PoolSize = 1
+	report, _ := ReplayMessages(context.Background(), messages, config)
+	if report == nil {
+		t.Fatal("no report")
+	}
+	if report.Successful != 1 || report.Errors != 3 {
+		t.Errorf("successful %d, errors %d; want 1 and 3", report.Successful, report.Errors)
+	}
+	if got := ft.receivedTypes(2); got != "QQ" {
+		t.Errorf("target received %s, want QQ", got)
+	}
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if ft.conns != 1 {
+		t.Errorf("target accepted %d connections, want 1", ft.conns)
+	}
+}
+
+func TestReplayPooledChecksExpectations(t *testing.T) {
+	ft := startFakeTarget(t, nil)
+	messages := []stream.PostgreSQLMessage{
+		clientMessage(msgtypes.MessageTypeQuery, "select 1\x00", "a", testStart),
+		clientMessage(msgtypes.MessageTypeQuery, "select name from t\x00", "b", testStart),
+	}
+	config := ft.config()
+	config.PoolSize = 2
+	// одно ожидание совпадает с ответом цели, другое нет: без проверки в режиме пула
+	// не прошли бы оба (ни одного проверенного запроса)
+	config.Expectations = []Expectation{
+		{Query: stream.Fingerprint("select 1"), Tag: "SELECT 1"},
+		{Query: stream.Fingerprint("select name from t"), Tag: "SELECT 2"},
+	}
+	report, err := ReplayMessages(context.Background(), messages, config)
+	if err == nil {
+		t.Fatal("expected an expectation failure")
+	}
+	if report == nil || report.ExpectationsFailed != 1 {
+		t.Errorf("report = %+v, want one failed expectation", report)
+	}
+}
+
+func TestReplayPooledRewritesStatementNames(t *testing.T) {
+	var mu sync.Mutex
+	var names []string
+	ft := startFakeTarget(t, func(typ byte, body []byte) []byte {
+		if typ == 'P' {
+			mu.Lock()
+			names = append(names, string(body[:bytes.IndexByte(body, 0)]))
+			mu.Unlock()
+		}
+		return answerReady(typ, body)
+	})
+	var messages []stream.PostgreSQLMessage
+	for _, id := range []string{"a", "b"} {
+		messages = append(messages,
+			clientMessage(msgtypes.MessageTypeParse, "s1\x00select 1\x00\x00\x00", id, testStart),
+			clientMessage(msgtypes.MessageTypeSync, "", id, testStart),
+		)
+	}
+	config := ft.config()
+	config.PoolSize = 1
+	config.RewriteStatementNames = true
+	if _, err := ReplayMessages(context.Background(), messages, config); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	slices.Sort(names)
+	if !slices.Equal(names, []string{"s1_r1", "s1_r2"}) {
+		t.Errorf("target prepared %v, want [s1_r1 s1_r2]", names)
+	}
+}
+
+// txTarget — цель с одним состоянием транзакции на все соединения: BEGIN открывает
+// транзакцию, COMMIT и ROLLBACK закрывают. queries возвращает выполненные запросы по порядку.
+type txTarget struct {
+	*fakeTarget
+	mu      sync.Mutex
+	status  string
+	queries []string
+}
+
+func startTxTarget(t *testing.T) *txTarget {
+	tt := &txTarget{status: "I"}
+	tt.fakeTarget = startFakeTarget(t, func(typ byte, body []byte) []byte {
+		if typ != 'Q' {
+			return answerReady(typ, body)
+		}
+		query := strings.TrimRight(string(body), "\x00")
+		tt.mu.Lock()
+		defer tt.mu.Unlock()
+		tt.queries = append(tt.queries, query)
+		switch query {
+		case "begin":
+			tt.status = "T"
+		case "ROLLBACK", "COMMIT":
+			tt.status = "I"
+		}
+		return append(serverFrame('C', strings.ToUpper(query)+"\x00"), serverFrame('Z', tt.status)...)
+	})
+	return tt
+}
+
+func (tt *txTarget) ran() []string {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	return slices.Clone(tt.queries)
+}
+
+func TestReplayPooledRollsBackOpenTransaction(t *testing.T) {
+	ft := startTxTarget(t)
+	// сессия a заканчивается внутри транзакции, сессия b ждёт освободившееся соединение
+	messages := []stream.PostgreSQLMessage{
+		clientMessage(msgtypes.MessageTypeQuery, "begin\x00", "a", testStart),
+		clientMessage(msgtypes.MessageTypeQuery, "select 1\x00", "a", testStart.Add(time.Millisecond)),
+		clientMessage(msgtypes.MessageTypeQuery, "select 2\x00", "b", testStart.Add(2*time.Millisecond)),
+	}
+	config := ft.config()
+	config.PoolSize = 1
+	if _, err := ReplayMessages(context.Background(), messages, config); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"begin", "select 1", "ROLLBACK", "select 2"}
+	if got := ft.ran(); !slices.Equal(got, want) {
+		t.Errorf("target ran %q, want %q", got, want)
+	}
+}
+
+func TestReplayPooledMaxDurationWhilePoolBusy(t *testing.T) {
+	ft := startTxTarget(t)
+	// сессия a держит единственное соединение в транзакции до запроса через час,
+	// сессия b ждёт соединение; MaxDuration должен прервать оба ожидания
+	messages := []stream.PostgreSQLMessage{
+		clientMessage(msgtypes.MessageTypeQuery, "begin\x00", "a", testStart),
+		clientMessage(msgtypes.MessageTypeQuery, "select 2\x00", "b", testStart.Add(time.Millisecond)),
+		clientMessage(msgtypes.MessageTypeQuery, "commit\x00", "a", testStart.Add(time.Hour)),
+	}
+	config := ft.config()
+	config.PoolSize = 1
+	config.MaxDuration = 100 * time.Millisecond
+
+	done := make(chan *ReplayReport)
+	go func() {
+		report, _ := ReplayMessages(context.Background(), messages, config)
+		done <- report
+	}()
+	select {
+	case report := <-done:
+		if report == nil || report.Successful != 1 || report.Skipped != 2 || report.Interrupted {
+			t.Errorf("report = %+v, want 1 successful and 2 skipped", report)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replay did not stop after MaxDuration")
+	}
+	if got, want := ft.ran(), []string{"begin", "ROLLBACK"}; !slices.Equal(got, want) {
+		t.Errorf("target ran %q, want %q", got, want)
+	}
+}
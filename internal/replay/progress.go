@@ -0,0 +1,192 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// progressReporter накапливает счётчики воспроизведения и раз в interval печатает
+// однострочный снимок: отправлено сообщений, QPS и p50/p99 задержек за последний
+// интервал, число ошибок. Безопасен для использования из нескольких горутин.
+type progressReporter struct {
+	w        io.Writer
+	interval time.Duration
+	start    time.Time
+
+	mu     sync.Mutex
+	sent   int
+	errors int
+	// window — задержки и число отправленных сообщений с предыдущего снимка
+	window     []time.Duration
+	windowSent int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newProgressReporter запускает периодический вывод снимков в w. Вызывающий обязан
+// вызвать close, чтобы остановить тикер.
+func newProgressReporter(w io.Writer, interval time.Duration) *progressReporter {
+	p := &progressReporter{
+		w:        w,
+		interval: interval,
+		start:    time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *progressReporter) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-ticker.C:
+			p.report(now.Sub(last))
+			last = now
+		}
+	}
+}
+
+// record учитывает n отправленных сообщений; latency > 0 добавляется в окно задержек.
+func (p *progressReporter) record(n int, latency time.Duration, failed bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if failed {
+		p.errors += n
+		return
+	}
+	p.sent += n
+	p.windowSent += n
+	if latency > 0 {
+		p.window = append(p.window, latency)
+	}
+}
+
+func (p *progressReporter) report(elapsed time.Duration) {
+	p.mu.Lock()
+	sent, errs, windowSent := p.sent, p.errors, p.windowSent
+	window := p.window
+	p.window, p.windowSent = nil, 0
+	p.mu.Unlock()
+
+	qps := float64(windowSent) / elapsed.Seconds()
+	fmt.Fprintf(p.w, "Progress %v: %d sent, %.1f qps, p50 %v, p99 %v, %d errors\n",
+		time.Since(p.start).Round(time.Second), sent, qps,
+		percentile(window, 0.50), percentile(window, 0.99), errs)
+}
+
+func (p *progressReporter) close() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+}
+
+// percentile возвращает q-й перцентиль задержек (0 для пустого набора). Сортирует latencies.
+func percentile(latencies []time.Duration, q float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	slices.Sort(latencies)
+	i := int(q * float64(len(latencies)-1))
+	return latencies[i]
+}
+
+// progressLineInterval — период обновления строки прогресса.
+const progressLineInterval = 200 * time.Millisecond
+
+// progressLine — строка прогресса воспроизведения, перерисовываемая на месте через возврат
+// каретки (для терминала): обработано сообщений из total, темп и оценка оставшегося времени.
+// При total <= 0 (бесконечные проходы) печатаются только счётчик и темп. Безопасна для
+// использования из нескольких горутин.
+type progressLine struct {
+	w     io.Writer
+	total int
+	start time.Time
+
+	mu   sync.Mutex
+	done int
+
+	stop     chan struct{}
+	finished chan struct{}
+}
+
+// newProgressLine запускает перерисовку строки в w. Вызывающий обязан вызвать close.
+func newProgressLine(w io.Writer, total int) *progressLine {
+	p := &progressLine{
+		w:        w,
+		total:    total,
+		start:    time.Now(),
+		stop:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *progressLine) run() {
+	defer close(p.finished)
+	ticker := time.NewTicker(progressLineInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			p.render()
+			fmt.Fprintln(p.w)
+			return
+		case <-ticker.C:
+			p.render()
+		}
+	}
+}
+
+// record учитывает n обработанных (отправленных или завершившихся ошибкой) сообщений.
+func (p *progressLine) record(n int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.done += n
+	p.mu.Unlock()
+}
+
+func (p *progressLine) render() {
+	p.mu.Lock()
+	done := p.done
+	p.mu.Unlock()
+
+	elapsed := time.Since(p.start)
+	rate := float64(done) / elapsed.Seconds()
+	if p.total <= 0 {
+		fmt.Fprintf(p.w, "\r%d messages, %.1f msg/s\033[K", done, rate)
+		return
+	}
+	eta := "?"
+	if done > 0 {
+		eta = time.Duration(float64(elapsed) * float64(p.total-done) / float64(done)).Round(time.Second).String()
+	}
+	fmt.Fprintf(p.w, "\r%d/%d messages (%.0f%%), %.1f msg/s, ETA %s\033[K",
+		done, p.total, 100*float64(done)/float64(p.total), rate, eta)
+}
+
+func (p *progressLine) close() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.finished
+}
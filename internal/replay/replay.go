@@ -1,50 +1,323 @@
 package replay
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"trafRep/internal/stream"
+	msgtypes "trafRep/internal/stream/message_types"
 )
 
 type Config struct {
 	TargetHost string
 	TargetPort int
 	Rate       float64
+	// QPS > 0 включает режим фиксированного темпа: исходные метки времени игнорируются,
+	// запросы отправляются с интервалом 1/QPS (см. fixedRateSchedule), Rate не учитывается.
+	QPS        float64
 	PrintQuery bool
 	MaxRetries int
+	// ReconnectBackoffBase и ReconnectBackoffMax задают экспоненциальную паузу между
+	// попытками переподключения (см. backoffDelay); нулевые значения — 100ms и 5s.
+	ReconnectBackoffBase time.Duration
+	ReconnectBackoffMax  time.Duration
+	Occurrence           int // если > 0, из каждой группы одинаковых запросов воспроизводится только N-е вхождение
+
+	// PreserveStartupParams сохраняет параметры сессии из захваченного StartupMessage;
+	// если false, переносятся только user и database. С собственным startup (User)
+	// параметры сессии переносятся в синтезированный StartupMessage (см. performStartup).
+	PreserveStartupParams bool
+	// StartupParams переопределяет (или добавляет) параметры StartupMessage.
+	StartupParams map[string]string
+
+	// RewriteStatementNames делает имена подготовленных операторов и порталов
+	// уникальными для каждой исходной сессии (см. statementRewriter).
+	RewriteStatementNames bool
+
+	// ProductionPattern — шаблон адреса цели или имени базы, при совпадении с которым
+	// воспроизведение запрещено без ConfirmProduction. nil отключает проверку.
+	ProductionPattern *regexp.Regexp
+	ConfirmProduction bool
+
+	// MaxDuration > 0 ограничивает время одного прохода: по его истечении оставшиеся
+	// сообщения не отправляются, соединение закрывается и печатается частичная сводка.
+	MaxDuration time.Duration
+
+	// MaxMessages > 0 оставляет только первые MaxMessages сообщений по времени
+	// (например, для быстрой проверки подключения к новой цели). 0 — все.
+	MaxMessages int
+
+	// FinalizeTransactions ("commit" | "rollback") завершает транзакцию, оставшуюся
+	// открытой на соединении после последнего сообщения. Пустое значение — не завершать;
+	// в режиме пула соединение достаётся другим сессиям, поэтому транзакция откатывается.
+	FinalizeTransactions string
+
+	// TLS, если задан, включает шифрование соединений с целью через SSLRequest.
+	TLS *tls.Config
+
+	// User, Database и Password включают собственный startup и аутентификацию на цели
+	// (см. performStartup): захваченные StartupMessage и PasswordMessage при этом
+	// не отправляются. Пустой User — воспроизводить захваченный startup как есть.
+	User     string
+	Database string
+	Password string
+
+	// DryRun — не подключаться к цели: сообщения сериализуются и печатаются со смещением
+	// отправки по расписанию (см. dryRun).
+	DryRun bool
+
+	// Loops — число проходов по сообщениям; у каждого прохода своё начало расписания.
+	// 0 и 1 — один проход, отрицательное значение — бесконечно.
+	Loops int
+
+	// PerStream воспроизводит каждую исходную сессию (StreamID) на своём соединении
+	// параллельно с остальными, сохраняя порядок сообщений внутри сессии.
+	PerStream bool
+
+	// PoolSize > 0 включает воспроизведение через пул прогретых соединений (см. replayPooled).
+	PoolSize int
+
+	// WriteTargetHost и WriteTargetPort задают primary, на который в режиме пула
+	// перенаправляются записи (см. unitIsWrite); чтения идут на TargetHost. Пустой хост —
+	// всё на TargetHost.
+	WriteTargetHost string
+	WriteTargetPort int
+
+	// ReadTimeout — сколько ждать ответа цели до ReadyForQuery (а также ответа на SSLRequest
+	// и шагов аутентификации); 0 — defaultReadTimeout.
+	ReadTimeout time.Duration
+
+	// StatsInterval > 0 включает периодический вывод снимка прогресса (см. progressReporter)
+	// в stdout, а при Quiet — в stderr.
+	StatsInterval time.Duration
+
+	// Progress, если задан, получает строку прогресса (обработано из общего числа, темп,
+	// оценка оставшегося времени), перерисовываемую на месте; рассчитан на терминал.
+	Progress io.Writer
+
+	// LatencyHistogram печатает в итоговой сводке гистограмму задержек до ReadyForQuery.
+	LatencyHistogram bool
+
+	// Quiet отключает человекочитаемый вывод в stdout (строки сообщений и итоговые сводки);
+	// результат доступен в ReplayReport. Логи ошибок не подавляются, снимки StatsInterval
+	// уходят в stderr.
+	Quiet bool
+
+	// Tracer, если задан, получает spans соединений и сообщений (см. internal/otel).
+	Tracer Tracer
+
+	// Expectations — ожидаемые ответы цели по отпечаткам запросов (см. LoadExpectations).
+	Expectations []Expectation
+
+	// Validate сравнивает каждый ответ цели с ответом сервера из захвата на те же сообщения
+	// (ошибка или успех, теги CommandComplete с числом строк); расхождения попадают в
+	// MessageOutcome.Mismatch и делают воспроизведение неуспешным.
+	Validate bool
+
+	// Logger получает диагностику воспроизведения: ошибки сообщений, переподключения,
+	// уведомления цели. nil — slog.Default().
+	Logger *slog.Logger
+}
+
+// defaultReadTimeout — ReadTimeout по умолчанию.
+const defaultReadTimeout = 40 * time.Second
+
+// readPollInterval — период, с которым waitForReady прерывает чтение из соединения, чтобы
+// проверить общий таймаут и отмену контекста: он же задаёт, как быстро замечается отмена.
+const readPollInterval = 500 * time.Millisecond
+
+// readTimeout возвращает ReadTimeout или значение по умолчанию.
+func (c Config) readTimeout() time.Duration {
+	if c.ReadTimeout > 0 {
+		return c.ReadTimeout
+	}
+	return defaultReadTimeout
+}
+
+// logger возвращает Logger или журнал по умолчанию.
+func (c Config) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.Default()
+}
+
+// rowFor возвращает байты, которые нужно отправить для сообщения m.
+// Для StartupMessage применяются PreserveStartupParams и StartupParams.
+func (c Config) rowFor(m stream.PostgreSQLMessage) []byte {
+	sm, ok := m.StartupMessage()
+	if !ok || (c.PreserveStartupParams && len(c.StartupParams) == 0) {
+		return m.Row()
+	}
+
+	if !c.PreserveStartupParams {
+		kept := stream.StartupMessage{ProtocolVersion: sm.ProtocolVersion}
+		for _, name := range []string{"user", "database"} {
+			if v, ok := sm.Get(name); ok {
+				kept.Set(name, v)
+			}
+		}
+		sm = kept
+	}
+	names := make([]string, 0, len(c.StartupParams))
+	for name := range c.StartupParams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sm.Set(name, c.StartupParams[name])
+	}
+	return sm.Row()
 }
 
 // connectTCP устанавливает TCP‑соединение с указанным адресом и возвращает net.Conn.
-func connectTCP(targetHost string, targetPort int) (net.Conn, error) {
-	addr := fmt.Sprintf("%s:%d", targetHost, targetPort)
-	return net.Dial("tcp", addr)
+// Если tlsConfig не nil, соединение переводится в TLS через SSLRequest (см. negotiateTLS).
+func connectTCP(targetHost string, targetPort int, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	addr := net.JoinHostPort(targetHost, strconv.Itoa(targetPort))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil || tlsConfig == nil {
+		return conn, err
+	}
+	tlsConn, err := negotiateTLS(conn, targetHost, tlsConfig, timeout)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// negotiateTLS отправляет SSLRequest и, если сервер ответил 'S', выполняет TLS-рукопожатие.
+// Ответ 'N' означает, что сервер не поддерживает TLS, и возвращается ошибкой.
+func negotiateTLS(conn net.Conn, host string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	req := make([]byte, 8)
+	binary.BigEndian.PutUint32(req[0:4], 8)
+	binary.BigEndian.PutUint32(req[4:8], stream.SSLRequestCode)
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("write SSLRequest: %w", err)
+	}
+	answer := make([]byte, 1)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return nil, fmt.Errorf("read SSLRequest answer: %w", err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if answer[0] != 'S' {
+		return nil, fmt.Errorf("target refused TLS (answer %q) but --tls is required", answer[0])
+	}
+
+	cfg := tlsConfig.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("tls handshake: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// dialTarget подключается к host:port и, если задан cfg.User, выполняет собственный startup
+// с параметрами сессии из захваченного startup (см. performStartup; может быть nil).
+func dialTarget(host string, port int, cfg Config, startup *stream.StartupMessage) (net.Conn, error) {
+	c, err := connectTCP(host, port, cfg.TLS, cfg.readTimeout())
+	if err != nil || cfg.User == "" {
+		return c, err
+	}
+	if err := performStartup(c, cfg, startup, cfg.readTimeout()); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// StartupError сообщает, что сервер отверг соединение на этапе startup/аутентификации
+// (ErrorResponse в ответ на StartupMessage или PasswordMessage).
+type StartupError struct {
+	Severity string
+	Code     string // SQLSTATE
+	Message  string
+}
+
+func (e *StartupError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("%s %s: %s", e.Severity, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Severity, e.Message)
+}
+
+// parseErrorResponse разбирает тело ErrorResponse (см. stream.DecodeErrorResponse) в *StartupError.
+// Из повреждённого тела берутся поля, прочитанные до ошибки; без Severity — "ERROR".
+func parseErrorResponse(body []byte) *StartupError {
+	er, _ := stream.DecodeErrorResponse(body)
+	e := &StartupError{Severity: er.Severity, Code: er.Code, Message: er.Message}
+	if e.Severity == "" {
+		e.Severity = "ERROR"
+	}
+	return e
+}
+
+// serverResponse — сводка ответа сервера на одно клиентское сообщение.
+type serverResponse struct {
+	CommandTags []string
+	Errors      []stream.ErrorResponse
+	// Columns — имена столбцов последнего RowDescription ответа.
+	Columns []string
+	// CopyIn — сервер ответил CopyInResponse ('G') и ждёт поток CopyData.
+	CopyIn bool
+	// TxStatus — индикатор состояния транзакции из ReadyForQuery: 'I' (вне транзакции),
+	// 'T' (в транзакции) или 'E' (в прерванной транзакции).
+	TxStatus byte
+}
+
+// LastCommandTag возвращает последний тег CommandComplete ответа или пустую строку.
+func (r serverResponse) LastCommandTag() string {
+	if len(r.CommandTags) == 0 {
+		return ""
+	}
+	return r.CommandTags[len(r.CommandTags)-1]
 }
 
 // waitForReady читает из conn до тех пор, пока не встретит серверное сообщение типа 'Z' (ReadyForQuery).
-// readTimeout задаёт максимальное время ожидания (общий таймаут для поиска 'Z').
+// readTimeout задаёт максимальное время ожидания (общий таймаут для поиска 'Z', см. Config.ReadTimeout);
+// соединение опрашивается с периодом readPollInterval.
 // Функция съедает прочитанные байты из соединения (не возвращает их).
-func waitForReady(conn net.Conn, readTimeout time.Duration) error {
+// Асинхронные уведомления NotificationResponse ('A') и NoticeResponse ('N') пишутся в logger и пропускаются.
+// Если startupPhase == true, ErrorResponse ('E') возвращается как *StartupError, а запрос
+// аутентификации ('R' с ненулевым кодом) завершает ожидание: сервер ждёт следующего сообщения клиента.
+// Теги CommandComplete и тексты ErrorResponse, встреченные до 'Z', собираются в serverResponse.
+// CopyInResponse ('G') тоже завершает ожидание: сервер ждёт от клиента поток CopyData.
+// CopyBothResponse ('W', потоковая репликация) завершает ожидание ошибкой.
+// Отмена ctx прерывает ожидание не позже чем через полсекунды (период чтения).
+func waitForReady(ctx context.Context, conn net.Conn, readTimeout time.Duration, startupPhase bool, logger *slog.Logger) (serverResponse, error) {
+	var resp serverResponse
 	if conn == nil {
-		return fmt.Errorf("nil connection")
+		return resp, fmt.Errorf("nil connection")
 	}
 	deadline := time.Now().Add(readTimeout)
 	buf := make([]byte, 0)
 	tmp := make([]byte, 4096)
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return resp, fmt.Errorf("interrupted waiting ReadyForQuery: %w", err)
+		}
 		if time.Now().After(deadline) {
-			return fmt.Errorf("timeout waiting ReadyForQuery")
+			return resp, fmt.Errorf("timeout waiting ReadyForQuery")
 		}
-		_ = conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_ = conn.SetReadDeadline(time.Now().Add(readPollInterval))
 		n, err := conn.Read(tmp)
 		if n > 0 {
 			buf = append(buf, tmp[:n]...)
@@ -55,154 +328,821 @@ func waitForReady(conn net.Conn, readTimeout time.Duration) error {
 				continue
 			}
 			if err == io.EOF {
-				return fmt.Errorf("connection closed by remote")
+				return resp, fmt.Errorf("connection closed by remote")
 			}
-			return fmt.Errorf("read error while waiting ReadyForQuery: %w", err)
+			return resp, fmt.Errorf("read error while waiting ReadyForQuery: %w", err)
 		}
 
 		for {
-			if len(buf) == 0 {
+			typ, body, total, err := splitServerFrame(buf)
+			if err != nil {
+				return resp, err
+			}
+			if total == 0 {
 				break
 			}
+			buf = buf[total:]
 
-			first := buf[0]
-			isASCIIType := (first >= 'A' && first <= 'Z') || (first >= 'a' && first <= 'z')
-			if isASCIIType {
-				if len(buf) < 5 {
-					break
+			switch typ {
+			case 'Z':
+				if len(body) > 0 {
+					resp.TxStatus = body[0]
 				}
-				msgLen := int(binary.BigEndian.Uint32(buf[1:5]))
-				if msgLen <= 0 {
-					return fmt.Errorf("invalid server length %d", msgLen)
+				return resp, nil
+			case 'G':
+				resp.CopyIn = true
+				return resp, nil
+			case 'W':
+				// CopyBothResponse: цель начала потоковую репликацию, ReadyForQuery не будет
+				// до её остановки, а поток WAL воспроизведение не потребляет
+				return resp, fmt.Errorf("target started replication streaming (CopyBothResponse), which replay does not support")
+			case 'C':
+				resp.CommandTags = append(resp.CommandTags, strings.TrimRight(string(body), "\x00"))
+			case 'T':
+				if rd, err := stream.DecodeRowDescription(body); err == nil {
+					resp.Columns = rd.Names()
 				}
-				total := 1 + msgLen
-				if len(buf) < total {
-					break
+			case 'E':
+				if startupPhase {
+					return resp, parseErrorResponse(body)
 				}
-				if first == 'Z' {
-					return nil
+				er, _ := stream.DecodeErrorResponse(body)
+				if er.Severity == "" {
+					er.Severity = "ERROR"
+				}
+				resp.Errors = append(resp.Errors, er)
+			case 'R':
+				if startupPhase && len(body) >= 4 && binary.BigEndian.Uint32(body[0:4]) != 0 {
+					return resp, nil
+				}
+			case 'A':
+				// уведомление для сессии, подписанной через LISTEN, приходит асинхронно
+				if n, err := stream.DecodeNotification(body); err == nil {
+					logger.Debug("notification received", "channel", n.Channel, "payload", n.Payload, "pid", n.PID)
+				}
+			case 'N':
+				// NoticeResponse (RAISE NOTICE, WARNING) не влияет на исход сообщения
+				if er, err := stream.DecodeErrorResponse(body); err == nil {
+					logger.Info("notice received", "severity", er.Severity, "code", er.Code, "message", er.Message)
 				}
-				buf = buf[total:]
-				continue
 			}
+		}
+	}
+}
 
-			if len(buf) < 4 {
-				break
-			}
-			msgLen := int(binary.BigEndian.Uint32(buf[0:4]))
-			if msgLen <= 0 {
-				return fmt.Errorf("invalid server length-only %d", msgLen)
-			}
-			if len(buf) < msgLen {
-				break
-			}
+// splitServerFrame выделяет из начала buf одно серверное сообщение. Обычное сообщение
+// начинается с байта типа (ASCII-буква или цифра ParseComplete, BindComplete, CloseComplete),
+// за которым идёт длина, учитывающая саму себя, но не байт типа: всего 1+length байт. Сообщение без типа (length-only) состоит только из
+// длины и тела: всего length байт, typ == 0. Длина меньше 4 не может быть корректной в
+// обеих формах и возвращается как ошибка: иначе чтение рассинхронизируется с потоком.
+// total == 0 означает, что сообщение в buf ещё не получено целиком.
+func splitServerFrame(buf []byte) (typ byte, body []byte, total int, err error) {
+	if len(buf) == 0 {
+		return 0, nil, 0, nil
+	}
+	first := buf[0]
+	if (first >= 'A' && first <= 'Z') || (first >= 'a' && first <= 'z') || (first >= '1' && first <= '3') {
+		if len(buf) < 5 {
+			return 0, nil, 0, nil
+		}
+		msgLen := int(binary.BigEndian.Uint32(buf[1:5]))
+		if msgLen < 4 {
+			return 0, nil, 0, fmt.Errorf("invalid server length %d for message %q", msgLen, first)
+		}
+		total = 1 + msgLen
+		if len(buf) < total {
+			return 0, nil, 0, nil
+		}
+		return first, buf[5:total], total, nil
+	}
+
+	if len(buf) < 4 {
+		return 0, nil, 0, nil
+	}
+	msgLen := int(binary.BigEndian.Uint32(buf[0:4]))
+	if msgLen < 4 {
+		return 0, nil, 0, fmt.Errorf("invalid server length-only %d", msgLen)
+	}
+	if len(buf) < msgLen {
+		return 0, nil, 0, nil
+	}
+	return 0, buf[4:msgLen], msgLen, nil
+}
 
-			buf = buf[msgLen:]
+// finalizeTransaction завершает открытую на conn транзакцию командой COMMIT или ROLLBACK
+// (mode: "commit" | "rollback"), чтобы воспроизведение не оставляло на цели удерживаемые блокировки.
+func finalizeTransaction(conn net.Conn, mode string, readTimeout time.Duration, logger *slog.Logger) error {
+	query := strings.ToUpper(mode)
+	payload := append([]byte(query), 0)
+	m := stream.PostgreSQLMessage{
+		Type:    msgtypes.MessageTypeQuery,
+		Len:     uint32(4 + len(payload)),
+		Payload: payload,
+	}
+	if _, err := conn.Write(m.Row()); err != nil {
+		return fmt.Errorf("write %s: %w", query, err)
+	}
+	// транзакция завершается и после отмены воспроизведения: для этого она и нужна
+	resp, err := waitForReady(context.Background(), conn, readTimeout, false, logger)
+	if err != nil {
+		return fmt.Errorf("wait %s: %w", query, err)
+	}
+	if len(resp.Errors) > 0 {
+		return fmt.Errorf("%s: %s", query, resp.Errors[0])
+	}
+	logger.Debug("open transaction finalized", "query", query)
+	return nil
+}
+
+// selectOccurrence оставляет для каждого отпечатка простого запроса (stream.Fingerprint)
+// только его n-е по времени вхождение. Сообщения других типов сохраняются без изменений.
+func selectOccurrence(messages []stream.PostgreSQLMessage, n int) []stream.PostgreSQLMessage {
+	seen := make(map[string]int)
+	out := make([]stream.PostgreSQLMessage, 0, len(messages))
+	for _, m := range messages {
+		if !m.Type.IsSimpleQuery() {
+			out = append(out, m)
+			continue
+		}
+		fp := stream.Fingerprint(m.PrettyQuery())
+		seen[fp]++
+		if seen[fp] == n {
+			out = append(out, m)
 		}
 	}
+	return out
+}
+
+// closeConn закрывает соединение с целью и завершает его трассу, если она есть.
+func closeConn(conn net.Conn, trace ConnectionTrace) error {
+	err := conn.Close()
+	if trace != nil {
+		trace.End()
+	}
+	return err
+}
+
+// capturedStartup возвращает первый StartupMessage среди messages или nil.
+func capturedStartup(messages []stream.PostgreSQLMessage) *stream.StartupMessage {
+	for _, m := range messages {
+		if sm, ok := m.StartupMessage(); ok {
+			return &sm
+		}
+	}
+	return nil
+}
+
+// progressTotal возвращает число отправляемых сообщений всех проходов для строки прогресса:
+// без пропускаемых skipsCapturedStartup; -1 — повтор без ограничения (Loops < 0).
+func progressTotal(messages []stream.PostgreSQLMessage, config Config) int {
+	if config.Loops < 0 {
+		return -1
+	}
+	sent := 0
+	for _, m := range messages {
+		if !config.skipsCapturedStartup(m) {
+			sent++
+		}
+	}
+	return sent * max(config.Loops, 1)
+}
+
+// skipsCapturedStartup сообщает, что m не воспроизводится: при собственной аутентификации
+// (User) захваченные StartupMessage и PasswordMessage заменяются новыми.
+func (c Config) skipsCapturedStartup(m stream.PostgreSQLMessage) bool {
+	return c.User != "" && (!m.Type.HaveTypeByte() || m.Type == msgtypes.MessageTypePasswordMessage)
+}
+
+// paceTime возвращает момент, в который нужно отправить m, чтобы сохранить исходные
+// интервалы от firstTime, сжатые в rate раз.
+func paceTime(replayStart, firstTime time.Time, m stream.PostgreSQLMessage, rate float64) time.Time {
+	return replayStart.Add(time.Duration(float64(m.FirstTCPPacketTimestamp.Sub(firstTime)) / rate))
+}
+
+// fixedRateSchedule возвращает копию messages, в которой метки отправки заменены равномерным
+// расписанием: i-й запрос — через i/qps от первого сообщения. Запросом считается простой
+// запрос, FunctionCall или конвейер расширенного протокола до Sync включительно: сообщения
+// конвейера одной сессии получают метку его первого сообщения и уходят вместе.
+// Порядок сообщений внутри каждой сессии сохраняется.
+func fixedRateSchedule(messages []stream.PostgreSQLMessage, qps float64) []stream.PostgreSQLMessage {
+	out := make([]stream.PostgreSQLMessage, len(messages))
+	copy(out, messages)
+	start := messages[0].FirstTCPPacketTimestamp
+	interval := float64(time.Second) / qps
+	// open — метки незавершённых конвейеров по сессиям
+	open := make(map[string]time.Time)
+	slot := 0
+	for i := range out {
+		m := &out[i]
+		ts, ok := open[m.StreamID]
+		if !ok {
+			ts = start.Add(time.Duration(float64(slot) * interval))
+			slot++
+		}
+		if m.Type.AwaitsSync() {
+			open[m.StreamID] = ts
+		} else {
+			delete(open, m.StreamID)
+		}
+		m.FirstTCPPacketTimestamp = ts
+	}
+	return out
+}
+
+// sleepCtx ждёт d или отмены ctx и сообщает, можно ли продолжать (ctx не отменён).
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
 // ReplayMessages сортирует сообщения по времени и воспроизводит их через TCP.
 // Временные интервалы между сообщениями масштабируются по config.Rate.
 // Если config.Rate == 1.0 — используются оригинальные интервалы (точное время).
+// При config.QPS > 0 исходные интервалы не используются: запросы идут с постоянным темпом.
 // После отправки каждого клиентского сообщения функция ждёт серверное ReadyForQuery ('Z').
-func ReplayMessages(messages []stream.PostgreSQLMessage, config Config) error {
+// По умолчанию все сообщения идут по одному соединению; с config.PerStream каждая
+// исходная сессия воспроизводится параллельно на своём соединении. С config.Loops
+// сообщения воспроизводятся повторно, итоги суммируются по всем проходам.
+// Итоги возвращаются в ReplayReport и при ошибке воспроизведения (ошибки сообщений,
+// несовпавшие ожидания); nil означает, что до отправки дело не дошло или включён DryRun.
+// Отмена ctx останавливает воспроизведение: неотправленные сообщения учитываются как
+// пропущенные, открытые транзакции завершаются (см. FinalizeTransactions), соединения
+// закрываются, печатается частичная сводка, а ошибка оборачивает ctx.Err().
+func ReplayMessages(ctx context.Context, messages []stream.PostgreSQLMessage, config Config) (*ReplayReport, error) {
 	if len(messages) == 0 {
-		return fmt.Errorf("no messages to replay")
+		return nil, fmt.Errorf("no messages to replay")
 	}
 
-	sort.Slice(messages, func(i, j int) bool {
+	// устойчивая сортировка: у сообщений конвейера из одного сегмента одна метка времени,
+	// и Execute не должен уйти раньше своих Parse и Bind
+	sort.SliceStable(messages, func(i, j int) bool {
 		return messages[i].FirstTCPPacketTimestamp.Before(messages[j].FirstTCPPacketTimestamp)
 	})
 
-	conn, err := connectTCP(config.TargetHost, config.TargetPort)
+	if config.Occurrence > 0 {
+		messages = selectOccurrence(messages, config.Occurrence)
+		if len(messages) == 0 {
+			return nil, fmt.Errorf("no messages left after occurrence filter")
+		}
+	}
+	messages = contiguousCopyBlocks(messages)
+	if config.MaxMessages > 0 && config.MaxMessages < len(messages) {
+		messages = messages[:config.MaxMessages]
+	}
+	if config.QPS > 0 {
+		messages = fixedRateSchedule(messages, config.QPS)
+		config.Rate = 1
+	}
+
+	if config.DryRun {
+		dryRun(os.Stdout, messages, config)
+		return nil, nil
+	}
+	if err := checkProduction(messages, config); err != nil {
+		return nil, err
+	}
+	if config.Tracer != nil {
+		defer func() {
+			if err := config.Tracer.Close(); err != nil {
+				config.logger().Warn("tracer shutdown failed", "err", err)
+			}
+		}()
+	}
+	if config.PoolSize > 0 {
+		return replayPooled(ctx, messages, config)
+	}
+
+	totals := newReplayTotals(config, progressTotal(messages, config))
+
+	out := config.output()
+	passes := 0
+	start := time.Now()
+	for (config.Loops < 0 || passes < max(config.Loops, 1)) && ctx.Err() == nil {
+		passes++
+		successBefore, errorsBefore := totals.counts()
+		r := &sessionReplayer{
+			ctx:         ctx,
+			config:      config,
+			totals:      totals,
+			firstTime:   messages[0].FirstTCPPacketTimestamp,
+			replayStart: time.Now(),
+		}
+		if err := r.runAll(messages); err != nil {
+			totals.progress.close()
+			totals.line.close()
+			return nil, err
+		}
+		if config.Loops != 1 {
+			success, errs := totals.counts()
+			fmt.Fprintf(out, "Loop %d: %d successful, %d errors, time: %v\n",
+				passes, success-successBefore, errs-errorsBefore, time.Since(r.replayStart))
+		}
+	}
+
+	return totals.finish(ctx, config, len(messages)*passes, passes, time.Since(start),
+		fmt.Sprintf("reconnecting: %v", totals.reconnectTime))
+}
+
+// dryRun печатает, что было бы отправлено: для каждого сообщения смещение от начала
+// воспроизведения с учётом config.Rate, тип, размер и текст запроса. Сообщения проходят
+// ту же сериализацию, что и при отправке (rowFor, переименование операторов), но к цели
+// никто не подключается.
+func dryRun(w io.Writer, messages []stream.PostgreSQLMessage, config Config) {
+	var rewriter *statementRewriter
+	if config.RewriteStatementNames {
+		rewriter = newStatementRewriter()
+	}
+	firstTime := messages[0].FirstTCPPacketTimestamp
+	var start time.Time
+	var offset time.Duration
+	sent, bytes := 0, 0
+	for i, m := range messages {
+		if config.skipsCapturedStartup(m) {
+			continue
+		}
+		if rewriter != nil {
+			m = rewriter.rewrite(m)
+		}
+		row := config.rowFor(m)
+		offset = paceTime(start, firstTime, m, config.Rate).Sub(start)
+		sent++
+		bytes += len(row)
+		line := fmt.Sprintf("client=%s idx=%d +%v DRY-RUN - %d bytes, Type: %s", m.ClientAddr(), i+1, offset, len(row), m.Type)
+		if m.Type.IsSimpleQuery() {
+			line += ", QUERY: " + m.PrettyQuery()
+		}
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintf(w, "Dry run: %d of %d messages would be sent, %d bytes, schedule length: %v\n",
+		sent, len(messages), bytes, offset)
+}
+
+// replayTotals — итоги воспроизведения, общие для всех сессий. Поля, кроме progress и line,
+// защищены mu.
+type replayTotals struct {
+	mu            sync.Mutex
+	success       int
+	errors        int
+	skipped       int
+	latencies     []time.Duration
+	reconnectTime time.Duration
+	outcomes      []MessageOutcome
+	checker       *expectationChecker
+	compared      int
+	mismatches    int
+	progress      *progressReporter
+	line          *progressLine
+}
+
+// newReplayTotals создаёт итоги воспроизведения с проверкой ожиданий и выводом прогресса
+// по config; total — число сообщений для строки прогресса (-1 — неизвестно).
+func newReplayTotals(config Config, total int) *replayTotals {
+	t := &replayTotals{}
+	if len(config.Expectations) > 0 {
+		t.checker = newExpectationChecker(config.Expectations)
+	}
+	if config.StatsInterval > 0 {
+		t.progress = newProgressReporter(config.statsOutput(), config.StatsInterval)
+	}
+	if config.Progress != nil {
+		t.line = newProgressLine(config.Progress, total)
+	}
+	return t
+}
+
+// finish останавливает вывод прогресса, печатает итоговую сводку и возвращает отчёт
+// с ошибкой итога воспроизведения. total — число сообщений всех passes проходов, detail
+// дописывается в строку итога (сведения, свои для режима воспроизведения).
+func (t *replayTotals) finish(ctx context.Context, config Config, total, passes int, elapsed time.Duration, detail string) (*ReplayReport, error) {
+	t.progress.close()
+	t.line.close()
+
+	out := config.output()
+	report := &ReplayReport{
+		Total:      total,
+		Successful: t.success,
+		Errors:     t.errors,
+		Skipped:    t.skipped,
+		Loops:      passes,
+		Elapsed:    elapsed,
+		Messages:   t.outcomes,
+	}
+	fmt.Fprintf(out, "Replay completed: %d messages, %d successful, %d errors, total time: %v, %s\n",
+		report.Total, t.success, t.errors, elapsed, detail)
+	if passes > 1 {
+		fmt.Fprintf(out, "Loops: %d\n", passes)
+	}
+	switch {
+	case ctx.Err() != nil:
+		report.Interrupted = true
+		fmt.Fprintf(out, "Replay interrupted: %d messages not sent\n", t.skipped)
+	case t.skipped > 0:
+		fmt.Fprintf(out, "Replay stopped by max duration %v: %d messages not sent\n", config.MaxDuration, t.skipped)
+	}
+	writeLatencySummary(out, t.latencies)
+	if config.LatencyHistogram {
+		writeLatencyHistogram(out, t.latencies)
+	}
+	if report.Interrupted {
+		return report, fmt.Errorf("replay interrupted: %w", ctx.Err())
+	}
+	if config.Validate {
+		report.ValidationMismatches = t.mismatches
+		fmt.Fprintf(out, "Validation: %d of %d responses differ from capture\n", t.mismatches, t.compared)
+	}
+	if t.checker != nil {
+		if failed := t.checker.report(out); failed > 0 {
+			report.ExpectationsFailed = failed
+			return report, fmt.Errorf("%d of %d expectations failed", failed, len(config.Expectations))
+		}
+	}
+	if t.mismatches > 0 {
+		return report, fmt.Errorf("%d responses differ from capture", t.mismatches)
+	}
+	if t.errors > 0 {
+		return report, fmt.Errorf("replay completed with %d errors", t.errors)
+	}
+	return report, nil
+}
+
+func (t *replayTotals) failed() {
+	t.mu.Lock()
+	t.errors++
+	t.mu.Unlock()
+	t.progress.record(1, 0, true)
+	t.line.record(1)
+}
+
+// failedMessage учитывает сообщение, которое не удалось отправить или дождаться ответа на него.
+func (t *replayTotals) failedMessage(o MessageOutcome) {
+	t.failed()
+	t.mu.Lock()
+	t.outcomes = append(t.outcomes, o)
+	t.mu.Unlock()
+}
+
+func (t *replayTotals) reconnected(d time.Duration) {
+	t.mu.Lock()
+	t.reconnectTime += d
+	t.mu.Unlock()
+}
+
+// completed учитывает отправленное сообщение с исходом o; resp и latency имеют смысл, только
+// если answered (ответ сервера дочитан до ReadyForQuery). Сообщение, на которое цель
+// ответила ErrorResponse, считается ошибкой.
+func (t *replayTotals) completed(o MessageOutcome, answered bool, resp serverResponse, latency time.Duration) {
+	failed := len(resp.Errors) > 0
+	if failed {
+		o.Error = resp.Errors[0].Error()
+	}
+	if answered {
+		o.Latency = latency
+	}
+	t.mu.Lock()
+	t.outcomes = append(t.outcomes, o)
+	if failed {
+		t.errors++
+	} else {
+		t.success++
+	}
+	if answered {
+		t.latencies = append(t.latencies, latency)
+	}
+	t.mu.Unlock()
+	t.progress.record(1, latency, failed)
+	t.line.record(1)
+}
+
+// check сверяет ответ resp на запрос m с ожиданиями (Config.Expectations), если они заданы.
+func (t *replayTotals) check(m stream.PostgreSQLMessage, resp serverResponse) {
+	if t.checker == nil {
+		return
+	}
+	t.mu.Lock()
+	t.checker.check(m, resp)
+	t.mu.Unlock()
+}
+
+// validated учитывает сверку ответа с захватом при Validate (compared) и расхождение
+// (mismatches), если mismatch не пуст.
+func (t *replayTotals) validated(mismatch string) {
+	t.mu.Lock()
+	t.compared++
+	if mismatch != "" {
+		t.mismatches++
+	}
+	t.mu.Unlock()
+}
+
+// counts возвращает текущие значения success и errors.
+func (t *replayTotals) counts() (success, errors int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.success, t.errors
+}
+
+// sessionReplayer воспроизводит последовательность сообщений на одном соединении с целью.
+type sessionReplayer struct {
+	ctx         context.Context
+	config      Config
+	totals      *replayTotals
+	firstTime   time.Time
+	replayStart time.Time
+	// dial подключается к цели; nil — dialTarget. Тесты подставляют свои соединения.
+	dial func(host string, port int, cfg Config, startup *stream.StartupMessage) (net.Conn, error)
+}
+
+// runAll воспроизводит messages одним проходом: на одном соединении или, с config.PerStream,
+// каждую исходную сессию на своём соединении параллельно.
+func (r *sessionReplayer) runAll(messages []stream.PostgreSQLMessage) error {
+	if !r.config.PerStream {
+		return r.run(messages)
+	}
+	sessions := make(map[string][]stream.PostgreSQLMessage)
+	var order []string
+	for _, m := range messages {
+		if _, ok := sessions[m.StreamID]; !ok {
+			order = append(order, m.StreamID)
+		}
+		sessions[m.StreamID] = append(sessions[m.StreamID], m)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(order))
+	for i, id := range order {
+		// сессия подключается со своим исходным сдвигом от начала захвата, чтобы
+		// сохранить картину появления соединений, а не только интервалы внутри сессии
+		if !sleepCtx(r.ctx, time.Until(paceTime(r.replayStart, r.firstTime, sessions[id][0], r.config.Rate))) {
+			r.totals.mu.Lock()
+			for _, rest := range order[i:] {
+				r.totals.skipped += len(sessions[rest])
+			}
+			r.totals.mu.Unlock()
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = r.run(sessions[id])
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// run отправляет messages по порядку на собственном соединении, соблюдая исходные интервалы.
+// Ошибка возвращается только при отказе startup/аутентификации; остальные ошибки
+// учитываются в totals.
+func (r *sessionReplayer) run(messages []stream.PostgreSQLMessage) error {
+	config := r.config
+	logger := config.logger()
+
+	// txStatus — состояние транзакции текущего соединения по последнему ReadyForQuery
+	var txStatus byte
+	// inCopy — цель ответила CopyInResponse и ждёт CopyData/CopyDone/CopyFail
+	var inCopy bool
+	// copyQuery — запрос COPY ... FROM STDIN, ожидание для которого проверяется по ответу
+	// на CopyDone/CopyFail (в ответе на сам запрос ещё нет тега)
+	var copyQuery *stream.PostgreSQLMessage
+	// unit — сообщения, отправленные с последнего ответа ReadyForQuery (для Validate)
+	var unit []stream.PostgreSQLMessage
+	startup := capturedStartup(messages)
+	// trace — трасса текущего соединения (nil без Tracer); после закрытия соединения она
+	// остаётся до следующего подключения, чтобы учесть сообщение, на котором оно оборвалось
+	var trace ConnectionTrace
+	connect := func() (net.Conn, error) {
+		dial := r.dial
+		if dial == nil {
+			dial = dialTarget
+		}
+		c, err := dial(config.TargetHost, config.TargetPort, config, startup)
+		if err == nil && config.Tracer != nil {
+			trace = config.Tracer.StartConnection(c.RemoteAddr().String())
+		}
+		txStatus = 0
+		inCopy = false
+		copyQuery = nil
+		unit = nil
+		return c, err
+	}
+
+	conn, err := connect()
 	if err != nil {
-		log.Printf("failed to connect to target %s:%d: %v", config.TargetHost, config.TargetPort, err)
+		var startupErr *StartupError
+		if errors.As(err, &startupErr) {
+			return fmt.Errorf("authentication on target failed: %w", err)
+		}
+		logger.Warn("failed to connect to target", "host", config.TargetHost, "port", config.TargetPort, "err", err)
 		conn = nil
 	}
 
-	var successCount, errorCount int
-	readyTimeout := 40 * time.Second
+	readyTimeout := config.readTimeout()
 
-	firstTime := messages[0].FirstTCPPacketTimestamp
-	replayStart := time.Now()
+	var rewriter *statementRewriter
+	if config.RewriteStatementNames {
+		rewriter = newStatementRewriter()
+	}
 
 	for i, m := range messages {
-		targetOffset := time.Duration(float64(m.FirstTCPPacketTimestamp.Sub(firstTime)) / config.Rate)
-		targetTime := replayStart.Add(targetOffset)
-		if wait := time.Until(targetTime); wait > 0 {
-			//time.Sleep(wait)
+		if r.ctx.Err() != nil {
+			r.totals.mu.Lock()
+			r.totals.skipped += len(messages) - i
+			r.totals.mu.Unlock()
+			break
+		}
+		if config.MaxDuration > 0 && time.Since(r.replayStart) >= config.MaxDuration {
+			skipped := len(messages) - i
+			r.totals.mu.Lock()
+			r.totals.skipped += skipped
+			r.totals.mu.Unlock()
+			logger.Warn("max duration reached, stopping replay", "max_duration", config.MaxDuration, "messages_left", skipped)
+			break
+		}
+
+		// при собственной аутентификации захваченный startup не воспроизводится
+		if config.skipsCapturedStartup(m) {
+			continue
+		}
+
+		// если отстаём от исходного расписания, сообщение отправляется сразу
+		if !sleepCtx(r.ctx, time.Until(paceTime(r.replayStart, r.firstTime, m, config.Rate))) {
+			r.totals.mu.Lock()
+			r.totals.skipped += len(messages) - i
+			r.totals.mu.Unlock()
+			break
 		}
 
 		if conn == nil {
-			c, err := connectTCP(config.TargetHost, config.TargetPort)
+			reconnectStart := time.Now()
+			c, err := connect()
+			r.totals.reconnected(time.Since(reconnectStart))
 			if err != nil {
-				log.Printf("could not connect before sending message %d: %v", i+1, err)
-				errorCount++
+				logger.Error("could not connect before sending message", "client", m.ClientAddr(), "idx", i+1, "err", err)
+				r.totals.failedMessage(MessageOutcome{Index: i + 1, Stream: m.StreamID, Type: m.Type.String(), Error: err.Error()})
 				continue
 			}
 			conn = c
 		}
 
+		// поток COPY отправляется только после CopyInResponse; если сервер его не прислал
+		// (например, COPY завершился ошибкой), данные пропускаются
+		if m.Type.IsCopyStream() && !inCopy {
+			logger.Warn("skipping message: target is not in COPY IN mode", "client", m.ClientAddr(), "idx", i+1, "type", m.Type.String())
+			r.totals.failedMessage(MessageOutcome{Index: i + 1, Stream: m.StreamID, Type: m.Type.String(), Error: "target is not in COPY IN mode"})
+			continue
+		}
+
+		if rewriter != nil {
+			m = rewriter.rewrite(m)
+		}
+		row := config.rowFor(m)
+		outcome := MessageOutcome{Index: i + 1, Stream: m.StreamID, Type: m.Type.String(), Bytes: len(row)}
+		sent := time.Now()
 		var writeErr error
-		for attempt := 0; attempt < config.MaxRetries; attempt++ {
-			row := m.Row()
+		for attempt := 0; attempt < max(config.MaxRetries, 1); attempt++ {
+			if attempt > 0 {
+				reconnectStart := time.Now()
+				if !sleepCtx(r.ctx, backoffDelay(attempt-1, config.ReconnectBackoffBase, config.ReconnectBackoffMax)) {
+					writeErr = r.ctx.Err()
+					break
+				}
+				c, err := connect()
+				r.totals.reconnected(time.Since(reconnectStart))
+				if err != nil {
+					writeErr = fmt.Errorf("reconnect: %w", err)
+					logger.Warn("reconnect attempt failed", "client", m.ClientAddr(), "idx", i+1, "attempt", attempt+1, "max_retries", config.MaxRetries, "err", err)
+					continue
+				}
+				conn = c
+			}
 			_, writeErr = conn.Write(row)
 			if writeErr == nil {
 				break
 			}
-			log.Printf("Write attempt %d/%d failed for message %d: %v. Reconnecting...", attempt+1, config.MaxRetries, i+1, writeErr)
-			_ = conn.Close()
+			logger.Warn("write attempt failed, reconnecting", "client", m.ClientAddr(), "idx", i+1, "attempt", attempt+1, "max_retries", config.MaxRetries, "err", writeErr)
+			_ = closeConn(conn, trace)
 			conn = nil
-			time.Sleep(100 * time.Millisecond)
-			if attempt < config.MaxRetries-1 {
-				c, err := connectTCP(config.TargetHost, config.TargetPort)
-				if err == nil {
-					conn = c
-				}
-			}
 		}
 		if writeErr != nil {
-			errorCount++
-			log.Printf("Message %d ERROR - write failed: %v", i+1, writeErr)
+			outcome.Error = fmt.Sprintf("write failed: %v", writeErr)
+			r.totals.failedMessage(outcome)
+			logger.Error("message failed: write failed", "client", m.ClientAddr(), "idx", i+1, "err", writeErr)
+			if trace != nil {
+				trace.Message(m, len(row), sent, time.Since(sent), writeErr)
+			}
 			continue
 		}
 
-		if i != len(messages)-1 {
-			if err := waitForReady(conn, readyTimeout); err != nil {
-				errorCount++
-				log.Printf("Message %d ERROR - waiting ReadyForQuery failed: %v", i+1, err)
-				_ = conn.Close()
+		unit = append(unit, m)
+
+		// сообщения расширенного протокола (Parse/Bind/Execute/Describe/Close/Flush)
+		// отправляются подряд: сервер ответит на них вместе с ReadyForQuery после Sync
+		isLast := i == len(messages)-1
+		waitLast := config.FinalizeTransactions != "" && m.Type != msgtypes.MessageTypeTerminate
+		if m.Type.IsCopyStream() && m.Type != msgtypes.MessageTypeCopyData {
+			inCopy = false
+		}
+		var latency time.Duration
+		var resp serverResponse
+		answered := false
+		if (!isLast || waitLast) && !m.Type.AwaitsSync() && m.Type != msgtypes.MessageTypeCopyData {
+			startupPhase := !m.Type.HaveTypeByte() || m.Type == msgtypes.MessageTypePasswordMessage
+			resp, err = waitForReady(r.ctx, conn, readyTimeout, startupPhase, logger)
+			if err != nil {
+				var startupErr *StartupError
+				if errors.As(err, &startupErr) {
+					_ = closeConn(conn, trace)
+					return fmt.Errorf("protocol/auth negotiation failed at message %d: %w", i+1, err)
+				}
+				outcome.Error = fmt.Sprintf("waiting ReadyForQuery failed: %v", err)
+				r.totals.failedMessage(outcome)
+				logger.Error("message failed: waiting ReadyForQuery failed", "client", m.ClientAddr(), "idx", i+1, "err", err)
+				if trace != nil {
+					trace.Message(m, len(row), sent, time.Since(sent), err)
+				}
+				_ = closeConn(conn, trace)
 				conn = nil
+				unit = nil
 				continue
 			}
+			latency = time.Since(sent)
+			answered = true
+			txStatus = resp.TxStatus
+			inCopy = resp.CopyIn
+			if config.Validate {
+				if mismatch, ok := compareResponse(unit, resp); ok {
+					r.totals.validated(mismatch)
+					if mismatch != "" {
+						outcome.Mismatch = mismatch
+						logger.Warn("response differs from capture", "client", m.ClientAddr(), "idx", i+1, "mismatch", mismatch)
+					}
+				}
+			}
+			unit = nil
 		}
 
-		successCount++
-		row := m.Row()
-		msg := fmt.Sprintf("Message %d/%d SUCCESS - %d bytes, Type: %s", i+1, len(messages), len(row), m.Type.String())
+		r.totals.completed(outcome, answered, resp, latency)
+		if answered {
+			switch {
+			case resp.CopyIn:
+				q := m
+				copyQuery = &q
+			case copyQuery != nil && m.Type.IsCopyStream():
+				r.totals.check(*copyQuery, resp)
+				copyQuery = nil
+			default:
+				r.totals.check(m, resp)
+			}
+		}
+		var respErr error
+		for _, e := range resp.Errors {
+			logger.Warn("target returned error", "client", m.ClientAddr(), "idx", i+1, "error", e)
+		}
+		if len(resp.Errors) > 0 {
+			respErr = resp.Errors[0]
+		}
+		if trace != nil {
+			trace.Message(m, len(row), sent, time.Since(sent), respErr)
+		}
+		status := "SUCCESS"
+		if respErr != nil {
+			status = "ERROR"
+		}
+		msg := fmt.Sprintf("client=%s idx=%d Message %d/%d %s - %d bytes, Type: %s",
+			m.ClientAddr(), i+1, i+1, len(messages), status, len(row), m.Type.String())
+		if config.PrintQuery && answered {
+			msg += fmt.Sprintf(", latency: %v", latency)
+		}
 		if config.PrintQuery && m.Type.IsSimpleQuery() {
 			msg += fmt.Sprintf(
 				", QUERY: %s", m.PrettyQuery(),
 			)
 		}
-		fmt.Println(msg)
+		fmt.Fprintln(config.output(), msg)
+	}
+
+	if conn != nil && config.FinalizeTransactions != "" && (txStatus == 'T' || txStatus == 'E') {
+		if err := finalizeTransaction(conn, config.FinalizeTransactions, readyTimeout, logger); err != nil {
+			r.totals.failed()
+			logger.Error("finalize open transaction failed", "err", err)
+		}
 	}
 
 	if conn != nil {
-		if err := conn.Close(); err != nil {
+		if err := closeConn(conn, trace); err != nil {
 			if strings.Contains(err.Error(), "use of closed network connection") {
 			} else {
-				log.Printf("Error closing connection: %v", err)
+				logger.Warn("close connection failed", "err", err)
 			}
 		}
 	}
-
-	total := time.Since(replayStart)
-	fmt.Fprintf(os.Stdout, "Replay completed: %d messages, %d successful, %d errors, total time: %v\n",
-		len(messages), successCount, errorCount, total)
-	if errorCount > 0 {
-		return fmt.Errorf("replay completed with %d errors", errorCount)
-	}
 	return nil
 }
@@ -0,0 +1,394 @@
+package replay
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"trafRep/internal/stream"
+	msgtypes "trafRep/internal/stream/message_types"
+)
+
+var testStart = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func quietLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// serverFrame собирает серверное сообщение с байтом типа typ и телом body.
+func serverFrame(typ byte, body string) []byte {
+	b := make([]byte, 5, 5+len(body))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:5], uint32(4+len(body)))
+	return append(b, body...)
+}
+
+// clientMessage собирает клиентское сообщение сессии streamID с меткой времени ts.
+func clientMessage(typ msgtypes.ClientMessageType, body, streamID string, ts time.Time) stream.PostgreSQLMessage {
+	return stream.PostgreSQLMessage{
+		FirstTCPPacketTimestamp: ts,
+		LastTCPPacketTimestamp:  ts,
+		Type:                    typ,
+		Len:                     uint32(4 + len(body)),
+		Payload:                 []byte(body),
+		StreamID:                streamID,
+		ClientIP:                "10.0.0.7",
+		ClientPort:              40000,
+	}
+}
+
+// fakeTarget — цель воспроизведения для тестов: принимает соединения, запоминает типы
+// полученных сообщений и отвечает на них функцией answer (по умолчанию answerReady).
+type fakeTarget struct {
+	ln     net.Listener
+	answer func(typ byte, body []byte) []byte
+
+	mu       sync.Mutex
+	received []byte
+	conns    int
+}
+
+// answerReady отвечает как сервер: на простой запрос — CommandComplete и ReadyForQuery,
+// на Parse, Bind и Execute — ParseComplete, BindComplete и CommandComplete, на Sync —
+// ReadyForQuery. Остальные сообщения остаются без ответа.
+func answerReady(typ byte, body []byte) []byte {
+	switch typ {
+	case 'Q':
+		return append(serverFrame('C', "SELECT 1\x00"), serverFrame('Z', "I")...)
+	case 'P':
+		return serverFrame('1', "")
+	case 'B':
+		return serverFrame('2', "")
+	case 'E':
+		return serverFrame('C', "SELECT 1\x00")
+	case 'S':
+		return serverFrame('Z', "I")
+	}
+	return nil
+}
+
+func startFakeTarget(t *testing.T, answer func(typ byte, body []byte) []byte) *fakeTarget {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer == nil {
+		answer = answerReady
+	}
+	ft := &fakeTarget{ln: ln, answer: answer}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			ft.mu.Lock()
+			ft.conns++
+			ft.mu.Unlock()
+			go ft.serve(conn)
+		}
+	}()
+	return ft
+}
+
+func (ft *fakeTarget) serve(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header[1:5])-4)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		ft.mu.Lock()
+		ft.received = append(ft.received, header[0])
+		ft.mu.Unlock()
+		if reply := ft.answer(header[0], body); len(reply) > 0 {
+			if _, err := conn.Write(reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// receivedTypes возвращает типы полученных целью сообщений строкой, дождавшись n
+// сообщений: последнее сообщение воспроизведение отправляет без ожидания ответа.
+func (ft *fakeTarget) receivedTypes(n int) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ft.mu.Lock()
+		got := string(ft.received)
+		ft.mu.Unlock()
+		if len(got) >= n || time.Now().After(deadline) {
+			return got
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// config возвращает Config воспроизведения на цель без пауз и вывода в stdout.
+func (ft *fakeTarget) config() Config {
+	addr := ft.ln.Addr().(*net.TCPAddr)
+	return Config{
+		TargetHost:  addr.IP.String(),
+		TargetPort:  addr.Port,
+		Rate:        1,
+		MaxRetries:  1,
+		ReadTimeout: 5 * time.Second,
+		Quiet:       true,
+		Logger:      quietLogger(),
+	}
+}
+
+func TestReplayKeepsPipelineOrder(t *testing.T) {
+	ft := startFakeTarget(t, nil)
+
+	// сообщения сгруппированы по сессиям, как их возвращает сборка потоков до сортировки;
+	// у сообщений конвейеров сессии a одинаковые метки, а между ними идут запросы сессии b
+	var a, b []stream.PostgreSQLMessage
+	var want strings.Builder
+	for i := range 3 {
+		ts := testStart.Add(time.Duration(2*i) * time.Millisecond)
+		for range 3 {
+			a = append(a,
+				clientMessage(msgtypes.MessageTypeParse, "\x00select 1\x00\x00\x00", "a", ts),
+				clientMessage(msgtypes.MessageTypeBind, "\x00\x00\x00\x00\x00\x00\x00\x00", "a", ts),
+				clientMessage(msgtypes.MessageTypeExecute, "\x00\x00\x00\x00\x00", "a", ts),
+				clientMessage(msgtypes.MessageTypeSync, "", "a", ts),
+			)
+			want.WriteString("PBES")
+		}
+		b = append(b, clientMessage(msgtypes.MessageTypeQuery, "select 0\x00", "b", ts.Add(time.Millisecond)))
+		want.WriteString("Q")
+	}
+	messages := append(a, b...)
+
+	if _, err := ReplayMessages(context.Background(), messages, ft.config()); err != nil {
+		t.Fatal(err)
+	}
+	if got := ft.receivedTypes(len(messages)); got != want.String() {
+		t.Errorf("target received %s, want %s", got, want.String())
+	}
+}
+
+// lengthOnlyFrame собирает серверное сообщение без байта типа.
+func lengthOnlyFrame(body string) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(4+len(body)))
+	return append(b, body...)
+}
+
+func TestSplitServerFrame(t *testing.T) {
+	typed := serverFrame('C', "SELECT 1\x00")
+	lengthOnly := lengthOnlyFrame("\x01\x02")
+	tests := []struct {
+		name    string
+		buf     []byte
+		typ     byte
+		body    string
+		total   int
+		wantErr bool
+	}{
+		{"empty", nil, 0, "", 0, false},
+		{"typed", typed, 'C', "SELECT 1\x00", len(typed), false},
+		{"typed with tail", append(append([]byte{}, typed...), 'Z'), 'C', "SELECT 1\x00", len(typed), false},
+		{"typed header only", typed[:3], 0, "", 0, false},
+		{"typed truncated", typed[:len(typed)-1], 0, "", 0, false},
+		{"digit type", serverFrame('2', ""), '2', "", 5, false},
+		{"length-only", lengthOnly, 0, "\x01\x02", len(lengthOnly), false},
+		{"length-only truncated", lengthOnly[:5], 0, "", 0, false},
+		{"typed bad length", []byte{'C', 0, 0, 0, 3}, 0, "", 0, true},
+		{"length-only bad length", []byte{0, 0, 0, 2}, 0, "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typ, body, total, err := splitServerFrame(tt.buf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if typ != tt.typ || string(body) != tt.body || total != tt.total {
+				t.Errorf("got (%q, %q, %d), want (%q, %q, %d)", typ, body, total, tt.typ, tt.body, tt.total)
+			}
+		})
+	}
+}
+
+func TestWaitForReadyMixedFraming(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	var reply []byte
+	reply = append(reply, lengthOnlyFrame("\x00\x01")...)
+	reply = append(reply, serverFrame('1', "")...)
+	reply = append(reply, serverFrame('2', "")...)
+	reply = append(reply, serverFrame('C', "INSERT 0 1\x00")...)
+	reply = append(reply, lengthOnlyFrame("")...)
+	reply = append(reply, serverFrame('Z', "T")...)
+	go func() {
+		// по байту: каждое сообщение заканчивается ровно на границе прочитанного
+		for i := range reply {
+			if _, err := server.Write(reply[i : i+1]); err != nil {
+				return
+			}
+		}
+	}()
+
+	resp, err := waitForReady(context.Background(), client, 5*time.Second, false, quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.LastCommandTag() != "INSERT 0 1" || resp.TxStatus != 'T' {
+		t.Errorf("got tag %q, status %q", resp.LastCommandTag(), resp.TxStatus)
+	}
+}
+
+func TestWaitForReadyRejectsCorruptLength(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() { _, _ = server.Write([]byte{0, 0, 0, 1, 'Z', 0, 0, 0, 5, 'I'}) }()
+
+	if _, err := waitForReady(context.Background(), client, 5*time.Second, false, quietLogger()); err == nil {
+		t.Fatal("waitForReady accepted a length-only frame shorter than its header")
+	}
+}
+
+func TestWaitForReadyTimesOut(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	// сервер отвечает CommandComplete, но ReadyForQuery не присылает
+	go func() { _, _ = server.Write(serverFrame('C', "SELECT 1\x00")) }()
+
+	start := time.Now()
+	_, err := waitForReady(context.Background(), client, 200*time.Millisecond, false, quietLogger())
+	if err == nil || !strings.Contains(err.Error(), "timeout waiting ReadyForQuery") {
+		t.Fatalf("err = %v, want a ReadyForQuery timeout", err)
+	}
+	// срабатывание не позже следующего опроса после таймаута
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond+2*readPollInterval {
+		t.Errorf("timeout reported after %v", elapsed)
+	}
+}
+
+func TestReplayReadTimeoutFailsMessage(t *testing.T) {
+	ft := startFakeTarget(t, func(typ byte, body []byte) []byte {
+		// на простой запрос — только CommandComplete: цель «зависла» до ReadyForQuery
+		return serverFrame('C', "SELECT 1\x00")
+	})
+	messages := []stream.PostgreSQLMessage{
+		clientMessage(msgtypes.MessageTypeQuery, "select pg_sleep(60)\x00", "a", testStart),
+		clientMessage(msgtypes.MessageTypeTerminate, "", "a", testStart),
+	}
+	config := ft.config()
+	config.ReadTimeout = 100 * time.Millisecond
+	report, err := ReplayMessages(context.Background(), messages, config)
+	if err == nil {
+		t.Fatal("replay succeeded without ReadyForQuery")
+	}
+	if report == nil || len(report.Messages) == 0 || !strings.Contains(report.Messages[0].Error, "timeout waiting ReadyForQuery") {
+		t.Errorf("report = %+v, want the query failed by timeout", report)
+	}
+}
+
+func TestReplayChecksCopyExpectationAfterCopyDone(t *testing.T) {
+	ft := startFakeTarget(t, answerCopy)
+
+	ts := testStart
+	messages := []stream.PostgreSQLMessage{
+		clientMessage(msgtypes.MessageTypeQuery, "copy t from stdin\x00", "a", ts),
+		clientMessage(msgtypes.MessageTypeCopyData, "1\n", "a", ts),
+		clientMessage(msgtypes.MessageTypeCopyData, "2\n", "a", ts),
+		clientMessage(msgtypes.MessageTypeCopyDone, "", "a", ts),
+		clientMessage(msgtypes.MessageTypeQuery, "select 1\x00", "a", ts),
+	}
+	config := ft.config()
+	// тег COPY приходит только в ответ на CopyDone
+	config.Expectations = []Expectation{{Query: stream.Fingerprint("copy t from stdin"), Tag: "COPY 2"}}
+	if _, err := ReplayMessages(context.Background(), messages, config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPaceTime(t *testing.T) {
+	start := time.Now()
+	m := clientMessage(msgtypes.MessageTypeQuery, "select 1\x00", "a", testStart.Add(100*time.Millisecond))
+	for _, tt := range []struct {
+		rate float64
+		want time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 50 * time.Millisecond},
+		{0.5, 200 * time.Millisecond},
+	} {
+		if got := paceTime(start, testStart, m, tt.rate).Sub(start); got != tt.want {
+			t.Errorf("rate %v: offset %v, want %v", tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestReplayPacesMessages(t *testing.T) {
+	// исходные запросы идут через 100 мс: при Rate 1 воспроизведение занимает не меньше
+	// 200 мс, при Rate 10 — около 20 мс
+	for _, perStream := range []bool{false, true} {
+		for _, tt := range []struct {
+			rate     float64
+			min, max time.Duration
+		}{
+			{1, 200 * time.Millisecond, time.Second},
+			{10, 20 * time.Millisecond, 150 * time.Millisecond},
+		} {
+			ft := startFakeTarget(t, nil)
+			messages := []stream.PostgreSQLMessage{
+				clientMessage(msgtypes.MessageTypeQuery, "select 1\x00", "a", testStart),
+				clientMessage(msgtypes.MessageTypeQuery, "select 2\x00", "b", testStart.Add(100*time.Millisecond)),
+				clientMessage(msgtypes.MessageTypeQuery, "select 3\x00", "a", testStart.Add(200*time.Millisecond)),
+			}
+			config := ft.config()
+			config.Rate = tt.rate
+			config.PerStream = perStream
+
+			start := time.Now()
+			if _, err := ReplayMessages(context.Background(), messages, config); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed < tt.min || elapsed > tt.max {
+				t.Errorf("per-stream %v, rate %v: replay took %v, want %v..%v", perStream, tt.rate, elapsed, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+func TestProgressTotalSkipsCapturedStartup(t *testing.T) {
+	messages := []stream.PostgreSQLMessage{
+		clientMessage(msgtypes.ClientMessageTypeOnlyLength, "\x00\x03\x00\x00user\x00app\x00\x00", "a", testStart),
+		clientMessage(msgtypes.MessageTypePasswordMessage, "secret\x00", "a", testStart),
+		clientMessage(msgtypes.MessageTypeQuery, "select 1\x00", "a", testStart),
+		clientMessage(msgtypes.MessageTypeTerminate, "", "a", testStart),
+	}
+	for _, tt := range []struct {
+		user  string
+		loops int
+		want  int
+	}{
+		{"", 1, 4},
+		{"replayer", 1, 2},
+		{"replayer", 3, 6},
+		{"replayer", -1, -1},
+	} {
+		config := Config{User: tt.user, Loops: tt.loops}
+		if got := progressTotal(messages, config); got != tt.want {
+			t.Errorf("user %q, loops %d: total %d, want %d", tt.user, tt.loops, got, tt.want)
+		}
+	}
+}
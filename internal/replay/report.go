@@ -0,0 +1,58 @@
+package replay
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// ReplayReport — итоги воспроизведения для программного использования (например, в тестовых
+// стендах или для вывода в JSON). При Config.Loops > 1 счётчики суммируются по всем
+// проходам, а Messages содержит исходы каждого прохода подряд.
+type ReplayReport struct {
+	Total              int           `json:"total"`
+	Successful         int           `json:"successful"`
+	Errors             int           `json:"errors"`
+	Skipped            int           `json:"skipped"`
+	Loops              int           `json:"loops"`
+	Elapsed            time.Duration `json:"elapsed_ns"`
+	ExpectationsFailed int           `json:"expectations_failed,omitempty"`
+	// ValidationMismatches — число ответов цели, разошедшихся с захватом (Config.Validate).
+	ValidationMismatches int `json:"validation_mismatches,omitempty"`
+	// Interrupted — воспроизведение остановлено отменой контекста, отчёт частичный.
+	Interrupted bool             `json:"interrupted,omitempty"`
+	Messages    []MessageOutcome `json:"messages"`
+}
+
+// MessageOutcome — исход отправки одного сообщения. Index — номер сообщения (с 1) в
+// последовательности, воспроизводимой на одном соединении (как idx в логе): при PerStream
+// и в режиме пула — внутри исходной сессии Stream. Bytes — размер отправленных байт.
+// Latency задан, только если ответ цели дочитан до ReadyForQuery; Error пуст для
+// успешного сообщения.
+type MessageOutcome struct {
+	Index   int           `json:"index"`
+	Stream  string        `json:"stream"`
+	Type    string        `json:"type"`
+	Bytes   int           `json:"bytes"`
+	Latency time.Duration `json:"latency_ns,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	// Mismatch — расхождение ответа цели с захватом при Config.Validate.
+	Mismatch string `json:"mismatch,omitempty"`
+}
+
+// output возвращает поток для человекочитаемого вывода: stdout или io.Discard при Quiet.
+func (c Config) output() io.Writer {
+	if c.Quiet {
+		return io.Discard
+	}
+	return os.Stdout
+}
+
+// statsOutput возвращает поток для снимков StatsInterval: stdout, а при Quiet — stderr,
+// чтобы не смешивать их с машиночитаемым отчётом.
+func (c Config) statsOutput() io.Writer {
+	if c.Quiet {
+		return os.Stderr
+	}
+	return os.Stdout
+}
@@ -0,0 +1,72 @@
+package replay
+
+import (
+	"bytes"
+	"fmt"
+
+	"trafRep/internal/stream"
+	msgtypes "trafRep/internal/stream/message_types"
+)
+
+// statementRewriter переименовывает подготовленные операторы и порталы в сообщениях
+// расширенного протокола так, чтобы имена из разных исходных сессий не пересекались
+// на общем целевом соединении. Имя "s1" из потока с порядковым номером 3 становится "s1_r3".
+// Безымянные оператор и портал ("") не переименовываются.
+type statementRewriter struct {
+	streams map[string]int
+}
+
+func newStatementRewriter() *statementRewriter {
+	return &statementRewriter{streams: make(map[string]int)}
+}
+
+// rewrite возвращает копию m с переименованными полями имён. Сообщения, не содержащие
+// имён операторов или порталов, и сообщения с повреждённым payload возвращаются без изменений.
+func (r *statementRewriter) rewrite(m stream.PostgreSQLMessage) stream.PostgreSQLMessage {
+	var names int
+	offset := 0
+	switch m.Type {
+	case msgtypes.MessageTypeParse, msgtypes.MessageTypeExecute:
+		names = 1
+	case msgtypes.MessageTypeBind:
+		names = 2
+	case msgtypes.MessageTypeDescribe, msgtypes.MessageTypeClose:
+		names, offset = 1, 1
+	default:
+		return m
+	}
+	if len(m.Payload) < offset {
+		return m
+	}
+
+	suffix := r.suffix(m.StreamID)
+	payload := make([]byte, 0, len(m.Payload)+names*len(suffix))
+	payload = append(payload, m.Payload[:offset]...)
+	rest := m.Payload[offset:]
+	for i := 0; i < names; i++ {
+		end := bytes.IndexByte(rest, 0)
+		if end < 0 {
+			return m
+		}
+		payload = append(payload, rest[:end]...)
+		if end > 0 {
+			payload = append(payload, suffix...)
+		}
+		payload = append(payload, 0)
+		rest = rest[end+1:]
+	}
+	payload = append(payload, rest...)
+
+	m.Payload = payload
+	m.Len = uint32(4 + len(payload))
+	return m
+}
+
+func (r *statementRewriter) suffix(streamID string) string {
+	id, ok := r.streams[streamID]
+	if !ok {
+		id = len(r.streams) + 1
+		r.streams[streamID] = id
+	}
+	return fmt.Sprintf("_r%d", id)
+}
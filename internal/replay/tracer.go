@@ -0,0 +1,25 @@
+package replay
+
+import (
+	"time"
+
+	"trafRep/internal/stream"
+)
+
+// Tracer получает события воспроизведения для экспорта во внешнюю систему трассировки.
+// StartConnection вызывается при каждом новом подключении к цели и возвращает трассу
+// этого соединения. С PerStream и в режиме пула соединения воспроизводятся параллельно,
+// поэтому StartConnection может вызываться одновременно из разных горутин.
+type Tracer interface {
+	StartConnection(target string) ConnectionTrace
+	// Close завершает корневой span и сбрасывает накопленные данные экспортёру.
+	Close() error
+}
+
+// ConnectionTrace — трасса одного соединения с целью: Message вызывается после отправки
+// сообщения и получения ответа, End — при закрытии соединения. Методы одной трассы
+// не вызываются одновременно.
+type ConnectionTrace interface {
+	Message(m stream.PostgreSQLMessage, bytes int, start time.Time, latency time.Duration, err error)
+	End()
+}
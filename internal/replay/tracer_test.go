@@ -0,0 +1,92 @@
+package replay
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"trafRep/internal/stream"
+	msgtypes "trafRep/internal/stream/message_types"
+)
+
+// recordingTracer считает соединения и сообщения; endedAtClose — сколько трасс соединений
+// было завершено к вызову Close.
+type recordingTracer struct {
+	mu           sync.Mutex
+	started      int
+	ended        int
+	messages     int
+	endedAtClose int
+}
+
+type recordingConn struct {
+	t     *recordingTracer
+	ended bool
+}
+
+func (rt *recordingTracer) StartConnection(string) ConnectionTrace {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.started++
+	return &recordingConn{t: rt}
+}
+
+func (rt *recordingTracer) Close() error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.endedAtClose = rt.ended
+	return nil
+}
+
+func (c *recordingConn) Message(stream.PostgreSQLMessage, int, time.Time, time.Duration, error) {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+	c.t.messages++
+}
+
+func (c *recordingConn) End() {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+	if !c.ended {
+		c.ended = true
+		c.t.ended++
+	}
+}
+
+func TestTracerConnectionsEndedOnClose(t *testing.T) {
+	tests := []struct {
+		name        string
+		setup       func(*Config)
+		connections int
+	}{
+		{"single connection", func(*Config) {}, 1},
+		{"per stream", func(c *Config) { c.PerStream = true }, 2},
+		{"pool", func(c *Config) { c.PoolSize = 2 }, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ft := startFakeTarget(t, nil)
+			messages := []stream.PostgreSQLMessage{
+				clientMessage(msgtypes.MessageTypeQuery, "select 1\x00", "a", testStart),
+				clientMessage(msgtypes.MessageTypeQuery, "select 2\x00", "b", testStart),
+				clientMessage(msgtypes.MessageTypeQuery, "select 3\x00", "a", testStart.Add(time.Millisecond)),
+			}
+			tracer := &recordingTracer{}
+			config := ft.config()
+			config.Tracer = tracer
+			tt.setup(&config)
+			if _, err := ReplayMessages(context.Background(), messages, config); err != nil {
+				t.Fatal(err)
+			}
+			tracer.mu.Lock()
+			defer tracer.mu.Unlock()
+			if tracer.started != tt.connections || tracer.endedAtClose != tt.connections {
+				t.Errorf("started %d connections, %d ended before Close; want %d", tracer.started, tracer.endedAtClose, tt.connections)
+			}
+			if tracer.messages != len(messages) {
+				t.Errorf("traced %d messages, want %d", tracer.messages, len(messages))
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package replay
+
+import (
+	"fmt"
+	"strings"
+
+	"trafRep/internal/stream"
+)
+
+// compareResponse сравнивает ответ цели resp с ответом, который сервер дал в захвате на
+// сообщения unit — последовательность, завершённую сообщением с ответом ReadyForQuery
+// (простой запрос или конвейер расширенного протокола до Sync): наличие ошибки и её SQLSTATE,
+// теги CommandComplete (с числом строк). Возвращает описание первого расхождения или
+// пустую строку. ok == false, если ответ в захват не попал и сравнивать не с чем.
+func compareResponse(unit []stream.PostgreSQLMessage, resp serverResponse) (mismatch string, ok bool) {
+	last := unit[len(unit)-1]
+	if last.ReadyForQueryTimestamp.IsZero() {
+		return "", false
+	}
+
+	captured := last.ResponseError
+	switch {
+	case captured == nil && len(resp.Errors) > 0:
+		return fmt.Sprintf("target returned %s, capture succeeded", resp.Errors[0]), true
+	case captured != nil && len(resp.Errors) == 0:
+		return fmt.Sprintf("target succeeded, capture returned %s", captured), true
+	case captured != nil && captured.Code != resp.Errors[0].Code:
+		return fmt.Sprintf("error %s, captured %s", resp.Errors[0].Code, captured.Code), true
+	}
+
+	var tags []string
+	for _, m := range unit {
+		if m.CommandTag != "" {
+			tags = append(tags, strings.Split(m.CommandTag, "; ")...)
+		}
+	}
+	if len(tags) != len(resp.CommandTags) {
+		return fmt.Sprintf("%d commands completed, captured %d", len(resp.CommandTags), len(tags)), true
+	}
+	for i, tag := range tags {
+		if resp.CommandTags[i] != tag {
+			return fmt.Sprintf("tag %q, captured %q", resp.CommandTags[i], tag), true
+		}
+	}
+	return "", true
+}
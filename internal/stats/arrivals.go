@@ -0,0 +1,78 @@
+// Package stats считает распределения по собранным сообщениям для команд print, stats и export.
+package stats
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"trafRep/internal/stream"
+)
+
+// maxBuckets ограничивает число интервалов: слишком мелкий шаг на долгом захвате дал бы
+// миллионы пустых строк.
+const maxBuckets = 1_000_000
+
+const barWidth = 40
+
+// Bucket — число сообщений, первый пакет которых пришёл в интервал [Start, Start+ширина).
+type Bucket struct {
+	Start time.Time `json:"bucket_start"`
+	Count int       `json:"count"`
+}
+
+// ArrivalHistogram раскладывает messages по интервалам ширины width по
+// FirstTCPPacketTimestamp. Границы интервалов кратны width; пустые интервалы между первым
+// и последним сообщением сохраняются, чтобы паузы в нагрузке были видны так же, как всплески.
+func ArrivalHistogram(messages []stream.PostgreSQLMessage, width time.Duration) ([]Bucket, error) {
+	if width <= 0 {
+		return nil, fmt.Errorf("bucket width must be positive, got %v", width)
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	first, last := messages[0].FirstTCPPacketTimestamp, messages[0].FirstTCPPacketTimestamp
+	for _, m := range messages[1:] {
+		if m.FirstTCPPacketTimestamp.Before(first) {
+			first = m.FirstTCPPacketTimestamp
+		}
+		if m.FirstTCPPacketTimestamp.After(last) {
+			last = m.FirstTCPPacketTimestamp
+		}
+	}
+	start := first.Truncate(width)
+	n := int64(last.Sub(start)/width) + 1
+	if n > maxBuckets {
+		return nil, fmt.Errorf("bucket width %v splits %v of traffic into %d buckets (max %d)", width, last.Sub(first), n, maxBuckets)
+	}
+
+	buckets := make([]Bucket, n)
+	for i := range buckets {
+		buckets[i].Start = start.Add(time.Duration(i) * width)
+	}
+	for _, m := range messages {
+		buckets[m.FirstTCPPacketTimestamp.Sub(start)/width].Count++
+	}
+	return buckets, nil
+}
+
+// WriteHistogram печатает buckets ASCII-гистограммой: строка на интервал с его началом,
+// полосой, пропорциональной числу сообщений относительно самого заполненного интервала,
+// и самим числом.
+func WriteHistogram(w io.Writer, buckets []Bucket) {
+	peak := 0
+	for _, b := range buckets {
+		peak = max(peak, b.Count)
+	}
+	for _, b := range buckets {
+		bar := 0
+		if peak > 0 {
+			bar = b.Count * barWidth / peak
+		}
+		if b.Count > 0 && bar == 0 {
+			bar = 1
+		}
+		fmt.Fprintf(w, "  %s | %-*s %d\n", b.Start.Format("2006-01-02 15:04:05.000"), barWidth, strings.Repeat("█", bar), b.Count)
+	}
+}
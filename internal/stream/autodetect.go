@@ -0,0 +1,152 @@
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+
+	"trafRep/internal/pcap"
+)
+
+// maxUndetectedPackets — сколько пакетов потока придерживается, пока не ясно, какая
+// сторона сервер. Если сервер так и не найден, пакеты сверх лимита отбрасываются.
+const maxUndetectedPackets = 1024
+
+const (
+	// maxStartupPacketSize — предел длины startup-пакета в PostgreSQL (MAX_STARTUP_PACKET_LENGTH).
+	maxStartupPacketSize = 10000
+	// maxAuthRequestCode — наибольший код AuthenticationRequest (AuthenticationSASLFinal).
+	maxAuthRequestCode = 12
+)
+
+// endpoint — адрес одной стороны TCP-потока.
+type endpoint struct {
+	ip   string
+	port uint16
+}
+
+func (e endpoint) String() string {
+	return fmt.Sprintf("%s:%d", e.ip, e.port)
+}
+
+// serverDetector определяет сервер каждого TCP-потока по содержимому: сторона, приславшая
+// AuthenticationRequest ('R') или ReadyForQuery ('Z'), — сервер; сторона, приславшая
+// StartupMessage, SSLRequest или GSSENCRequest, — клиент. Пока сторона не определена,
+// пакеты потока придерживаются и после определения отдаются в исходном порядке.
+type serverDetector struct {
+	servers map[string]endpoint
+	pending map[string][]pcap.TCPPacket
+	dropped map[string]int
+	logger  *slog.Logger
+}
+
+func newServerDetector(logger *slog.Logger) *serverDetector {
+	return &serverDetector{
+		servers: make(map[string]endpoint),
+		pending: make(map[string][]pcap.TCPPacket),
+		dropped: make(map[string]int),
+		logger:  logger,
+	}
+}
+
+// detectedPacket — пакет с определённым сервером своего потока.
+type detectedPacket struct {
+	pcap.TCPPacket
+	server endpoint
+}
+
+// feed принимает пакет и возвращает пакеты, для которых сервер уже известен:
+// сам pkt или, в момент определения, все придержанные пакеты потока вместе с ним.
+func (d *serverDetector) feed(pkt pcap.TCPPacket) []detectedPacket {
+	src := endpoint{pkt.IPSource, pkt.PortSource}
+	dst := endpoint{pkt.IPDest, pkt.PortDest}
+	flow := flowKey(src, dst)
+
+	server, ok := d.servers[flow]
+	if !ok {
+		switch classifyPayload(pkt.Data) {
+		case sideServer:
+			server, ok = src, true
+		case sideClient:
+			server, ok = dst, true
+		}
+		if !ok {
+			if len(d.pending[flow]) >= maxUndetectedPackets {
+				d.dropped[flow]++
+				return nil
+			}
+			d.pending[flow] = append(d.pending[flow], pkt)
+			return nil
+		}
+		d.servers[flow] = server
+		d.logger.Debug("auto-detect: server found", "flow", flow, "server", server.String())
+	}
+
+	held := d.pending[flow]
+	delete(d.pending, flow)
+	out := make([]detectedPacket, 0, len(held)+1)
+	for _, p := range held {
+		out = append(out, detectedPacket{TCPPacket: p, server: server})
+	}
+	return append(out, detectedPacket{TCPPacket: pkt, server: server})
+}
+
+// finish сообщает о потоках, сервер которых так и не определился.
+func (d *serverDetector) finish() {
+	for flow, held := range d.pending {
+		d.logger.Warn("auto-detect: server not detected, packets ignored", "flow", flow, "packets", len(held)+d.dropped[flow])
+	}
+}
+
+// flowKey — ключ потока, не зависящий от направления пакета.
+func flowKey(a, b endpoint) string {
+	if a.String() > b.String() {
+		a, b = b, a
+	}
+	return a.String() + "<->" + b.String()
+}
+
+type side int
+
+const (
+	sideUnknown side = iota
+	sideClient
+	sideServer
+)
+
+// classifyPayload определяет по данным сегмента, кто его отправил. Сервер узнаётся по
+// цепочке типизированных сообщений, содержащей AuthenticationRequest или ReadyForQuery
+// (клиент таких типов не отправляет), клиент — по StartupMessage, SSLRequest или GSSENCRequest.
+func classifyPayload(data []byte) side {
+	if len(data) >= 8 {
+		size := binary.BigEndian.Uint32(data[0:4])
+		code := binary.BigEndian.Uint32(data[4:8])
+		if size >= 8 && size <= maxStartupPacketSize &&
+			(code == ProtocolVersion3 || code == SSLRequestCode || code == GSSENCRequestCode) {
+			return sideClient
+		}
+	}
+
+	for off := 0; off+5 <= len(data); {
+		typ := data[off]
+		if !(typ >= 'A' && typ <= 'Z') && !(typ >= 'a' && typ <= 'z') {
+			break
+		}
+		size := binary.BigEndian.Uint32(data[off+1 : off+5])
+		if size < 4 {
+			break
+		}
+		switch {
+		case typ == 'Z' && size == 5 && off+6 <= len(data):
+			if status := data[off+5]; status == 'I' || status == 'T' || status == 'E' {
+				return sideServer
+			}
+		case typ == 'R' && size >= 8 && off+9 <= len(data):
+			if binary.BigEndian.Uint32(data[off+5:off+9]) <= maxAuthRequestCode {
+				return sideServer
+			}
+		}
+		off += 1 + int(size)
+	}
+	return sideUnknown
+}
@@ -0,0 +1,123 @@
+package stream
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// readKeywords — ведущие ключевые слова запросов, которые можно выполнить на реплике.
+// Всё остальное (DML, DDL, управление транзакциями, SET и т.д.) считается записью.
+var readKeywords = map[string]bool{
+	"SELECT":  true,
+	"WITH":    true,
+	"SHOW":    true,
+	"EXPLAIN": true,
+	"VALUES":  true,
+	"TABLE":   true,
+}
+
+// cteWriteKeywords — операторы, с которыми WITH модифицирует данные в одном из
+// подзапросов или в основном запросе.
+var cteWriteKeywords = map[string]bool{
+	"INSERT": true,
+	"UPDATE": true,
+	"DELETE": true,
+	"MERGE":  true,
+}
+
+// IsWriteQuery сообщает, что запрос нужно выполнять на primary. Классификация идёт
+// по ведущему ключевому слову (после пробелов, комментариев и открывающих скобок);
+// запрос чтения всё же считается записью, если это WITH с INSERT, UPDATE, DELETE или
+// MERGE либо в нём есть блокировка строк (FOR UPDATE, FOR NO KEY UPDATE, FOR SHARE,
+// FOR KEY SHARE). Слова внутри литералов, идентификаторов в кавычках и комментариев
+// не учитываются. Запрос из нескольких операторов (см. SplitStatements) считается
+// записью, если запись хотя бы один из них. Пустой или нераспознанный запрос считается
+// записью.
+func IsWriteQuery(sql string) bool {
+	read := false
+	for _, stmt := range SplitStatements(sql) {
+		if len(queryWords(stmt)) == 0 {
+			// оператор из одних комментариев
+			continue
+		}
+		if isWriteStatement(stmt) {
+			return true
+		}
+		read = true
+	}
+	return !read
+}
+
+// isWriteStatement классифицирует один оператор по правилам IsWriteQuery.
+func isWriteStatement(sql string) bool {
+	keyword := leadingKeyword(sql)
+	if !readKeywords[keyword] {
+		return true
+	}
+	words := queryWords(sql)
+	for i, w := range words {
+		if keyword == "WITH" && cteWriteKeywords[w] {
+			return true
+		}
+		if (w == "UPDATE" || w == "SHARE") && i > 0 && (words[i-1] == "FOR" || words[i-1] == "KEY") {
+			return true
+		}
+	}
+	return false
+}
+
+// queryWords возвращает слова запроса в верхнем регистре. Запрос сначала нормализуется
+// (см. NormalizeLiterals), поэтому литералы и комментарии слов не дают; идентификаторы
+// в двойных кавычках пропускаются.
+func queryWords(sql string) []string {
+	s := NormalizeLiterals(sql, func(LiteralKind) string { return "?" })
+	var words []string
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == '"':
+			i = quotedEnd(s, i)
+		case unicode.IsLetter(r) || r == '_':
+			end := strings.IndexFunc(s[i:], func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '$'
+			})
+			if end < 0 {
+				end = len(s) - i
+			}
+			words = append(words, strings.ToUpper(s[i:i+end]))
+			i += end
+		default:
+			i += size
+		}
+	}
+	return words
+}
+
+// leadingKeyword возвращает первое слово запроса в верхнем регистре.
+func leadingKeyword(sql string) string {
+	s := sql
+	for {
+		s = strings.TrimLeftFunc(s, func(r rune) bool { return unicode.IsSpace(r) || r == '(' })
+		switch {
+		case strings.HasPrefix(s, "--"):
+			end := strings.IndexByte(s, '\n')
+			if end < 0 {
+				return ""
+			}
+			s = s[end+1:]
+		case strings.HasPrefix(s, "/*"):
+			end := strings.Index(s, "*/")
+			if end < 0 {
+				return ""
+			}
+			s = s[end+2:]
+		default:
+			end := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsLetter(r) })
+			if end < 0 {
+				end = len(s)
+			}
+			return strings.ToUpper(s[:end])
+		}
+	}
+}
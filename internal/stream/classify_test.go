@@ -0,0 +1,53 @@
+package stream
+
+import "testing"
+
+func TestIsWriteQuery(t *testing.T) {
+	tests := []struct {
+		sql   string
+		write bool
+	}{
+		{"select * from users", false},
+		{"  (SELECT 1)", false},
+		{"-- comment\nshow search_path", false},
+		{"explain select 1", false},
+		{"values (1), (2)", false},
+		{"table users", false},
+		{"insert into t values (1)", true},
+		{"UPDATE t SET a = 1", true},
+		{"delete from t", true},
+		{"create table t (a int)", true},
+		{"begin", true},
+		{"", true},
+		{"-- nothing", true},
+
+		{"select 1; update t set a = 1", true},
+		{"SELECT 1; DELETE FROM t;", true},
+		{"select 1; select 2; -- done", false},
+		{"select ';update t set a = 1'", false},
+
+		{"with x as (select 1) select * from x", false},
+		{"with x as (insert into t values (1) returning id) select * from x", true},
+		{"WITH gone AS (DELETE FROM t RETURNING *) SELECT count(*) FROM gone", true},
+		{"with x as (select id from s) update t set a = 1 from x", true},
+		{"with src as (select 1 as id) merge into t using src on t.id = src.id when matched then delete", true},
+
+		{"select * from t for update", true},
+		{"SELECT * FROM t WHERE id = 1 FOR NO KEY UPDATE SKIP LOCKED", true},
+		{"select * from t for share", true},
+		{"select * from t for key share nowait", true},
+		{"with x as (select * from t for update) select * from x", true},
+
+		{"select 'for update' from t", false},
+		{"select $$delete from t$$", false},
+		{"with x as (select 1 /* update */) select * from x -- delete", false},
+		{`with x as (select "delete" from t) select * from x`, false},
+		{`select "for" update from t`, false},
+		{"select updated_at, share_id from t", false},
+	}
+	for _, tt := range tests {
+		if got := IsWriteQuery(tt.sql); got != tt.write {
+			t.Errorf("IsWriteQuery(%q) = %v, want %v", tt.sql, got, tt.write)
+		}
+	}
+}
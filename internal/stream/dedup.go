@@ -0,0 +1,65 @@
+package stream
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// DefaultDedupWindow — максимальная разница во времени между копиями одного пакета,
+// снятыми разными отводами (SPAN-портами), при которой они считаются дубликатами.
+const DefaultDedupWindow = 100 * time.Millisecond
+
+// dedupKey идентифицирует TCP-сегмент: направление, порядковый номер и содержимое.
+type dedupKey struct {
+	ipSrc, ipDst     string
+	portSrc, portDst uint16
+	seq              uint32
+	size             int
+	sum              uint64
+}
+
+// packetDeduper запоминает недавно увиденные сегменты, чтобы отбрасывать их полные копии
+// при слиянии захватов с нескольких отводов. Пакеты должны поступать в порядке времени.
+type packetDeduper struct {
+	window time.Duration
+	seen   map[dedupKey]time.Time
+	pruned time.Time
+}
+
+func newPacketDeduper(window time.Duration) *packetDeduper {
+	if window <= 0 {
+		window = DefaultDedupWindow
+	}
+	return &packetDeduper{window: window, seen: make(map[dedupKey]time.Time)}
+}
+
+// duplicate сообщает, что такой же сегмент уже встречался не раньше чем за window до ts.
+func (d *packetDeduper) duplicate(data []byte, ts time.Time, ipSrc, ipDst string, portSrc, portDst uint16, seq uint32) bool {
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	key := dedupKey{
+		ipSrc: ipSrc, ipDst: ipDst,
+		portSrc: portSrc, portDst: portDst,
+		seq: seq, size: len(data), sum: h.Sum64(),
+	}
+
+	d.prune(ts)
+	if prev, ok := d.seen[key]; ok && ts.Sub(prev) <= d.window {
+		return true
+	}
+	d.seen[key] = ts
+	return false
+}
+
+// prune удаляет записи старше window, не чаще одного раза за window.
+func (d *packetDeduper) prune(ts time.Time) {
+	if ts.Sub(d.pruned) < d.window {
+		return
+	}
+	for k, seen := range d.seen {
+		if ts.Sub(seen) > d.window {
+			delete(d.seen, k)
+		}
+	}
+	d.pruned = ts
+}
@@ -0,0 +1,69 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorResponse — разобранное тело ErrorResponse ('E') или NoticeResponse ('N'):
+// у них одинаковый формат. Неизвестные поля сохраняются в Fields по коду поля.
+type ErrorResponse struct {
+	Severity string // 'S' (локализованная) или 'V' (нелокализованная), если 'S' нет
+	Code     string // 'C', SQLSTATE
+	Message  string // 'M'
+	Detail   string // 'D'
+	Hint     string // 'H'
+	Fields   map[byte]string
+}
+
+// DecodeErrorResponse разбирает тело ErrorResponse или NoticeResponse (без байта типа
+// и поля длины): последовательность пар «байт кода поля, C-строка значения»,
+// завершённая нулевым байтом.
+func DecodeErrorResponse(body []byte) (ErrorResponse, error) {
+	var e ErrorResponse
+	rest := body
+	for {
+		if len(rest) == 0 {
+			return e, errors.New("error response is not zero-terminated")
+		}
+		code := rest[0]
+		if code == 0 {
+			break
+		}
+		val, next, ok := cutCString(rest[1:])
+		if !ok {
+			return e, fmt.Errorf("error response field %q is not null-terminated", code)
+		}
+		rest = next
+		switch code {
+		case 'S':
+			e.Severity = val
+		case 'V':
+			if e.Severity == "" {
+				e.Severity = val
+			}
+		case 'C':
+			e.Code = val
+		case 'M':
+			e.Message = val
+		case 'D':
+			e.Detail = val
+		case 'H':
+			e.Hint = val
+		default:
+			if e.Fields == nil {
+				e.Fields = make(map[byte]string)
+			}
+			e.Fields[code] = val
+		}
+	}
+	return e, nil
+}
+
+// Error возвращает "SEVERITY SQLSTATE: message".
+func (e ErrorResponse) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("%s %s: %s", e.Severity, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Severity, e.Message)
+}
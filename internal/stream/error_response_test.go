@@ -0,0 +1,112 @@
+package stream
+
+import "testing"
+
+func TestDecodeErrorResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want ErrorResponse
+	}{
+		{
+			name: "error",
+			body: "SERROR\x00VERROR\x00C23505\x00Mduplicate key value violates unique constraint \"users_pkey\"\x00" +
+				"DKey (id)=(1) already exists.\x00sbilling\x00tusers\x00nusers_pkey\x00Fnbtinsert.c\x00L664\x00R_bt_check_unique\x00\x00",
+			want: ErrorResponse{
+				Severity: "ERROR",
+				Code:     "23505",
+				Message:  `duplicate key value violates unique constraint "users_pkey"`,
+				Detail:   "Key (id)=(1) already exists.",
+				Fields: map[byte]string{
+					's': "billing", 't': "users", 'n': "users_pkey",
+					'F': "nbtinsert.c", 'L': "664", 'R': "_bt_check_unique",
+				},
+			},
+		},
+		{
+			name: "notice",
+			body: "SNOTICE\x00VNOTICE\x00C00000\x00Mtable \"tmp\" does not exist, skipping\x00HCheck the name.\x00\x00",
+			want: ErrorResponse{
+				Severity: "NOTICE",
+				Code:     "00000",
+				Message:  `table "tmp" does not exist, skipping`,
+				Hint:     "Check the name.",
+			},
+		},
+		{
+			// сервер старше 9.6 не присылает 'V'; локализованная 'S' приоритетнее 'V'
+			name: "localized severity",
+			body: "VERROR\x00SОШИБКА\x00C42P01\x00Mотношение \"t\" не существует\x00\x00",
+			want: ErrorResponse{Severity: "ОШИБКА", Code: "42P01", Message: `отношение "t" не существует`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeErrorResponse([]byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Severity != tt.want.Severity || got.Code != tt.want.Code || got.Message != tt.want.Message ||
+				got.Detail != tt.want.Detail || got.Hint != tt.want.Hint {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if len(got.Fields) != len(tt.want.Fields) {
+				t.Errorf("fields %v, want %v", got.Fields, tt.want.Fields)
+			}
+			for code, v := range tt.want.Fields {
+				if got.Fields[code] != v {
+					t.Errorf("field %q = %q, want %q", code, got.Fields[code], v)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeErrorResponseMalformed(t *testing.T) {
+	for _, body := range []string{
+		"",
+		"SERROR\x00",           // нет завершающего нулевого байта
+		"SERROR\x00MNo termin", // значение не завершено
+	} {
+		if _, err := DecodeErrorResponse([]byte(body)); err == nil {
+			t.Errorf("DecodeErrorResponse(%q) succeeded", body)
+		}
+	}
+}
+
+func TestErrorResponseError(t *testing.T) {
+	e := ErrorResponse{Severity: "ERROR", Code: "42601", Message: "syntax error"}
+	if got := e.Error(); got != "ERROR 42601: syntax error" {
+		t.Errorf("Error() = %q", got)
+	}
+	e.Code = ""
+	if got := e.Error(); got != "ERROR: syntax error" {
+		t.Errorf("Error() without code = %q", got)
+	}
+}
+
+func TestNoticeAndErrorInStream(t *testing.T) {
+	m := newTestManager()
+	c := newTestConn(m)
+	c.client(t, pgQuery("drop table if exists tmp; insert into users values (1)"))
+	c.server(t,
+		pgMessage('N', "SNOTICE\x00C00000\x00Mtable \"tmp\" does not exist, skipping\x00\x00"),
+		pgComplete("DROP TABLE"),
+		pgMessage('E', "SERROR\x00C23505\x00Mduplicate key\x00\x00"),
+		pgReady(),
+	)
+	messages := m.FlushPartial()
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	if e := messages[0].ResponseError; e == nil || e.Code != "23505" {
+		t.Errorf("ResponseError = %+v, want SQLSTATE 23505", e)
+	}
+	notices := m.Notices()
+	if len(notices) != 1 {
+		t.Fatalf("got %d notices, want 1", len(notices))
+	}
+	if notices[0].Response.Severity != "NOTICE" {
+		t.Errorf("notice severity %q, want NOTICE", notices[0].Response.Severity)
+	}
+}
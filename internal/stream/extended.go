@@ -0,0 +1,202 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	msgtypes "trafRep/internal/stream/message_types"
+)
+
+// CloseMessage — декодированное клиентское сообщение Close ('C'): закрытие
+// подготовленного оператора (Kind == 'S') или портала (Kind == 'P').
+type CloseMessage struct {
+	Kind byte
+	Name string
+}
+
+// DecodeClose разбирает payload сообщения Close.
+func DecodeClose(payload []byte) (CloseMessage, error) {
+	if len(payload) < 2 {
+		return CloseMessage{}, fmt.Errorf("close message too short")
+	}
+	kind := payload[0]
+	if kind != 'S' && kind != 'P' {
+		return CloseMessage{}, fmt.Errorf("invalid close kind %q", kind)
+	}
+	name, _, ok := cutCString(payload[1:])
+	if !ok {
+		return CloseMessage{}, fmt.Errorf("close name is not null-terminated")
+	}
+	return CloseMessage{Kind: kind, Name: name}, nil
+}
+
+// Close возвращает декодированное сообщение Close, если m им является.
+func (m PostgreSQLMessage) Close() (CloseMessage, bool) {
+	if m.Type != msgtypes.MessageTypeClose {
+		return CloseMessage{}, false
+	}
+	c, err := DecodeClose(m.Payload)
+	if err != nil {
+		return CloseMessage{}, false
+	}
+	return c, true
+}
+
+// ParseMessage — декодированное клиентское сообщение Parse ('P'): имя подготовленного
+// оператора, его текст и OID типов параметров (0 — тип выводит сервер).
+type ParseMessage struct {
+	Name       string
+	Query      string
+	ParamTypes []uint32
+}
+
+// BindMessage — декодированное клиентское сообщение Bind ('B'). Значение параметра nil
+// означает NULL; форматы: 0 — текстовый, 1 — двоичный.
+type BindMessage struct {
+	Portal        string
+	Statement     string
+	ParamFormats  []int16
+	Params        [][]byte
+	ResultFormats []int16
+}
+
+// ExecuteMessage — декодированное клиентское сообщение Execute ('E').
+// MaxRows == 0 означает «без ограничения».
+type ExecuteMessage struct {
+	Portal  string
+	MaxRows uint32
+}
+
+// DecodeParse разбирает payload сообщения Parse.
+func DecodeParse(payload []byte) (ParseMessage, error) {
+	r := payloadReader{buf: payload}
+	p := ParseMessage{Name: r.cstring(), Query: r.cstring()}
+	n := r.int16()
+	for i := 0; i < int(n) && r.err == nil; i++ {
+		p.ParamTypes = append(p.ParamTypes, r.uint32())
+	}
+	if r.err != nil {
+		return ParseMessage{}, fmt.Errorf("decode parse: %w", r.err)
+	}
+	return p, nil
+}
+
+// DecodeBind разбирает payload сообщения Bind.
+func DecodeBind(payload []byte) (BindMessage, error) {
+	r := payloadReader{buf: payload}
+	b := BindMessage{Portal: r.cstring(), Statement: r.cstring()}
+	n := r.int16()
+	for i := 0; i < int(n) && r.err == nil; i++ {
+		b.ParamFormats = append(b.ParamFormats, r.int16())
+	}
+	n = r.int16()
+	for i := 0; i < int(n) && r.err == nil; i++ {
+		size := int32(r.uint32())
+		if size < 0 {
+			b.Params = append(b.Params, nil)
+			continue
+		}
+		b.Params = append(b.Params, r.bytes(int(size)))
+	}
+	n = r.int16()
+	for i := 0; i < int(n) && r.err == nil; i++ {
+		b.ResultFormats = append(b.ResultFormats, r.int16())
+	}
+	if r.err != nil {
+		return BindMessage{}, fmt.Errorf("decode bind: %w", r.err)
+	}
+	return b, nil
+}
+
+// DecodeExecute разбирает payload сообщения Execute.
+func DecodeExecute(payload []byte) (ExecuteMessage, error) {
+	r := payloadReader{buf: payload}
+	e := ExecuteMessage{Portal: r.cstring(), MaxRows: r.uint32()}
+	if r.err != nil {
+		return ExecuteMessage{}, fmt.Errorf("decode execute: %w", r.err)
+	}
+	return e, nil
+}
+
+// Parse возвращает декодированное сообщение Parse, если m им является.
+func (m PostgreSQLMessage) Parse() (ParseMessage, bool) {
+	if m.Type != msgtypes.MessageTypeParse {
+		return ParseMessage{}, false
+	}
+	p, err := DecodeParse(m.Payload)
+	if err != nil {
+		return ParseMessage{}, false
+	}
+	return p, true
+}
+
+// DecodeExtended декодирует сообщение расширенного протокола в ParseMessage, BindMessage,
+// ExecuteMessage или CloseMessage в зависимости от Type. Для остальных типов возвращает ошибку.
+func (m PostgreSQLMessage) DecodeExtended() (any, error) {
+	switch m.Type {
+	case msgtypes.MessageTypeParse:
+		return DecodeParse(m.Payload)
+	case msgtypes.MessageTypeBind:
+		return DecodeBind(m.Payload)
+	case msgtypes.MessageTypeExecute:
+		return DecodeExecute(m.Payload)
+	case msgtypes.MessageTypeClose:
+		return DecodeClose(m.Payload)
+	default:
+		return nil, fmt.Errorf("message type %s is not an extended query message", m.Type)
+	}
+}
+
+// payloadReader последовательно читает поля payload; первая ошибка запоминается,
+// последующие чтения возвращают нулевые значения.
+type payloadReader struct {
+	buf []byte
+	err error
+}
+
+func (r *payloadReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.buf) {
+		r.err = errors.New("payload truncated")
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *payloadReader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	s, rest, ok := cutCString(r.buf)
+	if !ok {
+		r.err = errors.New("string is not null-terminated")
+		return ""
+	}
+	r.buf = rest
+	return s
+}
+
+func (r *payloadReader) int16() int16 {
+	b := r.take(2)
+	if b == nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(b))
+}
+
+func (r *payloadReader) uint32() uint32 {
+	b := r.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *payloadReader) bytes(n int) []byte {
+	return r.take(n)
+}
@@ -0,0 +1,159 @@
+package stream
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sort"
+
+	"trafRep/internal/pcap"
+)
+
+// Direction ограничивает направления TCP-потока, пакеты которых передаются в сборку.
+type Direction int
+
+const (
+	DirectionBoth Direction = iota
+	DirectionClient
+	DirectionServer
+)
+
+// ExtractOptions — параметры ExtractMessages.
+type ExtractOptions struct {
+	// ServerNets и Ports — адреса (подсети) и порты PostgreSQL-серверов в захвате
+	// (см. pcap.ResolveHost); сервером считается сторона, у которой адрес входит в одну
+	// из ServerNets, а порт — из Ports.
+	ServerNets []*net.IPNet
+	Ports      []uint16
+	// Direction — какие направления собирать; без серверного направления у сообщений
+	// не будет CommandComplete и ReadyForQuery.
+	Direction Direction
+	// AutoDetect определяет сервер каждого потока по содержимому (см. serverDetector)
+	// вместо ServerNets и Ports.
+	AutoDetect      bool
+	Dedup           bool
+	VerifyRoundtrip bool
+	// ServerMessages включает сборку серверных сообщений (см. TCPStreamManager.CollectServer).
+	ServerMessages bool
+	// MaxMessageSize — см. TCPStreamManager.MaxMessageSize; 0 — DefaultMaxMessageSize.
+	MaxMessageSize uint32
+	// SampleRate — см. TCPStreamManager.SampleRate: доля потоков, сообщения которых собираются.
+	SampleRate float64
+	// OnStreamClosed — см. TCPStreamManager.OnStreamClosed: сообщения завершённых клиентом
+	// потоков передаются ему по мере завершения и не входят в результат ExtractMessages.
+	OnStreamClosed func(streamID string, messages []PostgreSQLMessage)
+	// Logger получает диагностику сборки; nil — slog.Default().
+	Logger *slog.Logger
+}
+
+// ExtractMessages передаёт пакеты из packets в новый TCPStreamManager, собирает сообщения
+// (включая незавершённые, см. FlushPartial) и возвращает их отсортированными по времени
+// первого пакета. Менеджер возвращается для статистики: дубликаты, несовпадения
+// round-trip, уведомления и серверные сообщения (отсортированные по времени).
+func ExtractMessages(packets <-chan pcap.TCPPacket, opts ExtractOptions) ([]PostgreSQLMessage, *TCPStreamManager) {
+	manager := NewTCPStreamManager()
+	manager.Dedup = opts.Dedup
+	manager.VerifyRoundtrip = opts.VerifyRoundtrip
+	manager.CollectServer = opts.ServerMessages
+	manager.Logger = opts.Logger
+	manager.OnStreamClosed = opts.OnStreamClosed
+	manager.SampleRate = opts.SampleRate
+	if opts.MaxMessageSize > 0 {
+		manager.MaxMessageSize = opts.MaxMessageSize
+	}
+	logger := manager.logger()
+
+	// принадлежность адреса подсетям запоминается: адресов в захвате немного, а пакетов много
+	servers := make(map[string]bool)
+	isServer := func(ip string) bool {
+		v, ok := servers[ip]
+		if !ok {
+			v = pcap.ContainsIP(opts.ServerNets, net.ParseIP(ip))
+			servers[ip] = v
+		}
+		return v
+	}
+
+	add := func(pkt pcap.TCPPacket, fromServer bool) {
+		switch opts.Direction {
+		case DirectionClient:
+			if fromServer {
+				return
+			}
+		case DirectionServer:
+			if !fromServer {
+				return
+			}
+		}
+		serverIP, serverPort := pkt.IPDest, pkt.PortDest
+		if fromServer {
+			serverIP, serverPort = pkt.IPSource, pkt.PortSource
+		}
+		if err := manager.AddPacket(
+			pkt.Data, pkt.Timestamp, pkt.IPSource, pkt.IPDest, pkt.PortSource, pkt.PortDest, pkt.Seq, serverIP, serverPort,
+		); err != nil {
+			logger.Warn("add packet failed", "err", err)
+		}
+	}
+
+	if opts.AutoDetect {
+		detector := newServerDetector(logger)
+		for pkt := range packets {
+			for _, p := range detector.feed(pkt) {
+				add(p.TCPPacket, p.server == endpoint{p.IPSource, p.PortSource})
+			}
+		}
+		detector.finish()
+	} else {
+		for pkt := range packets {
+			// адресов и портов сервера может быть несколько: направление определяют те, что в пакете
+			add(pkt, slices.Contains(opts.Ports, pkt.PortSource) && isServer(pkt.IPSource))
+		}
+	}
+
+	if opts.Dedup {
+		logger.Info("dropped duplicate packets", "count", manager.DuplicatePackets())
+	}
+
+	if n := manager.SampledOutStreams(); n > 0 {
+		logger.Info("skipped streams outside the sample", "count", n, "sample_rate", opts.SampleRate)
+	}
+
+	messages := manager.FlushPartial()
+	if n := len(manager.EncryptedStreams()); n > 0 {
+		logger.Warn("skipped encrypted streams, their messages are not extracted", "count", n)
+	}
+	// сообщения конвейера (Parse/Bind/Execute/Sync) из одного сегмента имеют одну метку
+	// времени, и их порядок в потоке должен сохраниться
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].FirstTCPPacketTimestamp.Before(messages[j].FirstTCPPacketTimestamp)
+	})
+	// внутри потока порядок серверных сообщений задан потоком, а не метками времени
+	sort.SliceStable(manager.serverMessages, func(i, j int) bool {
+		return manager.serverMessages[i].Timestamp.Before(manager.serverMessages[j].Timestamp)
+	})
+	return messages, manager
+}
+
+// ExtractMessagesFromPcap открывает файл захвата path (pcap, pcapng, в том числе сжатый
+// gzip), отбирает пакеты сервера host:port и возвращает собранные из них сообщения,
+// отсортированные по времени. host — IP-адрес, подсеть CIDR или имя (см. pcap.ResolveHost).
+func ExtractMessagesFromPcap(path, host string, port uint16, dir Direction) ([]PostgreSQLMessage, error) {
+	serverNets, err := pcap.ResolveHost(host)
+	if err != nil {
+		return nil, err
+	}
+	src, err := pcap.OpenFile(path, "")
+	if err != nil {
+		return nil, fmt.Errorf("open pcap %s: %w", path, err)
+	}
+	defer src.Close()
+
+	messages, _ := ExtractMessages(pcap.ExtractPacketsChan(src, serverNets, []uint16{port}, nil), ExtractOptions{
+		ServerNets: serverNets,
+		Ports:      []uint16{port},
+		Direction:  dir,
+	})
+	return messages, nil
+}
@@ -0,0 +1,65 @@
+package stream
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"trafRep/internal/pcap"
+)
+
+func packetsChan(packets []pcap.TCPPacket) <-chan pcap.TCPPacket {
+	ch := make(chan pcap.TCPPacket, len(packets))
+	for _, p := range packets {
+		ch <- p
+	}
+	close(ch)
+	return ch
+}
+
+func TestExtractMessagesKeepsPipelineOrder(t *testing.T) {
+	// в каждом сегменте несколько конвейеров с одной меткой времени; сегменты другого
+	// соединения идут между ними, и сортировке по времени есть что переставлять
+	var pipeline []byte
+	for range 3 {
+		pipeline = append(pipeline, pgMessage('P', "\x00select 1\x00\x00\x00")...)
+		pipeline = append(pipeline, pgMessage('B', "\x00\x00\x00\x00\x00\x00\x00\x00")...)
+		pipeline = append(pipeline, pgMessage('E', "\x00\x00\x00\x00\x00")...)
+		pipeline = append(pipeline, pgMessage('S', "")...)
+	}
+	query := pgQuery("select 0")
+	var packets []pcap.TCPPacket
+	var want string
+	for i := range 3 {
+		packets = append(packets,
+			pcap.TCPPacket{
+				Timestamp: testStart.Add(time.Duration(2*i) * time.Second), Data: pipeline,
+				IPSource: testClientIP, IPDest: testServerIP, PortSource: testClientPort, PortDest: testServerPort,
+				Seq: uint32(1 + i*len(pipeline)),
+			},
+			pcap.TCPPacket{
+				Timestamp: testStart.Add(time.Duration(2*i+1) * time.Second), Data: query,
+				IPSource: "10.0.0.8", IPDest: testServerIP, PortSource: 40001, PortDest: testServerPort,
+				Seq: uint32(1 + i*len(query)),
+			})
+		want += strings.Repeat("PBES", 3) + "Q"
+	}
+	messages, _ := ExtractMessages(packetsChan(packets), ExtractOptions{
+		ServerNets: mustResolve(t, testServerIP),
+		Ports:      []uint16{testServerPort},
+		Logger:     quietLogger(),
+	})
+	if got := messageTypes(messages); got != want {
+		t.Errorf("message order = %s, want %s", got, want)
+	}
+}
+
+func mustResolve(t *testing.T, host string) []*net.IPNet {
+	t.Helper()
+	nets, err := pcap.ResolveHost(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
@@ -0,0 +1,267 @@
+package stream
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FingerprintStat — агрегированная статистика по одной форме запроса.
+type FingerprintStat struct {
+	Fingerprint string
+	Count       int
+	Example     string // текст первого встреченного запроса этой формы
+	// Latency — суммарная задержка от первого пакета запроса до CommandComplete по
+	// LatencySamples запросам, ответ на которые попал в захват.
+	Latency        time.Duration
+	LatencySamples int
+}
+
+// AvgLatency возвращает среднюю задержку или 0, если замеров нет.
+func (st FingerprintStat) AvgLatency() time.Duration {
+	if st.LatencySamples == 0 {
+		return 0
+	}
+	return st.Latency / time.Duration(st.LatencySamples)
+}
+
+// AggregateFingerprints группирует простые запросы (Query) по Fingerprint и возвращает
+// статистику, отсортированную по убыванию числа вхождений. Запрос из нескольких операторов
+// учитывается по каждому оператору (см. SplitStatements); задержка известна только для
+// запроса целиком, поэтому в Latency попадают лишь запросы из одного оператора. Формы,
+// встретившиеся реже minOccurrences раз, в результат не попадают.
+func AggregateFingerprints(messages []PostgreSQLMessage, minOccurrences int) []FingerprintStat {
+	stats := make(map[string]*FingerprintStat)
+	for _, m := range messages {
+		if !m.Type.IsSimpleQuery() {
+			continue
+		}
+		statements := SplitStatements(m.PrettyQuery())
+		for _, query := range statements {
+			fp := Fingerprint(query)
+			st, ok := stats[fp]
+			if !ok {
+				st = &FingerprintStat{Fingerprint: fp, Example: query}
+				stats[fp] = st
+			}
+			st.Count++
+			if len(statements) == 1 && !m.CommandCompleteTimestamp.IsZero() {
+				st.Latency += m.CommandCompleteTimestamp.Sub(m.FirstTCPPacketTimestamp)
+				st.LatencySamples++
+			}
+		}
+	}
+
+	out := make([]FingerprintStat, 0, len(stats))
+	for _, st := range stats {
+		if st.Count < minOccurrences {
+			continue
+		}
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Fingerprint < out[j].Fingerprint
+	})
+	return out
+}
+
+// LiteralKind — вид литерала, заменяемого при нормализации запроса.
+type LiteralKind int
+
+const (
+	LiteralString LiteralKind = iota
+	LiteralNumber
+	LiteralParam // параметр расширенного протокола $N
+)
+
+// inListPattern — список IN из одних литералов после замены их на '?'.
+var inListPattern = regexp.MustCompile(`\bin ?\( ?\?(?: ?, ?\?)* ?\)`)
+
+// Fingerprint нормализует SQL-запрос к каноническому виду, по которому можно
+// группировать запросы одной формы: строковые (в том числе в долларовых кавычках)
+// и числовые литералы, а также параметры $N заменяются на '?', пробельные символы
+// и комментарии схлопываются в один пробел, текст вне кавычек приводится к нижнему
+// регистру. Список IN из литералов любой длины сворачивается в "in (...)", как
+// в pg_stat_statements.
+func Fingerprint(sql string) string {
+	fp := NormalizeLiterals(sql, func(LiteralKind) string { return "?" })
+	return inListPattern.ReplaceAllString(fp, "in (...)")
+}
+
+// SplitStatements делит текст простого запроса на операторы по ';' вне строковых
+// литералов, идентификаторов в кавычках, строк в долларовых кавычках и комментариев.
+// Пустые операторы отбрасываются; запрос без ';' возвращается одним оператором.
+func SplitStatements(sql string) []string {
+	var out []string
+	add := func(s string) {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	start := 0
+	for i := 0; i < len(sql); i++ {
+		switch c := sql[i]; {
+		case c == '\'' || c == '"':
+			// удвоенная кавычка внутри литерала даёт два соседних литерала — тот же результат
+			i = quotedEnd(sql, i) - 1
+		case c == '-' || c == '/':
+			if n := commentLen(sql[i:]); n > 0 {
+				i += n - 1
+			}
+		case c == '$':
+			if n := dollarQuotedLen(sql[i:]); n > 0 {
+				i += n - 1
+			}
+		case c == ';':
+			add(sql[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(sql) {
+		add(sql[start:])
+	}
+	return out
+}
+
+// commentLen возвращает длину комментария (-- до конца строки или /* */) в начале s
+// или 0, если s начинается не с комментария. Незакрытый комментарий длится до конца s.
+func commentLen(s string) int {
+	switch {
+	case strings.HasPrefix(s, "--"):
+		if j := strings.IndexByte(s, '\n'); j >= 0 {
+			return j
+		}
+		return len(s)
+	case strings.HasPrefix(s, "/*"):
+		if j := strings.Index(s[2:], "*/"); j >= 0 {
+			return j + 4
+		}
+		return len(s)
+	}
+	return 0
+}
+
+// dollarQuotedLen возвращает длину строки в долларовых кавычках в начале s вместе
+// с тегами или 0, если s начинается не с тега. Незакрытая строка длится до конца s.
+func dollarQuotedLen(s string) int {
+	tag := dollarQuoteTag(s)
+	if tag == "" {
+		return 0
+	}
+	if j := strings.Index(s[len(tag):], tag); j >= 0 {
+		return len(tag) + j + len(tag)
+	}
+	return len(s)
+}
+
+// dollarQuoteTag возвращает открывающий тег строки в долларовых кавычках ($$ или $tag$)
+// в начале s или пустую строку. $1 и подобные параметры тегом не являются.
+func dollarQuoteTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '$':
+			return s[:i+1]
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80:
+		case c >= '0' && c <= '9' && i > 1:
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
+// NormalizeLiterals приводит запрос к тому же виду, что и Fingerprint, но каждый литерал
+// (включая строки в долларовых кавычках) заменяется строкой, которую возвращает replace
+// для его вида. Комментарии, как и пробельные символы, схлопываются в один пробел.
+func NormalizeLiterals(sql string, replace func(kind LiteralKind) string) string {
+	var sb strings.Builder
+	sb.Grow(len(sql))
+
+	s := strings.TrimSpace(sql)
+	pendingSpace := false
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+
+		if n := commentLen(s[i:]); n > 0 || unicode.IsSpace(r) {
+			i += max(n, size)
+			pendingSpace = true
+			continue
+		}
+		if pendingSpace && sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		pendingSpace = false
+
+		switch {
+		case r == '\'':
+			i = quotedEnd(s, i)
+			sb.WriteString(replace(LiteralString))
+		case r == '"':
+			end := quotedEnd(s, i)
+			sb.WriteString(s[i:end])
+			i = end
+		case r == '$' && dollarQuoteTag(s[i:]) != "":
+			i += dollarQuotedLen(s[i:])
+			sb.WriteString(replace(LiteralString))
+		case r == '$' && startsWithDigit(s[i+1:]):
+			i = digitsEnd(s, i+1, false)
+			sb.WriteString(replace(LiteralParam))
+		case unicode.IsDigit(r) && !prevIsIdent(s, i):
+			i = digitsEnd(s, i, true)
+			sb.WriteString(replace(LiteralNumber))
+		default:
+			sb.WriteRune(unicode.ToLower(r))
+			i += size
+		}
+	}
+	return sb.String()
+}
+
+// quotedEnd возвращает индекс за закрывающей кавычкой литерала, начинающегося в s[start],
+// или len(s) для незакрытого литерала. Удвоенная кавычка внутри литерала считается
+// экранированной.
+func quotedEnd(s string, start int) int {
+	q := s[start]
+	for i := start + 1; i < len(s); i++ {
+		if s[i] != q {
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == q {
+			i++
+			continue
+		}
+		return i + 1
+	}
+	return len(s)
+}
+
+func startsWithDigit(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsDigit(r)
+}
+
+// digitsEnd возвращает индекс за последовательностью цифр (и точек, если dot), начинающейся
+// в s[start].
+func digitsEnd(s string, start int, dot bool) int {
+	i := start
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if !unicode.IsDigit(r) && !(dot && r == '.') {
+			break
+		}
+		i += size
+	}
+	return i
+}
+
+func prevIsIdent(s string, i int) bool {
+	p, _ := utf8.DecodeLastRuneInString(s[:i])
+	return unicode.IsLetter(p) || unicode.IsDigit(p) || p == '_'
+}
@@ -0,0 +1,76 @@
+package stream
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{"SELECT * FROM users WHERE id = 42", "select * from users where id = ?"},
+		{"select  name\n\tfrom t where s = 'it''s'", "select name from t where s = ?"},
+		{`SELECT "Name" FROM t WHERE a = $1 AND b = 1.5`, `select "Name" from t where a = ? and b = ?`},
+		{"select * from t where id in (1, 2, 3)", "select * from t where id in (...)"},
+		{"select col1 from t2", "select col1 from t2"},
+		{"select $$it's$$", "select ?"},
+		{"select $fn$ a $$ b $fn$ || 'x'", "select ? || ?"},
+		{"select 1 -- trailing comment", "select ?"},
+		{"-- leading\nselect /* inline */ a from t", "select a from t"},
+		{"select a/*no space*/from t", "select a from t"},
+		{"select '-- not a comment', '/* nor this */'", "select ?, ?"},
+		{"select $$ unterminated", "select ?"},
+	}
+	for _, tt := range tests {
+		if got := Fingerprint(tt.sql); got != tt.want {
+			t.Errorf("Fingerprint(%q) = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeLiteralsKinds(t *testing.T) {
+	var kinds []LiteralKind
+	NormalizeLiterals("select 'a', $$b$$, $1, 2 /* 3 */", func(kind LiteralKind) string {
+		kinds = append(kinds, kind)
+		return "?"
+	})
+	want := []LiteralKind{LiteralString, LiteralString, LiteralParam, LiteralNumber}
+	if !slices.Equal(kinds, want) {
+		t.Errorf("literal kinds %v, want %v", kinds, want)
+	}
+}
+
+func TestAggregateFingerprintsGroupsCommentsAndDollarQuotes(t *testing.T) {
+	var messages []PostgreSQLMessage
+	for _, sql := range []string{
+		"select $$a$$ -- first",
+		"/* app=web */ select $tag$b$tag$",
+		"select 'c'",
+	} {
+		messages = append(messages, PostgreSQLMessage{Type: 'Q', Payload: append([]byte(sql), 0)})
+	}
+	stats := AggregateFingerprints(messages, 1)
+	if len(stats) != 1 || stats[0].Fingerprint != "select ?" || stats[0].Count != 3 {
+		t.Errorf("stats %+v, want one form \"select ?\" with 3 queries", stats)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want []string
+	}{
+		{"select 1; select 2;", []string{"select 1", "select 2"}},
+		{"select ';'; select \"a;b\"", []string{"select ';'", `select "a;b"`}},
+		{"select $$;$$; select 2", []string{"select $$;$$", "select 2"}},
+		{"select 1 -- ;\n; /* ; */ select 2", []string{"select 1 -- ;", "/* ; */ select 2"}},
+		{"select 'unterminated;", []string{"select 'unterminated;"}},
+	}
+	for _, tt := range tests {
+		if got := SplitStatements(tt.sql); !slices.Equal(got, tt.want) {
+			t.Errorf("SplitStatements(%q) = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
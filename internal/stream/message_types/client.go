@@ -15,11 +15,13 @@ const (
 	MessageTypeTerminate            ClientMessageType = 'X'
 	MessageTypeCopyData             ClientMessageType = 'd'
 	MessageTypeCopyFail             ClientMessageType = 'f'
+	MessageTypeCopyDone             ClientMessageType = 'c'
 	MessageTypeDescribe             ClientMessageType = 'D'
 	MessageTypeFlush                ClientMessageType = 'H'
 	MessageTypeFunctionCall         ClientMessageType = 'F'
 	MessageTypeFunctionCallResponse ClientMessageType = 'V'
 	MessageTypePasswordMessage      ClientMessageType = 'p'
+	MessageTypeClose                ClientMessageType = 'C'
 	ClientMessageTypeOnlyLength     ClientMessageType = 0 // для сообщений без типа, только с длиной
 )
 
@@ -32,11 +34,13 @@ var clientMessageTypeNames = map[ClientMessageType]string{
 	MessageTypeTerminate:            "Terminate",
 	MessageTypeCopyData:             "CopyData",
 	MessageTypeCopyFail:             "CopyFail",
+	MessageTypeCopyDone:             "CopyDone",
 	MessageTypeDescribe:             "CopyDescribe",
 	MessageTypeFlush:                "Flush",
 	MessageTypeFunctionCall:         "FunctionCall",
 	MessageTypeFunctionCallResponse: "FunctionCallResponse",
 	MessageTypePasswordMessage:      "PasswordMessage",
+	MessageTypeClose:                "Close",
 	ClientMessageTypeOnlyLength:     "<len-only>",
 }
 
@@ -51,6 +55,16 @@ func (mt ClientMessageType) String() string {
 	return sb.String()
 }
 
+// IsKnown сообщает, является ли байт известным типом клиентского сообщения.
+// Используется при ресинхронизации потока для поиска правдоподобной границы кадра.
+func (mt ClientMessageType) IsKnown() bool {
+	if mt == ClientMessageTypeOnlyLength {
+		return false
+	}
+	_, ok := clientMessageTypeNames[mt]
+	return ok
+}
+
 func (mt ClientMessageType) IsSimpleQuery() bool {
 	return mt == MessageTypeQuery
 }
@@ -59,10 +73,30 @@ func (mt ClientMessageType) HaveTypeByte() bool {
 	return mt != ClientMessageTypeOnlyLength
 }
 
+// NeedCommandCompleteAnswer сообщает, что сервер отвечает на сообщение CommandComplete:
+// это простой запрос (по одному на каждый оператор) и Execute расширенного протокола.
 func (mt ClientMessageType) NeedCommandCompleteAnswer() bool {
-	return mt == MessageTypeQuery
+	return mt == MessageTypeQuery || mt == MessageTypeExecute
 }
 
+// NeedReadyForQueryAnswer сообщает, что сервер завершит ответ на сообщение ReadyForQuery:
+// это простой запрос, Sync расширенного протокола и FunctionCall.
 func (mt ClientMessageType) NeedReadyForQueryAnswer() bool {
-	return mt == MessageTypeQuery
+	return mt == MessageTypeQuery || mt == MessageTypeSync || mt == MessageTypeFunctionCall
+}
+
+// AwaitsSync сообщает, что сообщение относится к расширенному протоколу и сервер
+// не отвечает на него ReadyForQuery до ближайшего Sync.
+func (mt ClientMessageType) AwaitsSync() bool {
+	switch mt {
+	case MessageTypeParse, MessageTypeBind, MessageTypeExecute, MessageTypeDescribe, MessageTypeClose, MessageTypeFlush:
+		return true
+	}
+	return false
+}
+
+// IsCopyStream сообщает, что сообщение передаёт поток COPY FROM STDIN:
+// CopyData, завершающий CopyDone или CopyFail.
+func (mt ClientMessageType) IsCopyStream() bool {
+	return mt == MessageTypeCopyData || mt == MessageTypeCopyDone || mt == MessageTypeCopyFail
 }
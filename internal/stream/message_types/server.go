@@ -11,6 +11,24 @@ const (
 	MessageTypeErrorResponse          ServerMessageType = 'E'
 	MessageTypeRowDescription         ServerMessageType = 'T'
 	MessageTypeDataRow                ServerMessageType = 'D'
+	MessageTypeParameterStatus        ServerMessageType = 'S'
+	MessageTypeBackendKeyData         ServerMessageType = 'K'
+	MessageTypeParseComplete          ServerMessageType = '1'
+	MessageTypeBindComplete           ServerMessageType = '2'
+	MessageTypeCloseComplete          ServerMessageType = '3'
+	MessageTypeNoData                 ServerMessageType = 'n'
+	MessageTypeParameterDescription   ServerMessageType = 't'
+	MessageTypePortalSuspended        ServerMessageType = 's'
+	MessageTypeEmptyQueryResponse     ServerMessageType = 'I'
+	MessageTypeNoticeResponse         ServerMessageType = 'N'
+	MessageTypeNotificationResponse   ServerMessageType = 'A'
+	MessageTypeCopyInResponse         ServerMessageType = 'G'
+	MessageTypeCopyOutResponse        ServerMessageType = 'H'
+	MessageTypeCopyBothResponse       ServerMessageType = 'W'
+	MessageTypeServerCopyData         ServerMessageType = 'd'
+	MessageTypeServerCopyDone         ServerMessageType = 'c'
+	MessageTypeServerFunctionResult   ServerMessageType = 'V'
+	MessageTypeNegotiateProtocol      ServerMessageType = 'v'
 	ServerClientMessageTypeOnlyLength ServerMessageType = 0
 )
 
@@ -21,6 +39,24 @@ var serverMessageTypeNames = map[ServerMessageType]string{
 	MessageTypeErrorResponse:          "ErrorResponse",
 	MessageTypeRowDescription:         "RowDescription",
 	MessageTypeDataRow:                "DataRow",
+	MessageTypeParameterStatus:        "ParameterStatus",
+	MessageTypeBackendKeyData:         "BackendKeyData",
+	MessageTypeParseComplete:          "ParseComplete",
+	MessageTypeBindComplete:           "BindComplete",
+	MessageTypeCloseComplete:          "CloseComplete",
+	MessageTypeNoData:                 "NoData",
+	MessageTypeParameterDescription:   "ParameterDescription",
+	MessageTypePortalSuspended:        "PortalSuspended",
+	MessageTypeEmptyQueryResponse:     "EmptyQueryResponse",
+	MessageTypeNoticeResponse:         "NoticeResponse",
+	MessageTypeNotificationResponse:   "NotificationResponse",
+	MessageTypeCopyInResponse:         "CopyInResponse",
+	MessageTypeCopyOutResponse:        "CopyOutResponse",
+	MessageTypeCopyBothResponse:       "CopyBothResponse",
+	MessageTypeServerCopyData:         "CopyData",
+	MessageTypeServerCopyDone:         "CopyDone",
+	MessageTypeServerFunctionResult:   "FunctionCallResponse",
+	MessageTypeNegotiateProtocol:      "NegotiateProtocolVersion",
 	ServerClientMessageTypeOnlyLength: "<len-only>",
 }
 
@@ -30,3 +66,13 @@ func (mt ServerMessageType) String() string {
 	}
 	return string(mt)
 }
+
+// IsKnown сообщает, является ли байт известным типом серверного сообщения.
+// Используется при ресинхронизации потока для поиска правдоподобной границы кадра.
+func (mt ServerMessageType) IsKnown() bool {
+	if mt == ServerClientMessageTypeOnlyLength {
+		return false
+	}
+	_, ok := serverMessageTypeNames[mt]
+	return ok
+}
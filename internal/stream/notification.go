@@ -0,0 +1,56 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Notification представляет асинхронное серверное сообщение NotificationResponse ('A'),
+// которое приходит подписанному через LISTEN клиенту вне цикла запрос/ответ.
+type Notification struct {
+	Timestamp time.Time
+	PID       uint32
+	Channel   string
+	Payload   string
+}
+
+// Notice представляет серверное сообщение NoticeResponse ('N'): предупреждение или
+// информационное сообщение (RAISE NOTICE, WARNING), которое сервер может прислать в любой
+// момент, в том числе посреди ответа на запрос. Тело разбирается как ErrorResponse.
+type Notice struct {
+	Timestamp time.Time
+	Response  ErrorResponse
+}
+
+// DecodeNotification разбирает тело NotificationResponse (без байта типа и поля длины):
+// Int32 PID процесса-отправителя, затем имя канала и полезная нагрузка как C-строки.
+func DecodeNotification(body []byte) (Notification, error) {
+	if len(body) < 4 {
+		return Notification{}, errors.New("notification body too short")
+	}
+	n := Notification{PID: binary.BigEndian.Uint32(body[0:4])}
+	rest := body[4:]
+
+	channel, rest, ok := cutCString(rest)
+	if !ok {
+		return Notification{}, errors.New("notification channel is not null-terminated")
+	}
+	payload, _, ok := cutCString(rest)
+	if !ok {
+		return Notification{}, errors.New("notification payload is not null-terminated")
+	}
+	n.Channel = channel
+	n.Payload = payload
+	return n, nil
+}
+
+// cutCString отрезает от b строку до первого нулевого байта и возвращает её вместе с остатком.
+func cutCString(b []byte) (s string, rest []byte, ok bool) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return "", b, false
+	}
+	return string(b[:i]), b[i+1:], true
+}
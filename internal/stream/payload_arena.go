@@ -0,0 +1,32 @@
+package stream
+
+// payloadChunkSize — размер блока, из которого нарезаются payload небольших сообщений.
+// Сообщения длиннее четверти блока получают собственный срез.
+const payloadChunkSize = 64 << 10
+
+// payloadArena выделяет payload клиентских сообщений из общих блоков: одно выделение на
+// блок вместо отдельного make на каждое сообщение. Блоки не переиспользуются, поэтому
+// выданный payload остаётся действительным и после Reset потока; блок освобождается
+// сборщиком мусора вместе с последним payload из него. Платой за это служит удержание
+// целого блока одним оставшимся в памяти сообщением.
+type payloadArena struct {
+	chunk []byte
+}
+
+// copy возвращает копию data. Ёмкость среза ограничена его длиной: append к payload
+// не затрёт соседние сообщения блока.
+func (a *payloadArena) copy(data []byte) []byte {
+	n := len(data)
+	if n > payloadChunkSize/4 {
+		p := make([]byte, n)
+		copy(p, data)
+		return p
+	}
+	if len(a.chunk) < n {
+		a.chunk = make([]byte, payloadChunkSize)
+	}
+	p := a.chunk[:n:n]
+	copy(p, data)
+	a.chunk = a.chunk[n:]
+	return p
+}
@@ -0,0 +1,63 @@
+package stream
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPayloadValidAfterReset(t *testing.T) {
+	s := NewTCPStream()
+	s.setLogger(quietLogger())
+	s.addClientData(pgQuery("select 1"), testStart, 1)
+	if len(s.completed) != 1 {
+		t.Fatalf("got %d messages, want 1", len(s.completed))
+	}
+	first := s.completed[0]
+
+	s.Reset()
+	s.addClientData(pgQuery("select 2"), testStart, 1)
+	if len(s.completed) != 1 {
+		t.Fatalf("after Reset got %d messages, want 1", len(s.completed))
+	}
+	if got := string(first.Payload); got != "select 1\x00" {
+		t.Errorf("payload of the first message changed after Reset: %q", got)
+	}
+	if got := string(s.completed[0].Payload); got != "select 2\x00" {
+		t.Errorf("payload after Reset = %q", got)
+	}
+}
+
+func TestPayloadArenaCapacity(t *testing.T) {
+	var a payloadArena
+	p := a.copy([]byte("abc"))
+	q := a.copy([]byte("def"))
+	_ = append(p, 'x')
+	if !bytes.Equal(q, []byte("def")) {
+		t.Errorf("append to one payload overwrote the next: %q", q)
+	}
+	big := bytes.Repeat([]byte{1}, payloadChunkSize)
+	if got := a.copy(big); !bytes.Equal(got, big) {
+		t.Error("large payload copied incorrectly")
+	}
+}
+
+// BenchmarkParseQueries — разбор 10 000 простых запросов, по сегменту на запрос.
+func BenchmarkParseQueries(b *testing.B) {
+	const n = 10000
+	segs := make([][]byte, n)
+	for i := range segs {
+		segs[i] = pgQuery("select * from accounts where id = 42")
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		s := NewTCPStream()
+		var seq uint32 = 1
+		for _, seg := range segs {
+			s.addClientData(seg, testStart, seq)
+			seq += uint32(len(seg))
+		}
+		if len(s.completed) != n {
+			b.Fatalf("got %d messages, want %d", len(s.completed), n)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package stream
+
+import (
+	"log/slog"
+	"time"
+)
+
+// maxPendingSegments — сколько сегментов после пропуска ждут недостающие данные.
+// Если пропуск так и не заполнился (сегмент потерян при захвате), сборка
+// продолжается с ближайшего сохранённого сегмента.
+const maxPendingSegments = 64
+
+// pendingSegment — сегмент, пришедший раньше предшествующих ему данных.
+type pendingSegment struct {
+	data []byte
+	ts   time.Time
+}
+
+// seqTracker восстанавливает порядок байтов одного направления TCP-потока
+// по порядковым номерам: отбрасывает повторные передачи, обрезает перекрытия
+// и придерживает сегменты, пришедшие раньше своей очереди.
+type seqTracker struct {
+	known   bool
+	next    uint32
+	pending map[uint32]pendingSegment
+	// gaps — число байтов, так и не полученных в пропусках, через которые пришлось перейти.
+	gaps   int
+	logger *slog.Logger
+}
+
+// accept принимает сегмент с порядковым номером seq и возвращает данные, которые
+// теперь можно дописать в буфер потока, в порядке seq. Сравнения учитывают
+// переполнение 32-битного порядкового номера.
+func (t *seqTracker) accept(seq uint32, data []byte, ts time.Time) []pendingSegment {
+	if !t.known {
+		t.known = true
+		t.next = seq
+	}
+
+	if d := int32(seq - t.next); d < 0 {
+		if int32(seq+uint32(len(data))-t.next) <= 0 {
+			return nil // повторная передача уже собранных данных
+		}
+		data = data[-d:]
+		seq = t.next
+	} else if d > 0 {
+		if t.pending == nil {
+			t.pending = make(map[uint32]pendingSegment)
+		}
+		if prev, ok := t.pending[seq]; !ok || len(prev.data) < len(data) {
+			t.pending[seq] = pendingSegment{data: data, ts: ts}
+		}
+		if len(t.pending) <= maxPendingSegments {
+			return nil
+		}
+		t.skipGap()
+		return t.drain(nil)
+	}
+
+	t.next = seq + uint32(len(data))
+	return t.drain([]pendingSegment{{data: data, ts: ts}})
+}
+
+// drain дописывает к out придержанные сегменты, ставшие очередными.
+func (t *seqTracker) drain(out []pendingSegment) []pendingSegment {
+	for len(t.pending) > 0 {
+		progressed := false
+		for seq, seg := range t.pending {
+			d := int32(seq - t.next)
+			if d > 0 {
+				continue
+			}
+			delete(t.pending, seq)
+			progressed = true
+			if int32(seq+uint32(len(seg.data))-t.next) <= 0 {
+				continue
+			}
+			seg.data = seg.data[-d:]
+			out = append(out, seg)
+			t.next += uint32(len(seg.data))
+		}
+		if !progressed {
+			break
+		}
+	}
+	return out
+}
+
+// skipGap переносит ожидаемый порядковый номер на ближайший придержанный сегмент.
+func (t *seqTracker) skipGap() {
+	first := true
+	var nearest uint32
+	for seq := range t.pending {
+		if first || int32(seq-nearest) < 0 {
+			nearest, first = seq, false
+		}
+	}
+	gap := int(int32(nearest - t.next))
+	t.logger.Warn("tcp reassembly: bytes never captured, skipping gap", "bytes", gap)
+	t.gaps += gap
+	t.next = nearest
+}
+
+func (t *seqTracker) reset() {
+	*t = seqTracker{logger: t.logger}
+}
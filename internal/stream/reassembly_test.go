@@ -0,0 +1,123 @@
+package stream
+
+import (
+	"bytes"
+	"testing"
+)
+
+// joinSegments склеивает данные сегментов, возвращённых seqTracker.accept.
+func joinSegments(segs []pendingSegment) []byte {
+	var out []byte
+	for _, s := range segs {
+		out = append(out, s.data...)
+	}
+	return out
+}
+
+func TestSeqTrackerReordersSegments(t *testing.T) {
+	wire := []byte("0123456789abcdef")
+	tr := seqTracker{logger: quietLogger()}
+	var got []byte
+	// первый сегмент задаёт начало, дальше — не по порядку и с повтором уже собранного
+	for _, seg := range []struct {
+		seq  uint32
+		data string
+	}{
+		{100, "0123"},
+		{108, "89ab"},
+		{104, "4567"},
+		{104, "4567"},
+		{112, "cdef"},
+	} {
+		got = append(got, joinSegments(tr.accept(seg.seq, []byte(seg.data), testStart))...)
+	}
+	if !bytes.Equal(got, wire) {
+		t.Errorf("reassembled %q, want %q", got, wire)
+	}
+	if len(tr.pending) != 0 || tr.gaps != 0 {
+		t.Errorf("pending %d, gaps %d after complete stream", len(tr.pending), tr.gaps)
+	}
+}
+
+func TestSeqTrackerWrapsAround(t *testing.T) {
+	tr := seqTracker{logger: quietLogger()}
+	start := uint32(0xFFFFFFFE)
+	got := joinSegments(tr.accept(start, []byte("ab"), testStart))
+	got = append(got, joinSegments(tr.accept(start+4, []byte("ef"), testStart))...)
+	got = append(got, joinSegments(tr.accept(start+2, []byte("cd"), testStart))...)
+	if string(got) != "abcdef" {
+		t.Errorf("reassembled %q across sequence wraparound, want abcdef", got)
+	}
+}
+
+func TestSeqTrackerSkipsLostSegment(t *testing.T) {
+	tr := seqTracker{logger: quietLogger()}
+	tr.accept(0, []byte("ab"), testStart)
+	// сегмент [2, 4) потерян: после maxPendingSegments ожидающих сборка переходит через пропуск
+	var got []byte
+	for i := range maxPendingSegments + 1 {
+		got = append(got, joinSegments(tr.accept(uint32(4+i), []byte{'x'}, testStart))...)
+	}
+	if len(got) != maxPendingSegments+1 {
+		t.Errorf("got %d bytes after the gap, want %d", len(got), maxPendingSegments+1)
+	}
+	if tr.gaps != 2 {
+		t.Errorf("gaps = %d, want 2", tr.gaps)
+	}
+}
+
+func TestStreamReassemblesOutOfOrderAndRetransmitted(t *testing.T) {
+	wire := append(pgQuery("select 1"), pgQuery("select 2")...)
+	m := newTestManager()
+	c := newTestConn(m)
+	base := c.cseq
+	// первый сегмент задаёт начало потока, остальные приходят не по порядку и с повторами
+	c.clientAt(t, base, wire[:5])
+	c.clientAt(t, base+10, wire[10:20])
+	c.clientAt(t, base, wire[:5])
+	c.clientAt(t, base+20, wire[20:])
+	c.clientAt(t, base+5, wire[5:10])
+	c.clientAt(t, base+10, wire[10:20])
+
+	messages := m.FlushPartial()
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want 2", len(messages))
+	}
+	if got := append(messages[0].Row(), messages[1].Row()...); !bytes.Equal(got, wire) {
+		t.Errorf("reassembled %q, want %q", got, wire)
+	}
+}
+
+func TestRetransmittedSegmentYieldsOneMessage(t *testing.T) {
+	m := newTestManager()
+	c := newTestConn(m)
+	query := pgQuery("select 1")
+	c.clientAt(t, c.cseq, query)
+	c.clientAt(t, c.cseq, query)
+
+	s := m.streams[testStreamKey]
+	if s == nil {
+		t.Fatal("stream not created")
+	}
+	if len(s.completed) != 1 {
+		t.Errorf("completed has %d messages after a retransmit, want 1", len(s.completed))
+	}
+}
+
+func TestPartiallyOverlappingSegmentIsTrimmed(t *testing.T) {
+	wire := append(pgQuery("select 1"), pgQuery("select 2")...)
+	m := newTestManager()
+	c := newTestConn(m)
+	base := c.cseq
+	c.clientAt(t, base, wire[:12])
+	// повторная передача захватывает уже собранные байты [8, 12) и новые за ними
+	c.clientAt(t, base+8, wire[8:])
+
+	messages := m.FlushPartial()
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want 2", len(messages))
+	}
+	if got := append(messages[0].Row(), messages[1].Row()...); !bytes.Equal(got, wire) {
+		t.Errorf("reassembled %q, want %q", got, wire)
+	}
+}
@@ -0,0 +1,120 @@
+package stream
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestClientResyncAfterCorruptFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		garbage []byte
+	}{
+		{"unknown type", []byte{0xEE, 0xEE, 0xEE}},
+		{"length below header", []byte{'Q', 0, 0, 0, 2}},
+		{"length above max", binary.BigEndian.AppendUint32([]byte{'Q'}, 0x7FFFFFF0)},
+		{"tail of a lost message", []byte("ct * from users where id = 1\x00")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager()
+			c := newTestConn(m)
+			c.client(t, pgQuery("select 1"))
+			c.client(t, tt.garbage, pgQuery("select 2"), pgMessage('S', ""))
+
+			messages := m.FlushPartial()
+			if got := messageTypes(messages); got != "QQS" {
+				t.Fatalf("messages %q, want QQS", got)
+			}
+			if got := messages[1].PrettyQuery(); got != "select 2" {
+				t.Errorf("query after resync %q, want select 2", got)
+			}
+		})
+	}
+}
+
+func TestClientResyncSkipsCoincidentalHeader(t *testing.T) {
+	// 'Q' с правдоподобной длиной внутри мусора: кадр за ним начинается с неизвестного
+	// байта, поэтому граница не принимается
+	garbage := []byte{0xEE, 'Q', 0, 0, 0, 5, 'x', 0xEE, 0xEE}
+	m := newTestManager()
+	c := newTestConn(m)
+	c.client(t, pgQuery("select 1"))
+	c.client(t, garbage, pgQuery("select 2"))
+	if got := messageTypes(m.FlushPartial()); got != "QQ" {
+		t.Errorf("messages %q, want QQ", got)
+	}
+}
+
+func TestServerResyncAfterCorruptFrame(t *testing.T) {
+	m := newTestManager()
+	c := newTestConn(m)
+	c.client(t, pgQuery("select 1"))
+	c.server(t, []byte{0xEE, 0xEE, 'C', 0xFF, 0xFF, 0xFF, 0xFF}, pgComplete("SELECT 1"), pgReady())
+
+	messages := m.FlushPartial()
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	if messages[0].CommandTag != "SELECT 1" || messages[0].ReadyForQueryTimestamp.IsZero() {
+		t.Errorf("after server resync: tag %q, ReadyForQuery %v", messages[0].CommandTag, messages[0].ReadyForQueryTimestamp)
+	}
+}
+
+func TestMaxLengthFieldDoesNotAllocate(t *testing.T) {
+	m := newTestManager()
+	c := newTestConn(m)
+	c.client(t, pgQuery("select 1"))
+	huge := binary.BigEndian.AppendUint32([]byte{'Q'}, 0xFFFFFFFF)
+	c.client(t, huge, pgQuery("select 2"))
+
+	s := m.streams[testStreamKey]
+	// кадр с длиной 0xFFFFFFFF отброшен сразу, а не ждёт 4 ГБ данных в буфере
+	if n := len(s.clientBuf); n != 0 {
+		t.Errorf("%d bytes left in the client buffer", n)
+	}
+	if got := messageTypes(m.FlushPartial()); got != "QQ" {
+		t.Errorf("messages %q, want QQ", got)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	long := make([]byte, 2000)
+	for i := range long {
+		long[i] = 'x'
+	}
+	query := pgQuery("select '" + string(long) + "'")
+
+	m := newTestManager()
+	m.MaxMessageSize = 1024
+	c := newTestConn(m)
+	c.client(t, query, pgQuery("select 1"))
+	messages := m.FlushPartial()
+	for _, msg := range messages {
+		if msg.Len > 1024 {
+			t.Errorf("message of %d bytes passed MaxMessageSize 1024", msg.Len)
+		}
+	}
+	if len(messages) == 0 || messages[len(messages)-1].PrettyQuery() != "select 1" {
+		t.Errorf("messages %q, want the short query after the oversized one", messageTypes(messages))
+	}
+
+	// тот же запрос в пределах лимита собирается целиком
+	m = newTestManager()
+	c = newTestConn(m)
+	c.client(t, query)
+	if messages := m.FlushPartial(); len(messages) != 1 || int(messages[0].Len) != len(query)-1 {
+		t.Errorf("within the default limit got %d messages", len(messages))
+	}
+}
+
+func TestExtractMaxMessageSizeDefault(t *testing.T) {
+	_, m := ExtractMessages(packetsChan(nil), ExtractOptions{Logger: quietLogger()})
+	if m.MaxMessageSize != DefaultMaxMessageSize {
+		t.Errorf("MaxMessageSize %d with zero option, want %d", m.MaxMessageSize, DefaultMaxMessageSize)
+	}
+	_, m = ExtractMessages(packetsChan(nil), ExtractOptions{MaxMessageSize: 1024, Logger: quietLogger()})
+	if m.MaxMessageSize != 1024 {
+		t.Errorf("MaxMessageSize %d, want 1024", m.MaxMessageSize)
+	}
+}
@@ -0,0 +1,68 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// rowDescriptionFieldLen — длина описания поля RowDescription после имени: OID таблицы,
+// номер столбца, OID типа, размер типа, модификатор типа и код формата.
+const rowDescriptionFieldLen = 18
+
+// FieldDescription — описание одного столбца результата из RowDescription.
+// TableOID и ColumnAttr равны 0, если столбец не является столбцом таблицы.
+// TypeSize < 0 — тип переменной длины; Format: 0 — текстовый, 1 — двоичный.
+type FieldDescription struct {
+	Name         string
+	TableOID     uint32
+	ColumnAttr   int16
+	TypeOID      uint32
+	TypeSize     int16
+	TypeModifier int32
+	Format       int16
+}
+
+// RowDescription — разобранное серверное сообщение RowDescription ('T'), описывающее
+// столбцы строк DataRow, которые следуют за ним.
+type RowDescription struct {
+	Fields []FieldDescription
+}
+
+// Names возвращает имена столбцов в порядке следования.
+func (r RowDescription) Names() []string {
+	names := make([]string, len(r.Fields))
+	for i, f := range r.Fields {
+		names[i] = f.Name
+	}
+	return names
+}
+
+// DecodeRowDescription разбирает тело RowDescription (без байта типа и поля длины):
+// Int16 число полей, затем для каждого имя (C-строка) и 18 байт описания.
+// При обрыве тела возвращаются уже прочитанные поля вместе с ошибкой.
+func DecodeRowDescription(body []byte) (RowDescription, error) {
+	if len(body) < 2 {
+		return RowDescription{}, errors.New("row description too short")
+	}
+	n := int(binary.BigEndian.Uint16(body[0:2]))
+	rest := body[2:]
+	r := RowDescription{Fields: make([]FieldDescription, 0, n)}
+	for i := 0; i < n; i++ {
+		name, tail, ok := cutCString(rest)
+		if !ok || len(tail) < rowDescriptionFieldLen {
+			return r, fmt.Errorf("row description field %d of %d truncated", i+1, n)
+		}
+		r.Fields = append(r.Fields, FieldDescription{
+			Name:         name,
+			TableOID:     binary.BigEndian.Uint32(tail[0:4]),
+			ColumnAttr:   int16(binary.BigEndian.Uint16(tail[4:6])),
+			TypeOID:      binary.BigEndian.Uint32(tail[6:10]),
+			TypeSize:     int16(binary.BigEndian.Uint16(tail[10:12])),
+			TypeModifier: int32(binary.BigEndian.Uint32(tail[12:16])),
+			Format:       int16(binary.BigEndian.Uint16(tail[16:18])),
+		})
+		rest = tail[rowDescriptionFieldLen:]
+	}
+	return r, nil
+}
@@ -0,0 +1,18 @@
+package stream
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// sampled сообщает, входит ли поток key в выборку доли rate (см. TCPStreamManager.SampleRate).
+// Решение зависит только от ключа потока, поэтому при повторных запусках на том же захвате
+// выбираются те же потоки. rate <= 0 или >= 1 — выборка выключена, входят все потоки.
+func sampled(key string, rate float64) bool {
+	if rate <= 0 || rate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return float64(h.Sum64()) < rate*math.MaxUint64
+}
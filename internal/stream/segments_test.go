@@ -0,0 +1,100 @@
+package stream
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSegmentsTimestampByOffset(t *testing.T) {
+	var s segments
+	at := func(i int) time.Time { return testStart.Add(time.Duration(i) * time.Millisecond) }
+	s.add(3, at(0))
+	s.add(2, at(1))
+	s.add(4, at(2))
+
+	for offset, want := range []int{0, 0, 0, 1, 1, 2, 2, 2, 2} {
+		if got := s.timestampByOffset(offset); !got.Equal(at(want)) {
+			t.Errorf("offset %d: %v, want segment %d", offset, got, want)
+		}
+	}
+	if got := s.timestampByOffset(9); !got.IsZero() {
+		t.Errorf("offset past the data: %v, want zero", got)
+	}
+
+	// после чтения 4 байт смещения считаются от нового начала буфера
+	s.consume(4)
+	if len(s.list) != 2 {
+		t.Errorf("%d segments left after consume, want 2", len(s.list))
+	}
+	if got := s.timestampByOffset(0); !got.Equal(at(1)) {
+		t.Errorf("offset 0 after consume: %v, want segment 1", got)
+	}
+	if got := s.timestampByOffset(1); !got.Equal(at(2)) {
+		t.Errorf("offset 1 after consume: %v, want segment 2", got)
+	}
+}
+
+// linearTimestampByOffset — прежний поиск сегмента линейным проходом с накоплением длин,
+// для сравнения в бенчмарке.
+func linearTimestampByOffset(lengths []int, stamps []time.Time, offset int) time.Time {
+	sum := 0
+	for i, n := range lengths {
+		sum += n
+		if offset < sum {
+			return stamps[i]
+		}
+	}
+	return time.Time{}
+}
+
+// benchSegments и benchSegmentSize — длинное сообщение, пришедшее 100 000 сегментами по 16 байт.
+const (
+	benchSegments    = 100000
+	benchSegmentSize = 16
+)
+
+func BenchmarkTimestampByOffset(b *testing.B) {
+	var s segments
+	for i := range benchSegments {
+		s.add(benchSegmentSize, testStart.Add(time.Duration(i)))
+	}
+	last := benchSegments*benchSegmentSize - 1
+	for b.Loop() {
+		_ = s.timestampByOffset(0)
+		_ = s.timestampByOffset(last)
+	}
+}
+
+func BenchmarkTimestampByOffsetLinear(b *testing.B) {
+	lengths := make([]int, benchSegments)
+	stamps := make([]time.Time, benchSegments)
+	for i := range lengths {
+		lengths[i] = benchSegmentSize
+		stamps[i] = testStart.Add(time.Duration(i))
+	}
+	last := benchSegments*benchSegmentSize - 1
+	for b.Loop() {
+		_ = linearTimestampByOffset(lengths, stamps, 0)
+		_ = linearTimestampByOffset(lengths, stamps, last)
+	}
+}
+
+// BenchmarkParseFragmentedQueries — разбор потока, в котором каждое сообщение приходит
+// множеством мелких сегментов.
+func BenchmarkParseFragmentedQueries(b *testing.B) {
+	var wire []byte
+	for range 1000 {
+		wire = append(wire, pgQuery("select * from accounts where id = 42 and status = 'active'")...)
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		s := NewTCPStream()
+		for off := 0; off < len(wire); off += 4 {
+			end := min(off+4, len(wire))
+			s.addClientData(wire[off:end], testStart, uint32(1+off))
+		}
+		if len(s.completed) != 1000 {
+			b.Fatalf("got %d messages", len(s.completed))
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package stream
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	msgtypes "trafRep/internal/stream/message_types"
+)
+
+// ServerMessage — серверное сообщение потока, собираемое при TCPStreamManager.CollectServer.
+// Тело сообщения не сохраняется: для CommandComplete, ErrorResponse/NoticeResponse и
+// RowDescription хранится только разобранное содержимое, для остальных — тип и длина.
+type ServerMessage struct {
+	Timestamp time.Time
+	Type      msgtypes.ServerMessageType
+	Len       uint32
+	// StreamID, ClientIP и ClientPort — как у PostgreSQLMessage того же потока.
+	StreamID   string
+	ClientIP   string
+	ClientPort uint16
+
+	// CommandTag — тег CommandComplete, например "INSERT 0 1".
+	CommandTag string
+	// Error — поля ErrorResponse или NoticeResponse.
+	Error *ErrorResponse
+	// RowDescription — описание столбцов результата.
+	RowDescription *RowDescription
+}
+
+// Summary возвращает краткое описание содержимого: тег, текст ошибки или столбцы.
+// Для остальных типов — пустая строка.
+func (m ServerMessage) Summary() string {
+	switch {
+	case m.CommandTag != "":
+		return m.CommandTag
+	case m.Error != nil:
+		return m.Error.Error()
+	case m.RowDescription != nil:
+		return strings.Join(m.RowDescription.Names(), ", ")
+	}
+	return ""
+}
+
+// CommandTagRows возвращает число строк из тега CommandComplete (последнее слово тега:
+// "SELECT 42", "INSERT 0 10"). ok == false для тегов без числа строк.
+func CommandTagRows(tag string) (int64, bool) {
+	fields := strings.Fields(tag)
+	if len(fields) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// decodeServerMessage разбирает тело серверного сообщения typ (без байта типа и длины)
+// в ServerMessage. Ошибка разбора тела не прерывает сборку: сообщение остаётся с типом и длиной.
+func decodeServerMessage(typ msgtypes.ServerMessageType, body []byte) ServerMessage {
+	m := ServerMessage{Type: typ, Len: uint32(len(body)) + 4}
+	switch typ {
+	case msgtypes.MessageTypeCommandComplete:
+		m.CommandTag = strings.TrimRight(string(body), "\x00")
+	case msgtypes.MessageTypeErrorResponse, msgtypes.MessageTypeNoticeResponse:
+		if er, err := DecodeErrorResponse(body); err == nil {
+			m.Error = &er
+		}
+	case msgtypes.MessageTypeRowDescription:
+		// при обрыве тела сохраняются уже разобранные столбцы
+		rd, _ := DecodeRowDescription(body)
+		m.RowDescription = &rd
+	}
+	return m
+}
@@ -0,0 +1,146 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ProtocolVersion3 — код версии протокола 3.0 в StartupMessage.
+const ProtocolVersion3 uint32 = 3 << 16
+
+// Коды безтиповых запросов, которые клиент может отправить вместо StartupMessage.
+// На SSLRequest и GSSENCRequest сервер отвечает одним байтом без длины:
+// 'S' (или 'G') — соединение дальше зашифровано, 'N' — продолжаем открытым текстом.
+const (
+	SSLRequestCode    uint32 = 80877103
+	GSSENCRequestCode uint32 = 80877104
+)
+
+// CompressionStartupParameter — параметр StartupMessage, которым клиент запрашивает
+// сжатие сообщений протокола.
+const CompressionStartupParameter = "_pq_.compression"
+
+// StartupParameter — одна пара имя/значение из StartupMessage.
+type StartupParameter struct {
+	Name  string
+	Value string
+}
+
+// StartupMessage представляет первое (безтиповое) сообщение клиента: версию протокола
+// и параметры сессии (user, database, application_name, client_encoding и т.д.)
+// в исходном порядке.
+type StartupMessage struct {
+	ProtocolVersion uint32
+	Parameters      []StartupParameter
+}
+
+// Get возвращает значение параметра name и признак его наличия.
+func (sm StartupMessage) Get(name string) (string, bool) {
+	for _, p := range sm.Parameters {
+		if p.Name == name {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+// Set заменяет значение параметра name или добавляет его в конец списка.
+func (sm *StartupMessage) Set(name, value string) {
+	for i := range sm.Parameters {
+		if sm.Parameters[i].Name == name {
+			sm.Parameters[i].Value = value
+			return
+		}
+	}
+	sm.Parameters = append(sm.Parameters, StartupParameter{Name: name, Value: value})
+}
+
+// String возвращает параметры в виде "name=value" через пробел.
+func (sm StartupMessage) String() string {
+	parts := make([]string, 0, len(sm.Parameters))
+	for _, p := range sm.Parameters {
+		parts = append(parts, p.Name+"="+p.Value)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Row возвращает StartupMessage в сетевом представлении (с полем длины).
+func (sm StartupMessage) Row() []byte {
+	size := 4 + 4 + 1
+	for _, p := range sm.Parameters {
+		size += len(p.Name) + 1 + len(p.Value) + 1
+	}
+	buf := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(size))
+	binary.BigEndian.PutUint32(buf[4:8], sm.ProtocolVersion)
+	for _, p := range sm.Parameters {
+		buf = append(buf, p.Name...)
+		buf = append(buf, 0)
+		buf = append(buf, p.Value...)
+		buf = append(buf, 0)
+	}
+	return append(buf, 0)
+}
+
+// DecodeStartupMessage разбирает payload безтипового сообщения (без поля длины)
+// как StartupMessage. Возвращает ошибку, если версия протокола не 3.x
+// или список параметров повреждён.
+func DecodeStartupMessage(payload []byte) (StartupMessage, error) {
+	if len(payload) < 5 {
+		return StartupMessage{}, errors.New("startup message too short")
+	}
+	sm := StartupMessage{ProtocolVersion: binary.BigEndian.Uint32(payload[0:4])}
+	if sm.ProtocolVersion>>16 != 3 {
+		return StartupMessage{}, fmt.Errorf("unsupported protocol version %d.%d", sm.ProtocolVersion>>16, sm.ProtocolVersion&0xffff)
+	}
+
+	rest := payload[4:]
+	for len(rest) > 0 && rest[0] != 0 {
+		name, r, ok := cutCString(rest)
+		if !ok {
+			return StartupMessage{}, errors.New("startup parameter name is not null-terminated")
+		}
+		value, r, ok := cutCString(r)
+		if !ok {
+			return StartupMessage{}, fmt.Errorf("startup parameter %q value is not null-terminated", name)
+		}
+		sm.Parameters = append(sm.Parameters, StartupParameter{Name: name, Value: value})
+		rest = r
+	}
+	return sm, nil
+}
+
+// decodeNegotiateProtocolVersion разбирает тело NegotiateProtocolVersion ('v'): старшую
+// поддерживаемую сервером младшую версию протокола и параметры _pq_.*, которые сервер
+// не распознал.
+func decodeNegotiateProtocolVersion(body []byte) (minor uint32, unrecognized []string, err error) {
+	if len(body) < 8 {
+		return 0, nil, errors.New("NegotiateProtocolVersion too short")
+	}
+	minor = binary.BigEndian.Uint32(body[0:4])
+	n := binary.BigEndian.Uint32(body[4:8])
+	rest := body[8:]
+	for i := uint32(0); i < n; i++ {
+		name, r, ok := cutCString(rest)
+		if !ok {
+			return 0, nil, fmt.Errorf("NegotiateProtocolVersion option %d is not null-terminated", i+1)
+		}
+		unrecognized = append(unrecognized, name)
+		rest = r
+	}
+	return minor, unrecognized, nil
+}
+
+// StartupMessage возвращает разобранный StartupMessage, если сообщение является им.
+func (m PostgreSQLMessage) StartupMessage() (StartupMessage, bool) {
+	if m.Type.HaveTypeByte() {
+		return StartupMessage{}, false
+	}
+	sm, err := DecodeStartupMessage(m.Payload)
+	if err != nil {
+		return StartupMessage{}, false
+	}
+	return sm, true
+}
@@ -1,9 +1,15 @@
 package stream
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,6 +26,47 @@ type PostgreSQLMessage struct {
 	Type                     msgtypes.ClientMessageType
 	Len                      uint32
 	Payload                  []byte
+	// Compression — алгоритмы сжатия протокола, запрошенные клиентом в StartupMessage
+	// (параметр _pq_.compression) и не отклонённые сервером в NegotiateProtocolVersion.
+	// Непустое значение означает, что payload сообщений
+	// потока после startup может быть сжат и не содержит читаемого текста запроса.
+	Compression string
+	// StreamID — ключ TCP-потока (client->server), из которого собрано сообщение.
+	StreamID string
+	// ClientIP и ClientPort — адрес клиентской стороны исходного соединения.
+	ClientIP   string
+	ClientPort uint16
+	// CopyGroup — порядковый номер (с 1) операции COPY FROM STDIN внутри потока, к которой
+	// относится сообщение: запрос COPY и его CopyData/CopyDone/CopyFail. 0 — вне COPY.
+	CopyGroup int
+	// CommandTag — тег CommandComplete ответа, например "SELECT 42" или "INSERT 0 10".
+	// Для простого запроса из нескольких операторов — теги всех операторов через "; ".
+	CommandTag string
+	// ResponseError — ErrorResponse, которым сервер ответил в захвате. Ошибка прерывает
+	// простой запрос или конвейер расширенного протокола до Sync целиком, поэтому она
+	// относится к сообщению, завершающемуся ReadyForQuery (Query, Sync, FunctionCall, startup).
+	ResponseError *ErrorResponse
+}
+
+// ClientAddr возвращает адрес клиента исходного соединения в виде host:port.
+func (m PostgreSQLMessage) ClientAddr() string {
+	return net.JoinHostPort(m.ClientIP, strconv.Itoa(int(m.ClientPort)))
+}
+
+// RowsAffected возвращает число строк из CommandTag (см. CommandTagRows), для запроса из
+// нескольких операторов — сумму по всем тегам с числом строк. ok == false, если ни один
+// тег числа строк не содержит (BEGIN, SET) или ответ не попал в захват.
+func (m PostgreSQLMessage) RowsAffected() (rows int64, ok bool) {
+	if m.CommandTag == "" {
+		return 0, false
+	}
+	for _, tag := range strings.Split(m.CommandTag, "; ") {
+		if n, tagOK := CommandTagRows(tag); tagOK {
+			rows += n
+			ok = true
+		}
+	}
+	return rows, ok
 }
 
 // PrettyQuery возвращает строку с SQL запросом для вывода.
@@ -52,141 +99,480 @@ func (m PostgreSQLMessage) untypedByteRow() []byte {
 
 // TCPStream хранит буферы и сегменты для двух направлений одного TCP-потока.
 type TCPStream struct {
-	clientBuf                []byte
-	clientSegs               segments
-	serverBuf                []byte
-	serverSegs               segments
-	completed                []PostgreSQLMessage
+	clientBuf     []byte
+	clientSegs    segments
+	serverBuf     []byte
+	serverSegs    segments
+	completed     []PostgreSQLMessage
+	notifications []Notification
+	notices       []Notice
+	// collectServer включает сборку serverMessages (см. TCPStreamManager.CollectServer).
+	collectServer            bool
+	serverMessages           []ServerMessage
 	needCommandCompleteIndex int
 	needReadyForQueryIndex   int
+	maxMessageSize           uint32
+	compression              string
+	key                      string
+	clientIP                 string
+	clientPort               uint16
+	verifyRoundtrip          bool
+	roundtripMismatches      int
+	clientSeq                seqTracker
+	serverSeq                seqTracker
+	// payloads — память для Payload собранных сообщений; не очищается при Reset.
+	payloads payloadArena
+	logger   *slog.Logger
+
+	// encryptionRequested — клиент отправил SSLRequest/GSSENCRequest, и следующий байт
+	// сервера — однобайтовый ответ на него; до ответа данные клиента не разбираются.
+	// encrypted — шифрование согласовано (или клиент сразу начал TLS), дальнейшие данные
+	// потока не разбираются.
+	encryptionRequested bool
+	encrypted           bool
+
+	// copyGroup — номер последней операции COPY FROM STDIN; inCopy — сервер ответил
+	// CopyInResponse и клиентские CopyData относятся к этой операции.
+	copyGroup int
+	inCopy    bool
+
+	// copyBoth — сервер ответил CopyBothResponse (потоковая репликация): CopyData идут
+	// в обе стороны до CopyDone. Клиентские кадры этого режима не собираются,
+	// copyBothSkipped — их число.
+	copyBoth        bool
+	copyBothSkipped int
+
+	// terminated — клиент отправил Terminate ('X'), сессия завершена.
+	terminated bool
+
+	// expectedReady — число клиентских сообщений, на которые сервер отвечает ReadyForQuery
+	// (включая StartupMessage), seenReady — число полученных ReadyForQuery.
+	expectedReady int
+	seenReady     int
 }
 
 // NewTCPStream создаёт и возвращает новый экземпляр TCPStream.
 func NewTCPStream() *TCPStream {
-	return &TCPStream{
-		clientBuf:  make([]byte, 0),
-		clientSegs: make([]segment, 0),
-		serverBuf:  make([]byte, 0),
-		serverSegs: make([]segment, 0),
-		completed:  make([]PostgreSQLMessage, 0),
+	s := &TCPStream{
+		clientBuf: make([]byte, 0),
+		serverBuf: make([]byte, 0),
+		completed: make([]PostgreSQLMessage, 0),
+
+		maxMessageSize: DefaultMaxMessageSize,
 	}
+	s.setLogger(slog.Default())
+	return s
+}
+
+// setLogger задаёт журнал диагностики потока и его сборщиков сегментов.
+func (s *TCPStream) setLogger(logger *slog.Logger) {
+	s.logger = logger
+	s.clientSeq.logger = logger
+	s.serverSeq.logger = logger
 }
 
 // Reset очищает все внутренние буферы и сегменты TCPStream.
 func (s *TCPStream) Reset() {
 	s.clientBuf = s.clientBuf[:0]
-	s.clientSegs = s.clientSegs[:0]
+	s.clientSegs.reset()
 	s.serverBuf = s.serverBuf[:0]
-	s.serverSegs = s.serverSegs[:0]
+	s.serverSegs.reset()
 	s.completed = s.completed[:0]
+	s.notifications = s.notifications[:0]
+	s.notices = s.notices[:0]
+	s.serverMessages = s.serverMessages[:0]
+	s.compression = ""
+	s.needCommandCompleteIndex = 0
+	s.needReadyForQueryIndex = 0
+	s.expectedReady = 0
+	s.seenReady = 0
+	s.clientSeq.reset()
+	s.serverSeq.reset()
+	s.encryptionRequested = false
+	s.encrypted = false
+	s.copyGroup = 0
+	s.inCopy = false
+	s.copyBoth = false
+	s.copyBothSkipped = 0
+	s.terminated = false
 }
 
-// segment представляет один TCP пакет с его длиной и временной меткой.
+// segment представляет один TCP пакет: смещение его конца от начала направления потока
+// (накопленная сумма длин) и временную метку.
 type segment struct {
-	length uint32
-	ts     time.Time
+	end uint64
+	ts  time.Time
 }
 
-type segments []segment
+// segments — сегменты одного направления потока в порядке байтов буфера. base — смещение
+// первого байта буфера от начала направления. Благодаря накопленным смещениям сегмент ищется
+// двоичным поиском, а удаление прочитанных байтов не переписывает оставшиеся сегменты.
+type segments struct {
+	list []segment
+	base uint64
+}
 
-func (s segments) timestampByOffset(offset int) time.Time {
-	var acc uint32 = 0
-	for _, seg := range s {
-		if uint32(offset) < acc+seg.length {
-			return seg.ts
-		}
-		acc += seg.length
+// add дописывает сегмент длиной n байт.
+func (s *segments) add(n int, ts time.Time) {
+	end := s.base
+	if len(s.list) > 0 {
+		end = s.list[len(s.list)-1].end
+	}
+	s.list = append(s.list, segment{end: end + uint64(n), ts: ts})
+}
+
+// timestampByOffset возвращает метку сегмента, содержащего байт буфера со смещением offset,
+// или нулевое время, если такого байта ещё нет.
+func (s *segments) timestampByOffset(offset int) time.Time {
+	pos := s.base + uint64(offset)
+	i := sort.Search(len(s.list), func(i int) bool { return s.list[i].end > pos })
+	if i == len(s.list) {
+		return time.Time{}
 	}
-	return time.Time{}
+	return s.list[i].ts
+}
+
+// consume удаляет n прочитанных байт из начала буфера: полностью прочитанные сегменты
+// отбрасываются, частично прочитанный остаётся первым.
+func (s *segments) consume(n int) {
+	s.base += uint64(n)
+	i := sort.Search(len(s.list), func(i int) bool { return s.list[i].end > s.base })
+	s.list = s.list[i:]
 }
 
+// reset очищает сегменты вместе с буфером.
+func (s *segments) reset() {
+	s.list = s.list[:0]
+	s.base = 0
+}
+
+// DefaultMaxMessageSize — максимальная длина сообщения по умолчанию (64 МБ). PostgreSQL
+// допускает до 1 ГБ, но в реальном трафике такие сообщения редки, а повреждённое поле длины
+// иначе заставило бы копить в буфере потока гигабайты в ожидании конца кадра. Кадры
+// с большей длиной считаются рассинхронизацией потока.
+const DefaultMaxMessageSize uint32 = 64 << 20
+
 // TCPStreamManager управляет множеством TCPStream и обеспечивает
 // сборку полных PostgreSQL‑сообщений и связывание CommandComplete.
 type TCPStreamManager struct {
-	streams map[string]*TCPStream
+	streams       map[string]*TCPStream
+	notifications []Notification
+	notices       []Notice
+	multiplexed   []string
+	encrypted     []string
+
+	// CollectServer включает сборку разобранных серверных сообщений потоков (см. ServerMessage);
+	// они доступны через ServerMessages. По умолчанию серверное направление только
+	// размечает клиентские сообщения метками CommandComplete и ReadyForQuery.
+	CollectServer  bool
+	serverMessages []ServerMessage
+
+	// MaxMessageSize ограничивает длину кадра в обоих направлениях; при превышении
+	// парсер выполняет ресинхронизацию (см. resyncClient, resyncServer).
+	MaxMessageSize uint32
+
+	// Dedup включает отбрасывание полных копий пакетов (тот же 4-tuple, seq и payload
+	// в пределах DedupWindow), возникающих при слиянии захватов с нескольких отводов.
+	Dedup       bool
+	DedupWindow time.Duration
+	deduper     *packetDeduper
+	duplicates  int
+
+	// SampleRate — доля потоков (0..1), пакеты которых собираются; остальные потоки
+	// пропускаются целиком, так что в выборку не попадает часть сессии. Поток выбирается
+	// по хешу ключа, одинаково при каждом запуске. 0 или 1 — все потоки.
+	SampleRate float64
+	sampledOut map[string]bool
+
+	// VerifyRoundtrip включает проверку, что Row() каждого собранного клиентского
+	// сообщения побайтно совпадает с байтами, наблюдавшимися на проводе.
+	VerifyRoundtrip     bool
+	roundtripMismatches int
+
+	// OnStreamClosed, если задан, получает сообщения потока, завершённого клиентом
+	// (Terminate) и получившего все ответы, сразу по завершении; буферы потока при этом
+	// освобождаются. Без обработчика сообщения таких потоков копятся в менеджере
+	// и возвращаются CollectMessages.
+	OnStreamClosed func(streamID string, messages []PostgreSQLMessage)
+	closedMessages []PostgreSQLMessage
+
+	// Logger получает предупреждения сборки (рассинхронизация, пропуски, незавершённые
+	// сообщения); nil — slog.Default().
+	Logger *slog.Logger
+	// closedStreams — ключи завершённых потоков: запоздавшие пакеты (повторные передачи
+	// Terminate, FIN с данными) не должны открывать их заново.
+	closedStreams map[string]bool
 }
 
 // NewTCPStreamManager создаёт и возвращает новый менеджер TCP-потоков.
 func NewTCPStreamManager() *TCPStreamManager {
 	return &TCPStreamManager{
-		streams: make(map[string]*TCPStream),
+		streams:        make(map[string]*TCPStream),
+		closedStreams:  make(map[string]bool),
+		MaxMessageSize: DefaultMaxMessageSize,
+	}
+}
+
+func (m *TCPStreamManager) logger() *slog.Logger {
+	if m.Logger != nil {
+		return m.Logger
 	}
+	return slog.Default()
 }
 
 // AddPacket добавляет один TCP-пакет в поток с идентификатором key.
 // serverPort используется для определения направления (client<->server).
+// seq — порядковый номер TCP-сегмента: по нему данные собираются в порядке потока, а не прихода
+// (повторные передачи отбрасываются); при включённом Dedup по нему же отбрасываются копии пакета.
 // Данные от клиента накапливаются и из них извлекаются полные PostgreSQL‑сообщения,
 // которые сохраняются во внутреннем срезе completed.
 // Данные от сервера накапливаются и сканируются на предмет сообщений типа CommandComplete и ReadyForQuery.
 // Для найденного типа выставляется Timestamp для первой незавершённой клиентской записи в completed.
-func (m *TCPStreamManager) AddPacket(data []byte, timestamp time.Time, ipSrc, ipDst string, portSrc, portDst uint16, serverIp string, serverPort uint16) error {
+func (m *TCPStreamManager) AddPacket(data []byte, timestamp time.Time, ipSrc, ipDst string, portSrc, portDst uint16, seq uint32, serverIp string, serverPort uint16) error {
+	if m.Dedup {
+		if m.deduper == nil {
+			m.deduper = newPacketDeduper(m.DedupWindow)
+		}
+		if m.deduper.duplicate(data, timestamp, ipSrc, ipDst, portSrc, portDst, seq) {
+			m.duplicates++
+			return nil
+		}
+	}
+
 	isFromServer := ipSrc == serverIp && portSrc == serverPort
 
 	key := fmt.Sprintf("%s:%d->%s:%d", ipSrc, portSrc, ipDst, portDst)
 	if isFromServer {
 		key = fmt.Sprintf("%s:%d->%s:%d", ipDst, portDst, ipSrc, portSrc)
 	}
+	if !sampled(key, m.SampleRate) {
+		if m.sampledOut == nil {
+			m.sampledOut = make(map[string]bool)
+		}
+		m.sampledOut[key] = true
+		return nil
+	}
 
 	stream, ok := m.streams[key]
+	if !ok && m.closedStreams[key] {
+		// новое соединение с тем же адресом и портом начинается со startup клиента
+		if isFromServer || classifyPayload(data) != sideClient {
+			return nil
+		}
+		delete(m.closedStreams, key)
+	}
 	if !ok {
 		stream = NewTCPStream()
+		stream.maxMessageSize = m.MaxMessageSize
+		stream.key = key
+		stream.setLogger(m.logger())
+		stream.verifyRoundtrip = m.VerifyRoundtrip
+		stream.collectServer = m.CollectServer
+		stream.clientIP, stream.clientPort = ipSrc, portSrc
+		if isFromServer {
+			stream.clientIP, stream.clientPort = ipDst, portDst
+		}
 		m.streams[key] = stream
 	}
 
 	if data == nil {
 		return errors.New("data is nil")
 	}
-	if len(data) < 4 {
-		return errors.New("data length less than 4 bytes")
+	// короткие сегменты допустимы: ответ сервера на SSLRequest занимает один байт,
+	// а хвост сообщения может прийти отдельным маленьким сегментом
+	if len(data) == 0 {
+		return errors.New("data is empty")
 	}
 
 	if isFromServer {
-		stream.addServerData(data, timestamp)
+		stream.addServerData(data, timestamp, seq)
 	} else {
-		stream.addClientData(data, timestamp)
+		stream.addClientData(data, timestamp, seq)
 	}
 
+	if stream.terminated && stream.answered() {
+		messages := m.finishStream(key, stream)
+		m.closedStreams[key] = true
+		if m.OnStreamClosed != nil {
+			m.OnStreamClosed(key, messages)
+		} else {
+			m.closedMessages = append(m.closedMessages, messages...)
+		}
+	}
 	return nil
 }
 
 // CollectMessages возвращает все собранные клиентские сообщения из текущих потоков.
 // После возврата сообщения и все внутренние буферы/сегменты потока очищаются,
 // а поток удаляется из менеджера (освобождение памяти и сброс состояния).
+// Уведомления NotificationResponse и NoticeResponse потоков переносятся в менеджер и доступны
+// через Notifications и Notices.
 func (m *TCPStreamManager) CollectMessages() []PostgreSQLMessage {
-	var out []PostgreSQLMessage
+	out := m.closedMessages
+	m.closedMessages = nil
 	for key, s := range m.streams {
-		if len(s.completed) > 0 {
-			out = append(out, s.completed...)
-		}
-		s.Reset()
-		delete(m.streams, key)
+		out = append(out, m.finishStream(key, s)...)
 	}
 	return out
 }
 
-func (s *TCPStream) addClientData(data []byte, timestamp time.Time) {
-	s.clientBuf = append(s.clientBuf, data...)
-	s.clientSegs = append(s.clientSegs, segment{length: uint32(len(data)), ts: timestamp})
+// finishStream возвращает сообщения потока key, переносит его статистику и уведомления
+// в менеджер и удаляет поток.
+func (m *TCPStreamManager) finishStream(key string, s *TCPStream) []PostgreSQLMessage {
+	out := s.completed
+	if s.suspectMultiplexed() {
+		m.logger().Warn("ReadyForQuery count differs from client requests, responses may be multiplexed by a pooler; latency correlation is unreliable",
+			"stream", key, "ready", s.seenReady, "requests", s.expectedReady)
+		m.multiplexed = append(m.multiplexed, key)
+	}
+	if s.copyBothSkipped > 0 {
+		m.logger().Warn("skipped client CopyData of replication streaming (CopyBothResponse), replication is not replayable",
+			"stream", key, "frames", s.copyBothSkipped)
+	}
+	if s.encrypted {
+		m.encrypted = append(m.encrypted, key)
+	}
+	m.notifications = append(m.notifications, s.notifications...)
+	m.notices = append(m.notices, s.notices...)
+	m.serverMessages = append(m.serverMessages, s.serverMessages...)
+	m.roundtripMismatches += s.roundtripMismatches
+	s.completed = nil
+	s.serverMessages = nil
+	s.Reset()
+	delete(m.streams, key)
+	return out
+}
+
+// FlushPartial завершает сборку в конце захвата и возвращает сообщения, как CollectMessages.
+// Сегменты, ждавшие недостающих данных, дописываются в буферы через пропуск и разбираются.
+// Клиентское сообщение, ответ на которое не попал в захват, возвращается с нулевым
+// CommandCompleteTimestamp. Оставшиеся байты незавершённых сообщений отбрасываются
+// с предупреждением по каждому потоку.
+func (m *TCPStreamManager) FlushPartial() []PostgreSQLMessage {
+	for key, s := range m.streams {
+		s.flushPending()
+		if n := len(s.clientBuf); n > 0 {
+			m.logger().Warn("undrained client bytes at end of capture, incomplete message dropped", "stream", key, "bytes", n)
+		}
+		if n := len(s.serverBuf); n > 0 {
+			m.logger().Warn("undrained server bytes at end of capture", "stream", key, "bytes", n)
+		}
+	}
+	return m.CollectMessages()
+}
+
+// SuspectedMultiplexed возвращает ключи потоков, у которых число ReadyForQuery сервера
+// не сходится с числом клиентских запросов. Так выглядят соединения за пулером
+// (PgBouncer в режиме transaction), где ответы сопоставляются с запросами ненадёжно.
+// Список пополняется при вызовах CollectMessages.
+func (m *TCPStreamManager) SuspectedMultiplexed() []string {
+	return m.multiplexed
+}
+
+// EncryptedStreams возвращает ключи потоков, согласовавших TLS или GSSAPI-шифрование: их
+// сообщения после рукопожатия не разбираются и в результат не попадают.
+// Список пополняется при вызовах CollectMessages.
+func (m *TCPStreamManager) EncryptedStreams() []string {
+	return m.encrypted
+}
+
+// ServerMessages возвращает серверные сообщения завершённых потоков (при CollectServer),
+// по потокам в порядке прихода. Список пополняется при вызовах CollectMessages.
+func (m *TCPStreamManager) ServerMessages() []ServerMessage {
+	return m.serverMessages
+}
+
+// SampledOutStreams возвращает число потоков, не вошедших в выборку SampleRate.
+func (m *TCPStreamManager) SampledOutStreams() int {
+	return len(m.sampledOut)
+}
+
+// DuplicatePackets возвращает число пакетов, отброшенных как дубликаты (см. Dedup).
+func (m *TCPStreamManager) DuplicatePackets() int {
+	return m.duplicates
+}
+
+// RoundtripMismatches возвращает число сообщений, для которых Row() не совпал с байтами
+// на проводе (см. VerifyRoundtrip). Счётчик пополняется при вызовах CollectMessages.
+func (m *TCPStreamManager) RoundtripMismatches() int {
+	return m.roundtripMismatches
+}
+
+// Notifications возвращает уведомления NotificationResponse ('A'), собранные
+// из потоков при вызовах CollectMessages.
+func (m *TCPStreamManager) Notifications() []Notification {
+	return m.notifications
+}
+
+// Notices возвращает сообщения NoticeResponse ('N'), собранные из потоков при вызовах
+// CollectMessages.
+func (m *TCPStreamManager) Notices() []Notice {
+	return m.notices
+}
+
+// addClientData дописывает в clientBuf данные сегмента seq в порядке порядковых номеров
+// (см. seqTracker) и разбирает накопленный буфер.
+func (s *TCPStream) addClientData(data []byte, timestamp time.Time, seq uint32) {
+	s.appendClient(s.clientSeq.accept(seq, data, timestamp))
+}
+
+// addServerData — то же, что addClientData, для серверного направления.
+func (s *TCPStream) addServerData(data []byte, timestamp time.Time, seq uint32) {
+	s.appendServer(s.serverSeq.accept(seq, data, timestamp))
+}
+
+func (s *TCPStream) appendClient(ready []pendingSegment) {
+	if len(ready) == 0 {
+		return
+	}
+	for _, seg := range ready {
+		s.clientBuf = append(s.clientBuf, seg.data...)
+		s.clientSegs.add(len(seg.data), seg.ts)
+	}
 	s.parseClientBuffer()
 }
 
-func (s *TCPStream) addServerData(data []byte, timestamp time.Time) {
-	s.serverBuf = append(s.serverBuf, data...)
-	s.serverSegs = append(s.serverSegs, segment{length: uint32(len(data)), ts: timestamp})
+func (s *TCPStream) appendServer(ready []pendingSegment) {
+	if len(ready) == 0 {
+		return
+	}
+	for _, seg := range ready {
+		s.serverBuf = append(s.serverBuf, seg.data...)
+		s.serverSegs.add(len(seg.data), seg.ts)
+	}
 	s.parseServerBuffer()
 }
 
+// flushPending дописывает в буферы сегменты, так и не дождавшиеся недостающих данных,
+// переходя через пропуски, и разбирает получившиеся буферы.
+func (s *TCPStream) flushPending() {
+	for len(s.clientSeq.pending) > 0 {
+		s.clientSeq.skipGap()
+		s.appendClient(s.clientSeq.drain(nil))
+	}
+	for len(s.serverSeq.pending) > 0 {
+		s.serverSeq.skipGap()
+		s.appendServer(s.serverSeq.drain(nil))
+	}
+}
+
 // tryCreateTypedMessage пытается создать PostgreSQLMessage с типом.
 func (s *TCPStream) tryCreateTypedMessage() (msg PostgreSQLMessage, processed int) {
 	msgType := s.clientMessageType()
+	if len(s.clientBuf) < 5 {
+		return PostgreSQLMessage{}, 0
+	}
 	dataLen := int(binary.BigEndian.Uint32(s.clientBuf[1:5]))
+	// поле длины включает само себя; меньшее значение — признак повреждённого потока
+	if dataLen < 4 {
+		return PostgreSQLMessage{}, 0
+	}
 	total := 1 + dataLen
 	if len(s.clientBuf) < total {
 		return PostgreSQLMessage{}, 0
 	}
 	payloadLen := dataLen - 4
-	payload := make([]byte, payloadLen)
-	copy(payload, s.clientBuf[5:5+payloadLen])
+	payload := s.payloads.copy(s.clientBuf[5 : 5+payloadLen])
 	msgFirstTs := s.clientSegs.timestampByOffset(0)
 	msgLastTs := s.clientSegs.timestampByOffset(total - 1)
 	return PostgreSQLMessage{
@@ -204,12 +590,11 @@ func (s *TCPStream) tryCreateTypedMessage() (msg PostgreSQLMessage, processed in
 func (s *TCPStream) tryCreateUntypedMessage() (msg PostgreSQLMessage, processed int) {
 	remaining := s.clientBuf[:]
 	dataLen := int(binary.BigEndian.Uint32(remaining[0:4]))
-	if len(s.clientBuf) < dataLen {
+	if dataLen < 4 || len(s.clientBuf) < dataLen {
 		return PostgreSQLMessage{}, 0
 	}
 	payloadLen := dataLen - 4
-	payload := make([]byte, payloadLen)
-	copy(payload, remaining[4:4+payloadLen])
+	payload := s.payloads.copy(remaining[4 : 4+payloadLen])
 	msgFirstTs := s.clientSegs.timestampByOffset(0)
 	msgLastTs := s.clientSegs.timestampByOffset(dataLen - 1)
 	return PostgreSQLMessage{
@@ -225,23 +610,69 @@ func (s *TCPStream) tryCreateUntypedMessage() (msg PostgreSQLMessage, processed
 
 // parseClientBuffer извлекает целые PostgreSQLMessage из clientBuf и добавляет их в completed.
 func (s *TCPStream) parseClientBuffer() {
-	for len(s.clientBuf) > 3 {
+	if !s.encrypted && len(s.completed) == 0 && startsWithTLSRecord(s.clientBuf) {
+		// прямое TLS-подключение (sslnegotiation=direct) начинается с ClientHello без SSLRequest
+		s.logger.Warn("client started TLS without SSLRequest, stream is not parseable", "stream", s.key)
+		s.encrypted = true
+	}
+	if s.encrypted {
+		s.clearProcessedBytes(len(s.clientBuf))
+		return
+	}
+	for len(s.clientBuf) > 3 && !s.encryptionRequested {
 		var msg PostgreSQLMessage
 		var processed int
 
 		msgType := s.clientMessageType()
+		if !msgType.HaveTypeByte() && s.skipEncryptionRequest() {
+			continue
+		}
+		if !s.plausibleClientFrame() {
+			skipped := s.resyncClient()
+			if skipped == 0 {
+				break
+			}
+			s.logger.Warn("client stream desync", "stream", s.key, "skipped_bytes", skipped)
+			s.clearProcessedBytes(skipped)
+			continue
+		}
 		if msgType.HaveTypeByte() {
 			msg, processed = s.tryCreateTypedMessage()
 		} else {
 			msg, processed = s.tryCreateUntypedMessage()
 		}
 
+		if processed > 0 && s.copyBoth && msg.Type.IsCopyStream() {
+			// сообщения о положении реплики и её CopyDone — часть протокола репликации, не запросы
+			s.copyBothSkipped++
+			s.clearProcessedBytes(processed)
+			continue
+		}
 		if processed > 0 {
-			if !msg.Type.NeedCommandCompleteAnswer() {
-				s.needCommandCompleteIndex++
+			if s.verifyRoundtrip && !bytes.Equal(msg.Row(), s.clientBuf[:processed]) {
+				s.logger.Warn("message does not round-trip through Row()", "stream", s.key, "type", msg.Type.String(), "bytes", processed)
+				s.roundtripMismatches++
 			}
-			if !msg.Type.NeedReadyForQueryAnswer() {
-				s.needReadyForQueryIndex++
+			if sm, ok := msg.StartupMessage(); ok {
+				if c, ok := sm.Get(CompressionStartupParameter); ok && c != "" {
+					s.logger.Warn("stream requests protocol compression, payloads may be undecodable", "stream", s.key, "compression", c)
+					s.compression = c
+				}
+			}
+			msg.Compression = s.compression
+			if awaitsReadyForQuery(msg) {
+				s.expectedReady++
+			}
+			msg.StreamID = s.key
+			if s.inCopy && msg.Type.IsCopyStream() {
+				msg.CopyGroup = s.copyGroup
+				if msg.Type != msgtypes.MessageTypeCopyData {
+					s.inCopy = false
+				}
+			}
+			msg.ClientIP, msg.ClientPort = s.clientIP, s.clientPort
+			if msg.Type == msgtypes.MessageTypeTerminate {
+				s.terminated = true
 			}
 			s.completed = append(s.completed, msg)
 			s.clearProcessedBytes(processed)
@@ -251,93 +682,341 @@ func (s *TCPStream) parseClientBuffer() {
 	}
 }
 
+// startsWithTLSRecord сообщает, что buf начинается с заголовка TLS-записи рукопожатия
+// (тип 0x16, версия 3.x). Клиентского сообщения PostgreSQL с таким байтом типа нет.
+func startsWithTLSRecord(buf []byte) bool {
+	return len(buf) >= 3 && buf[0] == 0x16 && buf[1] == 0x03
+}
+
+// skipEncryptionRequest пропускает SSLRequest или GSSENCRequest в начале clientBuf:
+// это не сообщение сессии, и воспроизводить его нельзя. Сообщает, был ли запрос пропущен.
+func (s *TCPStream) skipEncryptionRequest() bool {
+	if len(s.clientBuf) < 8 || binary.BigEndian.Uint32(s.clientBuf[0:4]) != 8 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(s.clientBuf[4:8]) {
+	case SSLRequestCode:
+		s.logger.Debug("client sent SSLRequest", "stream", s.key)
+	case GSSENCRequestCode:
+		s.logger.Debug("client sent GSSENCRequest", "stream", s.key)
+	default:
+		return false
+	}
+	s.encryptionRequested = true
+	s.clearProcessedBytes(8)
+	return true
+}
+
+// clearProcessedBytes удаляет из clientBuf первые processed байтов вместе с их сегментами.
+// Частично прочитанный сегмент остаётся: в одном сегменте часто приходят несколько
+// сообщений (например, конвейер Parse/Bind/Execute/Sync). Полностью разобранный буфер
+// начинается заново с начала своей памяти: payload сообщений на неё не ссылаются.
 func (s *TCPStream) clearProcessedBytes(processed int) {
-	s.clientBuf = s.clientBuf[processed:]
-	bytes := uint32(0)
-	checkedSegs := 0
-	for bytes < uint32(processed) {
-		bytes += s.clientSegs[checkedSegs].length
-		checkedSegs++
+	if processed == len(s.clientBuf) {
+		s.clientBuf = s.clientBuf[:0]
+	} else {
+		s.clientBuf = s.clientBuf[processed:]
 	}
-	s.clientSegs = s.clientSegs[checkedSegs:]
+	s.clientSegs.consume(processed)
 }
 
 // parseServerBuffer извлекает серверные сообщения из serverBuf и для каждого
 // сообщения типа 'C' (CommandComplete) назначает CommandCompleteTimestamp для первой
 // незавершённой клиентской записи в s.completed.
-func (s *TCPStream) parseServerBuffer() { // TODO: сделать нормально
+// Если тип или длина кадра неправдоподобны, выполняется ресинхронизация:
+// парсер ищет следующую правдоподобную границу кадра и пропускает байты до неё.
+func (s *TCPStream) parseServerBuffer() {
 	var processed uint32 = 0
 
+	if s.encryptionRequested && len(s.serverBuf) > 0 {
+		s.encryptionRequested = false
+		if answer := s.serverBuf[0]; answer == 'S' || answer == 'G' {
+			s.logger.Warn("server accepted encryption, stream is not parseable", "stream", s.key, "answer", string(answer))
+			s.encrypted = true
+			s.clearProcessedBytes(len(s.clientBuf))
+		} else {
+			// сервер отказал: придержанные данные клиента — открытый StartupMessage
+			s.parseClientBuffer()
+		}
+		processed = 1
+	}
+	if s.encrypted {
+		s.serverBuf = s.serverBuf[:0]
+		s.serverSegs.reset()
+		return
+	}
+
 	for rem := uint32(len(s.serverBuf)) - processed; rem > 0; rem = uint32(len(s.serverBuf)) - processed {
 		if rem < 5 {
 			break
 		}
 		remaining := s.serverBuf[processed:]
 		first := remaining[0]
-		isASCIIType := (first >= 'A' && first <= 'Z') || (first >= 'a' && first <= 'z')
-		if isASCIIType {
-			lenField := binary.BigEndian.Uint32(remaining[1:5])
-			if lenField <= 0 {
-				break
-			}
-			total := uint32(1) + lenField
-			if rem < total {
-				break
-			}
-
-			if first == 'C' {
-				ts := s.serverSegs.timestampByOffset(int(processed))
-				s.assignCommandComplete(ts)
-			}
-			processed += total
+		lenField := binary.BigEndian.Uint32(remaining[1:5])
+		if !s.plausibleServerFrame(first, lenField) {
+			skipped := s.resyncServer(remaining)
+			s.logger.Warn("server stream desync", "stream", s.key, "skipped_bytes", skipped)
+			processed += skipped
 			continue
 		}
 
-		lenField := binary.BigEndian.Uint32(remaining[0:4])
-		if lenField <= 0 {
-			break
-		}
-		total := lenField
+		total := uint32(1) + lenField
 		if rem < total {
 			break
 		}
+
+		if s.collectServer {
+			sm := decodeServerMessage(msgtypes.ServerMessageType(first), remaining[5:total])
+			sm.Timestamp = s.serverSegs.timestampByOffset(int(processed))
+			sm.StreamID, sm.ClientIP, sm.ClientPort = s.key, s.clientIP, s.clientPort
+			s.serverMessages = append(s.serverMessages, sm)
+		}
+
+		switch msgtypes.ServerMessageType(first) {
+		case msgtypes.MessageTypeCommandComplete:
+			ts := s.serverSegs.timestampByOffset(int(processed))
+			s.assignCommandComplete(ts, strings.TrimRight(string(remaining[5:total]), "\x00"))
+		case msgtypes.MessageTypeEmptyQueryResponse, msgtypes.MessageTypePortalSuspended:
+			s.skipCommandComplete()
+		case msgtypes.MessageTypeErrorResponse:
+			s.assignErrorResponse(remaining[5:total])
+		case msgtypes.MessageTypeCopyInResponse:
+			s.startCopy()
+		case msgtypes.MessageTypeCopyBothResponse:
+			s.copyBoth = true
+		case msgtypes.MessageTypeNegotiateProtocol:
+			s.negotiateProtocol(remaining[5:total])
+		case msgtypes.MessageTypeServerCopyDone:
+			s.copyBoth = false
+		case msgtypes.MessageTypeReadyForQuery:
+			s.copyBoth = false
+			s.seenReady++
+			ts := s.serverSegs.timestampByOffset(int(processed))
+			s.assignReadyForQuery(ts)
+		case msgtypes.MessageTypeNotificationResponse:
+			// NotificationResponse приходит асинхронно и не является ответом на запрос,
+			// поэтому индексы сопоставления не сдвигаются.
+			n, err := DecodeNotification(remaining[5:total])
+			if err != nil {
+				s.logger.Warn("decode NotificationResponse failed", "stream", s.key, "err", err)
+				break
+			}
+			n.Timestamp = s.serverSegs.timestampByOffset(int(processed))
+			s.notifications = append(s.notifications, n)
+		case msgtypes.MessageTypeNoticeResponse:
+			// NoticeResponse тоже не завершает ответ и не сдвигает индексы сопоставления
+			er, err := DecodeErrorResponse(remaining[5:total])
+			if err != nil {
+				s.logger.Warn("decode NoticeResponse failed", "stream", s.key, "err", err)
+				break
+			}
+			ts := s.serverSegs.timestampByOffset(int(processed))
+			s.notices = append(s.notices, Notice{Timestamp: ts, Response: er})
+		}
 		processed += total
 	}
 
 	if processed > 0 {
 		if processed >= uint32(len(s.serverBuf)) {
 			s.serverBuf = s.serverBuf[:0]
-			s.serverSegs = s.serverSegs[:0]
+			s.serverSegs.reset()
 		} else {
 			s.serverBuf = s.serverBuf[processed:]
-			rem := processed
-			newSegs := make([]segment, 0, len(s.serverSegs))
-			for _, seg := range s.serverSegs {
-				if rem <= 0 {
-					newSegs = append(newSegs, seg)
-					continue
-				}
-				if rem < seg.length {
-					seg.length -= rem
-					newSegs = append(newSegs, seg)
-					rem = 0
-				} else {
-					rem -= seg.length
-				}
-			}
-			s.serverSegs = newSegs
+			s.serverSegs.consume(int(processed))
 		}
 	}
 }
 
-func (s *TCPStream) assignCommandComplete(ts time.Time) {
-	s.completed[s.needCommandCompleteIndex].CommandCompleteTimestamp = ts
-	s.needCommandCompleteIndex++
+// negotiateProtocol обрабатывает NegotiateProtocolVersion: если сервер не распознал
+// запрошенный клиентом _pq_.compression, сжатие не включено, и признак Compression
+// снимается с сообщений потока.
+func (s *TCPStream) negotiateProtocol(body []byte) {
+	if s.compression == "" {
+		return
+	}
+	_, unrecognized, err := decodeNegotiateProtocolVersion(body)
+	if err != nil {
+		s.logger.Warn("decode NegotiateProtocolVersion failed", "stream", s.key, "err", err)
+		return
+	}
+	if !slices.Contains(unrecognized, CompressionStartupParameter) {
+		return
+	}
+	s.logger.Info("server rejected protocol compression", "stream", s.key, "compression", s.compression)
+	s.compression = ""
+	for i := range s.completed {
+		s.completed[i].Compression = ""
+	}
 }
 
+// plausibleClientFrame проверяет заголовок кадра в начале clientBuf: у сообщения с типом
+// байт типа известен, а длина не меньше собственного размера и не превышает
+// maxMessageSize; сообщение без типа (startup) допустимо только первым в потоке и не
+// длиннее предела startup-пакета. Неполный заголовок считается правдоподобным.
+func (s *TCPStream) plausibleClientFrame() bool {
+	buf := s.clientBuf
+	if !s.clientMessageType().HaveTypeByte() {
+		n := binary.BigEndian.Uint32(buf[0:4])
+		return len(s.completed) == 0 && n >= 8 && n <= maxStartupPacketSize
+	}
+	if len(buf) < 5 {
+		return true
+	}
+	n := binary.BigEndian.Uint32(buf[1:5])
+	return s.clientMessageType().IsKnown() && n >= 4 && n <= s.maxMessageSize
+}
+
+// resyncClient возвращает число байт в начале clientBuf до следующего правдоподобного
+// кадра с типом. Случайное совпадение байта типа и длины нередко, поэтому если кадр
+// целиком в буфере, за ним тоже должен начинаться кадр известного типа. Если кадр
+// не найден, последние 4 байта сохраняются, как в resyncServer.
+func (s *TCPStream) resyncClient() int {
+	buf := s.clientBuf
+	for off := 1; off+5 <= len(buf); off++ {
+		n := binary.BigEndian.Uint32(buf[off+1 : off+5])
+		if !msgtypes.ClientMessageType(buf[off]).IsKnown() || n < 4 || n > s.maxMessageSize {
+			continue
+		}
+		if next := off + 1 + int(n); next < len(buf) && !msgtypes.ClientMessageType(buf[next]).IsKnown() {
+			continue
+		}
+		return off
+	}
+	return max(len(buf)-4, 0)
+}
+
+// plausibleServerFrame проверяет, что байт типа известен, а поле длины
+// не меньше собственного размера и не превышает maxMessageSize.
+func (s *TCPStream) plausibleServerFrame(typ byte, lenField uint32) bool {
+	return msgtypes.ServerMessageType(typ).IsKnown() && lenField >= 4 && lenField <= s.maxMessageSize
+}
+
+// resyncServer возвращает число байт, которые нужно пропустить в buf, чтобы дойти
+// до следующего правдоподобного серверного кадра. Если такой кадр не найден,
+// последние 4 байта сохраняются: с них может начинаться ещё не дочитанный заголовок.
+func (s *TCPStream) resyncServer(buf []byte) uint32 {
+	for off := 1; off+5 <= len(buf); off++ {
+		if s.plausibleServerFrame(buf[off], binary.BigEndian.Uint32(buf[off+1:off+5])) {
+			return uint32(off)
+		}
+	}
+	return uint32(len(buf) - 4)
+}
+
+// assignCommandComplete назначает CommandCompleteTimestamp первому ещё не отвеченному
+// сообщению, ожидающему CommandComplete (Query или Execute), так что ответы на
+// конвейер P/B/E/.../S сопоставляются по порядку. Execute получает ровно один
+// CommandComplete. Простой запрос может содержать несколько операторов: он получает
+// метку первого CommandComplete, теги всех операторов и считается отвеченным по
+// ReadyForQuery (см. assignReadyForQuery).
+func (s *TCPStream) assignCommandComplete(ts time.Time, tag string) {
+	i := s.nextCommandComplete()
+	if i < 0 {
+		return
+	}
+	if s.completed[i].CommandCompleteTimestamp.IsZero() {
+		s.completed[i].CommandCompleteTimestamp = ts
+		s.completed[i].CommandTag = tag
+	} else {
+		s.completed[i].CommandTag += "; " + tag
+	}
+	if s.completed[i].Type != msgtypes.MessageTypeQuery {
+		s.needCommandCompleteIndex++
+	}
+}
+
+// skipCommandComplete учитывает EmptyQueryResponse или PortalSuspended: Execute
+// завершился без CommandComplete, и следующий CommandComplete относится к следующему сообщению.
+func (s *TCPStream) skipCommandComplete() {
+	if i := s.nextCommandComplete(); i >= 0 && s.completed[i].Type != msgtypes.MessageTypeQuery {
+		s.needCommandCompleteIndex++
+	}
+}
+
+// nextCommandComplete возвращает индекс первого неотвеченного сообщения, ожидающего
+// CommandComplete, или -1.
+func (s *TCPStream) nextCommandComplete() int {
+	for s.needCommandCompleteIndex < len(s.completed) && !s.completed[s.needCommandCompleteIndex].Type.NeedCommandCompleteAnswer() {
+		s.needCommandCompleteIndex++
+	}
+	if s.needCommandCompleteIndex >= len(s.completed) {
+		return -1
+	}
+	return s.needCommandCompleteIndex
+}
+
+// assignReadyForQuery назначает ReadyForQueryTimestamp первому ещё не отвеченному
+// сообщению, которое завершается ReadyForQuery; сообщения, на которые сервер
+// отдельно не отвечает (Parse, Bind, PasswordMessage и т.д.), пропускаются.
 func (s *TCPStream) assignReadyForQuery(ts time.Time) {
+	for s.needReadyForQueryIndex < len(s.completed) && !awaitsReadyForQuery(s.completed[s.needReadyForQueryIndex]) {
+		s.needReadyForQueryIndex++
+	}
+	if s.needReadyForQueryIndex >= len(s.completed) {
+		return
+	}
 	s.completed[s.needReadyForQueryIndex].ReadyForQueryTimestamp = ts
 	s.needReadyForQueryIndex++
+	// ReadyForQuery завершает ответ целиком: Execute, на которые CommandComplete не пришёл
+	// (ошибка в конвейере), и простой запрос больше CommandComplete не получат
+	s.needCommandCompleteIndex = max(s.needCommandCompleteIndex, s.needReadyForQueryIndex)
+}
+
+// assignErrorResponse сохраняет ErrorResponse в первом ещё не отвеченном сообщении,
+// которое завершается ReadyForQuery. Если ошибок до ReadyForQuery несколько, сохраняется первая.
+func (s *TCPStream) assignErrorResponse(body []byte) {
+	er, err := DecodeErrorResponse(body)
+	if err != nil {
+		s.logger.Warn("decode ErrorResponse failed", "stream", s.key, "err", err)
+		return
+	}
+	for i := s.needReadyForQueryIndex; i < len(s.completed); i++ {
+		if awaitsReadyForQuery(s.completed[i]) {
+			if s.completed[i].ResponseError == nil {
+				s.completed[i].ResponseError = &er
+			}
+			return
+		}
+	}
+}
+
+// startCopy открывает новую операцию COPY FROM STDIN по CopyInResponse сервера и относит
+// к ней последний запрос клиента (Query или Execute), на который пришёл этот ответ.
+func (s *TCPStream) startCopy() {
+	s.copyGroup++
+	s.inCopy = true
+	for i := len(s.completed) - 1; i >= 0; i-- {
+		if t := s.completed[i].Type; t == msgtypes.MessageTypeQuery || t == msgtypes.MessageTypeExecute {
+			s.completed[i].CopyGroup = s.copyGroup
+			return
+		}
+	}
+}
+
+// answered сообщает, что все сообщения потока, ждущие ReadyForQuery, его получили.
+func (s *TCPStream) answered() bool {
+	for _, m := range s.completed[s.needReadyForQueryIndex:] {
+		if awaitsReadyForQuery(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// awaitsReadyForQuery сообщает, что ответ сервера на m заканчивается ReadyForQuery:
+// так завершаются простой запрос, Sync, FunctionCall и startup-последовательность.
+func awaitsReadyForQuery(m PostgreSQLMessage) bool {
+	return m.Type.NeedReadyForQueryAnswer() || !m.Type.HaveTypeByte()
+}
+
+// suspectMultiplexed сообщает о расхождении числа ReadyForQuery и клиентских запросов
+// больше чем на один: один ответ может потеряться на границе захвата.
+func (s *TCPStream) suspectMultiplexed() bool {
+	if s.seenReady == 0 || s.expectedReady == 0 {
+		return false
+	}
+	diff := s.seenReady - s.expectedReady
+	return diff > 1 || diff < -1
 }
 
 func (s *TCPStream) clientMessageType() msgtypes.ClientMessageType {
@@ -0,0 +1,429 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// Адреса тестового соединения client -> server.
+const (
+	testClientIP   = "10.0.0.7"
+	testClientPort = 40000
+	testServerIP   = "10.0.0.5"
+	testServerPort = 5432
+	testStreamKey  = "10.0.0.7:40000->10.0.0.5:5432"
+)
+
+var testStart = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// quietLogger отбрасывает диагностику: предупреждения о пропусках и рассинхронизации
+// в тестах ожидаемы.
+func quietLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// pgMessage собирает кадр протокола с байтом типа typ и телом body.
+func pgMessage(typ byte, body string) []byte {
+	b := make([]byte, 5, 5+len(body))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:5], uint32(4+len(body)))
+	return append(b, body...)
+}
+
+// pgStartup собирает StartupMessage протокола 3.0 с параметрами в виде пар имя, значение.
+func pgStartup(params ...string) []byte {
+	body := []byte{0, 3, 0, 0}
+	for _, p := range params {
+		body = append(append(body, p...), 0)
+	}
+	body = append(body, 0)
+	b := binary.BigEndian.AppendUint32(nil, uint32(4+len(body)))
+	return append(b, body...)
+}
+
+func pgQuery(sql string) []byte {
+	return pgMessage('Q', sql+"\x00")
+}
+
+func pgReady() []byte {
+	return pgMessage('Z', "I")
+}
+
+func pgComplete(tag string) []byte {
+	return pgMessage('C', tag+"\x00")
+}
+
+// testConn подаёт в менеджер пакеты одного соединения testClientIP -> testServerIP,
+// следя за порядковыми номерами обоих направлений. Каждый пакет на миллисекунду
+// позже предыдущего.
+type testConn struct {
+	m          *TCPStreamManager
+	ts         time.Time
+	cseq, sseq uint32
+}
+
+func newTestManager() *TCPStreamManager {
+	m := NewTCPStreamManager()
+	m.Logger = quietLogger()
+	return m
+}
+
+func newTestConn(m *TCPStreamManager) *testConn {
+	return &testConn{m: m, ts: testStart, cseq: 1000, sseq: 50000}
+}
+
+func (c *testConn) tick() time.Time {
+	c.ts = c.ts.Add(time.Millisecond)
+	return c.ts
+}
+
+// client отправляет data от клиента одним сегментом.
+func (c *testConn) client(t testing.TB, data ...[]byte) {
+	t.Helper()
+	var seg []byte
+	for _, d := range data {
+		seg = append(seg, d...)
+	}
+	c.clientAt(t, c.cseq, seg)
+	c.cseq += uint32(len(seg))
+}
+
+// clientAt отправляет сегмент клиента с явным порядковым номером, не сдвигая очередной.
+func (c *testConn) clientAt(t testing.TB, seq uint32, data []byte) {
+	t.Helper()
+	if err := c.m.AddPacket(data, c.tick(), testClientIP, testServerIP, testClientPort, testServerPort, seq, testServerIP, testServerPort); err != nil {
+		t.Fatalf("AddPacket: %v", err)
+	}
+}
+
+// server отправляет data от сервера одним сегментом.
+func (c *testConn) server(t testing.TB, data ...[]byte) {
+	t.Helper()
+	var seg []byte
+	for _, d := range data {
+		seg = append(seg, d...)
+	}
+	if err := c.m.AddPacket(seg, c.tick(), testServerIP, testClientIP, testServerPort, testClientPort, c.sseq, testServerIP, testServerPort); err != nil {
+		t.Fatalf("AddPacket: %v", err)
+	}
+	c.sseq += uint32(len(seg))
+}
+
+// messageTypes возвращает байты типов сообщений (0 — сообщение без типа) строкой.
+func messageTypes(messages []PostgreSQLMessage) string {
+	b := make([]byte, len(messages))
+	for i, m := range messages {
+		b[i] = byte(m.Type)
+		if !m.Type.HaveTypeByte() {
+			b[i] = '0'
+		}
+	}
+	return string(b)
+}
+
+func TestRowReproducesWireBytes(t *testing.T) {
+	frames := [][]byte{
+		pgStartup("user", "app", "database", "shop"),
+		pgQuery("select 1"),
+		pgMessage('P', "s1\x00select $1\x00\x00\x01\x00\x00\x00\x17"),
+		pgMessage('S', ""),
+		pgMessage('X', ""),
+	}
+	m := newTestManager()
+	m.VerifyRoundtrip = true
+	c := newTestConn(m)
+	// все сообщения одним сегментом и по одному байту: границы сегментов не должны влиять
+	var wire []byte
+	for _, f := range frames {
+		wire = append(wire, f...)
+	}
+	c.client(t, wire[:7])
+	for i := 7; i < len(wire); i++ {
+		c.client(t, wire[i:i+1])
+	}
+
+	messages := m.FlushPartial()
+	if len(messages) != len(frames) {
+		t.Fatalf("got %d messages, want %d", len(messages), len(frames))
+	}
+	for i, msg := range messages {
+		if !bytes.Equal(msg.Row(), frames[i]) {
+			t.Errorf("message %d (%s): Row() = %q, wire %q", i, msg.Type, msg.Row(), frames[i])
+		}
+	}
+	if n := m.RoundtripMismatches(); n != 0 {
+		t.Errorf("RoundtripMismatches = %d", n)
+	}
+}
+
+func TestResetClearsResponseIndexes(t *testing.T) {
+	s := NewTCPStream()
+	s.setLogger(quietLogger())
+	s.addClientData(append(pgQuery("select 1"), pgQuery("select 2")...), testStart, 1)
+	s.addServerData(append(append(pgComplete("SELECT 1"), pgReady()...), pgComplete("SELECT 2")...), testStart, 1)
+	// индекс CommandComplete на простом запросе сдвигает только ReadyForQuery
+	if s.needCommandCompleteIndex != 1 || s.needReadyForQueryIndex != 1 {
+		t.Fatalf("before Reset: CommandComplete index %d, ReadyForQuery index %d", s.needCommandCompleteIndex, s.needReadyForQueryIndex)
+	}
+
+	s.Reset()
+	if s.needCommandCompleteIndex != 0 || s.needReadyForQueryIndex != 0 || s.expectedReady != 0 || s.seenReady != 0 {
+		t.Fatalf("Reset left counters: CommandComplete %d, ReadyForQuery %d, expected %d, seen %d",
+			s.needCommandCompleteIndex, s.needReadyForQueryIndex, s.expectedReady, s.seenReady)
+	}
+
+	// тот же поток после Reset: ответ относится к первому сообщению новой сессии
+	ts := testStart.Add(time.Second)
+	s.addClientData(pgQuery("select 3"), ts, 1)
+	s.addServerData(append(pgComplete("SELECT 3"), pgReady()...), ts, 1)
+	if len(s.completed) != 1 {
+		t.Fatalf("got %d messages after Reset, want 1", len(s.completed))
+	}
+	got := s.completed[0]
+	if got.CommandTag != "SELECT 3" || !got.CommandCompleteTimestamp.Equal(ts) || !got.ReadyForQueryTimestamp.Equal(ts) {
+		t.Errorf("after Reset: tag %q, CommandComplete %v, ReadyForQuery %v", got.CommandTag, got.CommandCompleteTimestamp, got.ReadyForQueryTimestamp)
+	}
+}
+
+// pgEncryptionRequest собирает SSLRequest или GSSENCRequest с кодом code.
+func pgEncryptionRequest(code uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, 8)
+	return binary.BigEndian.AppendUint32(b, code)
+}
+
+func TestEncryptionRequest(t *testing.T) {
+	startup := pgStartup("user", "app")
+	clientHello := []byte{0x16, 0x03, 0x01, 0x00, 0x05, 1, 2, 3, 4, 5}
+	tests := []struct {
+		name      string
+		request   uint32
+		answer    byte
+		then      []byte
+		types     string
+		encrypted bool
+	}{
+		{"ssl accepted", SSLRequestCode, 'S', clientHello, "", true},
+		{"ssl refused", SSLRequestCode, 'N', startup, "0", false},
+		{"gssenc accepted", GSSENCRequestCode, 'G', clientHello, "", true},
+		{"gssenc refused", GSSENCRequestCode, 'N', startup, "0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager()
+			c := newTestConn(m)
+			c.client(t, pgEncryptionRequest(tt.request))
+			c.server(t, []byte{tt.answer})
+			c.client(t, tt.then)
+			messages := m.FlushPartial()
+			if got := messageTypes(messages); got != tt.types {
+				t.Errorf("messages %q, want %q", got, tt.types)
+			}
+			if encrypted := len(m.EncryptedStreams()) > 0; encrypted != tt.encrypted {
+				t.Errorf("encrypted = %v, want %v", encrypted, tt.encrypted)
+			}
+		})
+	}
+}
+
+func TestEncryptionRequestWithPipelinedStartup(t *testing.T) {
+	// клиент отправил startup, не дождавшись ответа на SSLRequest: разбор ждёт ответа сервера
+	m := newTestManager()
+	c := newTestConn(m)
+	c.client(t, pgEncryptionRequest(SSLRequestCode), pgStartup("user", "app"))
+	c.server(t, []byte{'N'}, pgReady())
+	if got := messageTypes(m.FlushPartial()); got != "0" {
+		t.Errorf("messages %q, want the startup only", got)
+	}
+}
+
+func TestDirectTLSIsEncrypted(t *testing.T) {
+	m := newTestManager()
+	c := newTestConn(m)
+	c.client(t, []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01, 0x00, 0x01, 0xfc})
+	if messages := m.FlushPartial(); len(messages) != 0 {
+		t.Errorf("got %d messages from a TLS stream", len(messages))
+	}
+	if len(m.EncryptedStreams()) != 1 {
+		t.Error("direct TLS stream not reported as encrypted")
+	}
+}
+
+func TestReadyForQueryTimestamp(t *testing.T) {
+	m := newTestManager()
+	c := newTestConn(m)
+	c.client(t, pgQuery("select 1"))
+	c.server(t, pgComplete("SELECT 1"))
+	completeAt := c.ts
+	c.server(t, pgReady())
+	readyAt := c.ts
+
+	messages := m.FlushPartial()
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	got := messages[0]
+	if !got.CommandCompleteTimestamp.Equal(completeAt) {
+		t.Errorf("CommandCompleteTimestamp = %v, want %v", got.CommandCompleteTimestamp, completeAt)
+	}
+	if !got.ReadyForQueryTimestamp.Equal(readyAt) {
+		t.Errorf("ReadyForQueryTimestamp = %v, want %v", got.ReadyForQueryTimestamp, readyAt)
+	}
+}
+
+func TestReadyForQueryAfterPipeline(t *testing.T) {
+	// ReadyForQuery конвейера относится к Sync, а не к Parse/Bind/Execute
+	m := newTestManager()
+	c := newTestConn(m)
+	c.client(t,
+		pgMessage('P', "\x00select 1\x00\x00\x00"),
+		pgMessage('B', "\x00\x00\x00\x00\x00\x00\x00\x00"),
+		pgMessage('E', "\x00\x00\x00\x00\x00"),
+		pgMessage('S', ""),
+	)
+	c.server(t, pgMessage('1', ""), pgMessage('2', ""), pgComplete("SELECT 1"), pgReady())
+
+	messages := m.FlushPartial()
+	if got := messageTypes(messages); got != "PBES" {
+		t.Fatalf("messages %q, want PBES", got)
+	}
+	for i, msg := range messages {
+		if ready := !msg.ReadyForQueryTimestamp.IsZero(); ready != (msg.Type == 'S') {
+			t.Errorf("message %d (%s): ReadyForQueryTimestamp set = %v", i, msg.Type, ready)
+		}
+	}
+	if messages[2].CommandTag != "SELECT 1" {
+		t.Errorf("Execute tag = %q, want SELECT 1", messages[2].CommandTag)
+	}
+}
+
+func TestAddPacketStreamKey(t *testing.T) {
+	m := newTestManager()
+	// первый пакет соединения — от сервера: ключ всё равно строится от клиента к серверу
+	if err := m.AddPacket(pgReady(), testStart, testServerIP, testClientIP, testServerPort, testClientPort, 1, testServerIP, testServerPort); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddPacket(pgQuery("select 1"), testStart, testClientIP, testServerIP, testClientPort, testServerPort, 1, testServerIP, testServerPort); err != nil {
+		t.Fatal(err)
+	}
+	// другой порт клиента — другое соединение
+	if err := m.AddPacket(pgQuery("select 2"), testStart, testClientIP, testServerIP, testClientPort+1, testServerPort, 1, testServerIP, testServerPort); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.streams) != 2 {
+		t.Fatalf("got %d streams, want 2", len(m.streams))
+	}
+	s, ok := m.streams[testStreamKey]
+	if !ok {
+		t.Fatalf("no stream %s", testStreamKey)
+	}
+	if s.clientIP != testClientIP || s.clientPort != testClientPort {
+		t.Errorf("client side %s:%d, want %s:%d", s.clientIP, s.clientPort, testClientIP, testClientPort)
+	}
+	for _, msg := range m.FlushPartial() {
+		want := testStreamKey
+		if msg.ClientPort != testClientPort {
+			want = "10.0.0.7:40001->10.0.0.5:5432"
+		}
+		if msg.StreamID != want {
+			t.Errorf("message from port %d: StreamID %s, want %s", msg.ClientPort, msg.StreamID, want)
+		}
+	}
+}
+
+func TestTerminateClosesStream(t *testing.T) {
+	m := newTestManager()
+	var closedKey string
+	var closed []PostgreSQLMessage
+	m.OnStreamClosed = func(key string, messages []PostgreSQLMessage) {
+		closedKey, closed = key, messages
+	}
+	c := newTestConn(m)
+	c.client(t, pgQuery("select 1"))
+	c.client(t, pgMessage('X', ""))
+	// ответ на запрос ещё не получен: поток ждёт ReadyForQuery
+	if closed != nil {
+		t.Fatal("stream closed before the query was answered")
+	}
+	c.server(t, pgComplete("SELECT 1"), pgReady())
+
+	if closedKey != testStreamKey {
+		t.Fatalf("OnStreamClosed key %q, want %q", closedKey, testStreamKey)
+	}
+	if got := messageTypes(closed); got != "QX" {
+		t.Errorf("closed stream messages %q, want QX", got)
+	}
+	if closed[0].ReadyForQueryTimestamp.IsZero() {
+		t.Error("closed query has no ReadyForQuery timestamp")
+	}
+	if _, ok := m.streams[testStreamKey]; ok {
+		t.Error("terminated stream is still held by the manager")
+	}
+	if rest := m.CollectMessages(); len(rest) != 0 {
+		t.Errorf("CollectMessages returned %d messages of a closed stream", len(rest))
+	}
+
+	// запоздавшая повторная передача Terminate не открывает поток заново
+	c.clientAt(t, c.cseq-5, pgMessage('X', ""))
+	if len(m.streams) != 0 {
+		t.Error("late retransmit reopened the closed stream")
+	}
+}
+
+func TestTerminateWithoutCallbackKeepsMessages(t *testing.T) {
+	m := newTestManager()
+	c := newTestConn(m)
+	c.client(t, pgQuery("select 1"))
+	c.server(t, pgComplete("SELECT 1"), pgReady())
+	c.client(t, pgMessage('X', ""))
+	if len(m.streams) != 0 {
+		t.Error("terminated stream is still held by the manager")
+	}
+	if got := messageTypes(m.CollectMessages()); got != "QX" {
+		t.Errorf("CollectMessages = %q, want QX", got)
+	}
+}
+
+// pgNegotiateProtocol собирает NegotiateProtocolVersion с нераспознанными параметрами options.
+func pgNegotiateProtocol(options ...string) []byte {
+	body := binary.BigEndian.AppendUint32(nil, 0)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(options)))
+	for _, o := range options {
+		body = append(append(body, o...), 0)
+	}
+	return pgMessage('v', string(body))
+}
+
+func TestCompressionRejectedByServer(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		response []byte
+		want     string
+	}{
+		{"accepted", pgMessage('R', "\x00\x00\x00\x00"), "zstd"},
+		{"rejected", pgNegotiateProtocol(CompressionStartupParameter), ""},
+		{"other option rejected", pgNegotiateProtocol("_pq_.other"), "zstd"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager()
+			c := newTestConn(m)
+			c.client(t, pgStartup("user", "app", CompressionStartupParameter, "zstd"))
+			c.server(t, tt.response, pgReady())
+			c.client(t, pgQuery("select 1"))
+
+			messages := m.FlushPartial()
+			if len(messages) != 2 {
+				t.Fatalf("got %d messages, want 2", len(messages))
+			}
+			for _, msg := range messages {
+				if msg.Compression != tt.want {
+					t.Errorf("%s: Compression = %q, want %q", msg.Type, msg.Compression, tt.want)
+				}
+			}
+		})
+	}
+}
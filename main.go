@@ -1,7 +1,8 @@
 package main
 
 import (
-	"log"
+	"log/slog"
+	"os"
 
 	"trafRep/cmd"
 )
@@ -10,8 +11,11 @@ func main() {
 
 	cmd.RootCmd.AddCommand(cmd.PrintCmd)
 	cmd.RootCmd.AddCommand(cmd.ReplayCmd)
+	cmd.RootCmd.AddCommand(cmd.ExportCmd)
+	cmd.RootCmd.AddCommand(cmd.StatsCmd)
 	err := cmd.RootCmd.Execute()
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("command failed", "err", err)
+		os.Exit(1)
 	}
 }